@@ -2,27 +2,51 @@ package main
 
 import (
 	"context"
-	"errors"
+	"crypto/tls"
 	"fmt"
-	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
-	"sync"
+	"syscall"
 	"time"
 
-	"github.com/coder/websocket"
-	"github.com/int32-dev/fastshare/internal/ws"
+	"github.com/int32-dev/fastshare/internal/relay"
 	"github.com/jessevdk/go-flags"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 type Options struct {
-	Port int `short:"p" long:"port" default:"8080" description:"port to use for server"`
+	Port      int    `short:"p" long:"port" default:"8080" description:"port to use for server"`
+	Store     string `long:"store" default:"memory" choice:"memory" choice:"file" description:"where to keep sessions. file keeps them across restarts, so they can still be looked up"`
+	StorePath string `long:"store-path" default:"fastshare-sessions.json" description:"file to keep sessions in with --store file"`
+
+	PairCodeLength   int    `long:"pair-code-length" default:"8" description:"length of the pair codes handed out to senders"`
+	PairCodeAlphabet string `long:"pair-code-alphabet" default:"23456789abcdefghjkmnpqrstuvwxyz" description:"letters and digits pair codes are made of"`
+
+	MaxFailures   int           `long:"max-failures" default:"10" description:"unknown pair codes an address may try within --failure-window before it's locked out. 0 never locks out"`
+	FailureWindow time.Duration `long:"failure-window" default:"1m" description:"window unknown pair codes are counted in"`
+	Lockout       time.Duration `long:"lockout" default:"15m" description:"how long an address is locked out"`
+	TrustProxy    bool          `long:"trust-proxy" description:"count failures for the address in X-Forwarded-For, only when behind a reverse proxy that sets it"`
+
+	StoredDir          string        `long:"stored-dir" description:"directory to keep offline shares in until they're downloaded. offline shares are turned off without it"`
+	StoredMaxSize      int64         `long:"stored-max-size" default:"1024" description:"largest offline share in MiB"`
+	StoredQuota        int64         `long:"stored-quota" default:"10240" description:"MiB all offline shares together may take up"`
+	StoredAddressQuota int64         `long:"stored-address-quota" default:"2048" description:"MiB the offline shares uploaded from one address may take up, 0 for no limit"`
+	StoredTTL          time.Duration `long:"stored-ttl" default:"24h" description:"how long an offline share can be downloaded"`
+
+	AdminToken string `long:"admin-token" env:"FASTSHARE_ADMIN_TOKEN" description:"token for the session API under /api/sessions, which is turned off without it"`
+
+	TLSCert      string   `long:"tls-cert" description:"PEM certificate chain to serve https with, together with --tls-key. loaded again on SIGHUP"`
+	TLSKey       string   `long:"tls-key" description:"PEM private key of --tls-cert"`
+	ACMEDomains  []string `long:"acme-domain" description:"get certificates for this domain from Let's Encrypt automatically, can be specified multiple times. needs -p 443, or --redirect-port 80 for the http challenge"`
+	ACMEEmail    string   `long:"acme-email" description:"email Let's Encrypt sends notices about the certificates to"`
+	ACMECache    string   `long:"acme-cache" default:"fastshare-certs" description:"directory the automatic certificates and account key are kept in"`
+	RedirectPort int      `long:"redirect-port" default:"0" description:"port to redirect http to https on, usually 80. with --acme-domain it also answers http challenges. 0 turns it off"`
 }
 
 var options Options
 var parser = flags.NewParser(&options, flags.Default)
-var senderConLock = sync.Mutex{}
-var senderConnections = make(map[string]*SenderConnection)
 
 func main() {
 	_, err := parser.Parse()
@@ -30,184 +54,142 @@ func main() {
 		return
 	}
 
-	mux := http.NewServeMux()
-	mux.HandleFunc("/ws", errorMiddleware(handleWsConnect))
+	err = checkTLSOptions()
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
+
+	store, err := openStore()
+	if err != nil {
+		fmt.Println("error:", err)
+		return
+	}
 
-	go monitorConnections()
+	defer store.Close()
 
-	err = http.ListenAndServe(":"+strconv.Itoa(options.Port), mux)
+	codes, err := relay.NewPairCodes(options.PairCodeLength, options.PairCodeAlphabet)
 	if err != nil {
 		fmt.Println("error:", err)
+		return
 	}
-}
 
-func monitorConnections() {
-	for range time.Tick(time.Second * 5) {
-		for k, s := range senderConnections {
-			if time.Since(s.added) > expireTime && !s.getReceiverConnected() {
-				err := s.conn.Close(ws.StatusTimeoutError, "timed out waiting for receiver")
-				if err != nil {
-					fmt.Println(err)
-				}
-
-				deleteSenderConnection(k)
-				fmt.Println("sender expired:", k)
-				continue
-			}
-		}
+	server := relay.NewServer(relay.NewRegistry(store, codes))
+	server.TrustProxy = options.TrustProxy
+	server.AdminToken = options.AdminToken
+	server.Limiter = nil
+	if options.MaxFailures > 0 {
+		server.Limiter = relay.NewLimiter(options.MaxFailures, options.FailureWindow, options.Lockout)
 	}
-}
 
-func errorMiddleware(next func(w http.ResponseWriter, r *http.Request) error) func(w http.ResponseWriter, r *http.Request) {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		err := next(w, r)
+	if options.StoredDir != "" {
+		server.Stored, err = relay.OpenStoredShares(options.StoredDir, codes, options.StoredMaxSize<<20, options.StoredQuota<<20, options.StoredTTL)
 		if err != nil {
 			fmt.Println("error:", err)
+			return
 		}
-	})
-}
 
-func deleteSenderConnection(paircode string) {
-	senderConLock.Lock()
-	defer senderConLock.Unlock()
-	conn, ok := senderConnections[paircode]
-	if ok {
-		delete(senderConnections, paircode)
-		conn.conn.Close(websocket.StatusAbnormalClosure, "")
+		server.Stored.AddressQuota = options.StoredAddressQuota << 20
 	}
-}
 
-type SenderConnection struct {
-	info              *ws.ClientInfo
-	conn              *websocket.Conn
-	m                 sync.Mutex
-	receiverConnected bool
-	added             time.Time
-}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
 
-const expireTime = time.Minute * 2
+	go server.Monitor(ctx)
 
-func newSenderConn(info *ws.ClientInfo, conn *websocket.Conn) *SenderConnection {
-	return &SenderConnection{
-		info:              info,
-		conn:              conn,
-		receiverConnected: false,
-		added:             time.Now(),
+	err = serve(server.Handler())
+	if err != nil {
+		fmt.Println("error:", err)
 	}
 }
 
-func handleWsConnect(w http.ResponseWriter, r *http.Request) error {
-	clientInfo, err := ws.NewClientInfoFromQueryString(r.URL.Query())
-	if err != nil {
-		http.Error(w, "error parsing headers", http.StatusBadRequest)
-		return err
+func checkTLSOptions() error {
+	if (options.TLSCert == "") != (options.TLSKey == "") {
+		return fmt.Errorf("--tls-cert and --tls-key are needed together")
 	}
 
-	paircode := r.URL.Query().Get(ws.PaircodeQuery)
-
-	if paircode == "" {
-		paircode = getNewPairCode()
-		conn, err := websocket.Accept(w, r, nil)
-		if err != nil {
-			return err
-		}
+	if options.TLSCert != "" && len(options.ACMEDomains) > 0 {
+		return fmt.Errorf("use either --tls-cert or --acme-domain")
+	}
 
-		msg, err := ws.GetJsonMessageBytes("pairCode", paircode)
-		if err != nil {
-			conn.CloseNow()
-			return err
-		}
+	if options.RedirectPort != 0 && options.TLSCert == "" && len(options.ACMEDomains) == 0 {
+		return fmt.Errorf("--redirect-port needs --tls-cert or --acme-domain")
+	}
 
-		conn.Write(context.Background(), websocket.MessageText, msg)
+	// Let's Encrypt only checks the domain on port 443, or over http on port
+	// 80 for the redirect listener to answer
+	if len(options.ACMEDomains) > 0 && options.Port != 443 && options.RedirectPort != 80 {
+		return fmt.Errorf("--acme-domain needs -p 443 or --redirect-port 80, Let's Encrypt only checks ports 443 and 80")
+	}
 
-		senderConnections[paircode] = newSenderConn(clientInfo, conn)
-	} else {
-		sender, ok := senderConnections[paircode]
-		if !ok {
-			http.Error(w, "no sender found", http.StatusNotFound)
-			return fmt.Errorf("no sender found")
-		}
+	return nil
+}
 
-		sender.updateReceiverConnected(true)
-		defer sender.updateReceiverConnected(false)
-		defer deleteSenderConnection(paircode)
+// serve serves handler on --port, over https if a certificate was given or
+// is fetched automatically.
+func serve(handler http.Handler) error {
+	addr := ":" + strconv.Itoa(options.Port)
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	redirect := relay.RedirectHandler(options.Port)
 
-		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{})
+	switch {
+	case options.TLSCert != "":
+		cert, err := relay.LoadCertificate(options.TLSCert, options.TLSKey)
 		if err != nil {
 			return err
 		}
 
-		msg, err := ws.GetJsonMessageBytes("senderInfo", sender.info)
-		if err != nil {
-			return err
+		go reloadOnHangup(cert)
+		tlsConfig.GetCertificate = cert.GetCertificate
+	case len(options.ACMEDomains) > 0:
+		manager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(options.ACMEDomains...),
+			Cache:      autocert.DirCache(options.ACMECache),
+			Email:      options.ACMEEmail,
 		}
 
-		err = conn.Write(context.Background(), websocket.MessageText, msg)
-		if err != nil {
-			return err
-		}
+		tlsConfig = manager.TLSConfig()
+		tlsConfig.MinVersion = tls.VersionTLS12
+		redirect = manager.HTTPHandler(redirect)
+	default:
+		return http.ListenAndServe(addr, handler)
+	}
 
-		ctx, cancel := context.WithCancel(context.Background())
+	if options.RedirectPort != 0 {
 		go func() {
-			pump(ctx, sender.conn, conn)
-			cancel()
+			err := http.ListenAndServe(":"+strconv.Itoa(options.RedirectPort), redirect)
+			if err != nil {
+				fmt.Println("error redirecting to https:", err)
+			}
 		}()
-		pump(ctx, conn, sender.conn)
-		cancel()
 	}
 
-	return nil
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+	return server.ListenAndServeTLS("", "")
 }
 
-func (s *SenderConnection) updateReceiverConnected(connected bool) {
-	s.m.Lock()
-	defer s.m.Unlock()
-	s.receiverConnected = connected
-}
-
-func (s *SenderConnection) getReceiverConnected() bool {
-	s.m.Lock()
-	defer s.m.Unlock()
-	return s.receiverConnected
-}
+// reloadOnHangup loads the certificate again on every SIGHUP, like after it
+// was renewed.
+func reloadOnHangup(cert *relay.Certificate) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
 
-func getNewPairCode() string {
-	for {
-		pairCode := rand.Int31n(10000)
-		if _, ok := senderConnections[fmt.Sprintf("%04d", pairCode)]; !ok {
-			return fmt.Sprintf("%04d", pairCode)
+	for range hangup {
+		err := cert.Reload()
+		if err != nil {
+			fmt.Println("error:", err, "- keeping the old certificate")
+			continue
 		}
+
+		fmt.Println("certificate reloaded")
 	}
 }
 
-func pump(ctx context.Context, r *websocket.Conn, s *websocket.Conn) {
-	for {
-		msgType, message, err := s.Read(ctx)
-		if err != nil {
-			if closeStatus := websocket.CloseStatus(err); closeStatus > 0 {
-				err = r.Close(closeStatus, string(message))
-				if err != nil {
-					fmt.Printf("error closing connection: %v\n", err)
-				}
-
-				return
-			}
-
-			if errors.Is(err, context.Canceled) {
-				fmt.Println("context canceled")
-				r.Close(websocket.StatusNormalClosure, "")
-			}
-
-			fmt.Println("pump:", err)
-			return
-		}
-
-		if msgType == websocket.MessageText || msgType == websocket.MessageBinary {
-			err := r.Write(ctx, msgType, message)
-			if err != nil {
-				fmt.Println("error writing:", err)
-				return
-			}
-		}
+func openStore() (relay.SessionStore, error) {
+	if options.Store == "file" {
+		return relay.OpenFileStore(options.StorePath)
 	}
+
+	return relay.NewMemoryStore(), nil
 }
@@ -1,10 +1,21 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/int32-dev/fastshare"
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+	"github.com/int32-dev/fastshare/internal/transfer"
 	"github.com/jessevdk/go-flags"
 	"golang.org/x/term"
 )
@@ -13,10 +24,23 @@ type Options struct {
 	Port     int    `short:"p" long:"port" default:"65432" description:"port to use for sharing"`
 	Web      string `short:"w" long:"web" description:"web server to route share through (required if sending to web client)"`
 	Insecure bool   `long:"insecure-ws" description:"use insecure websocket connection (no https)"`
+	Offline  bool   `long:"offline" description:"store the share on the web server (-w) so it can be received later, the receiver uses --offline too"`
+	Verify   bool   `long:"verify" description:"ask to confirm that both devices show the same verification code before transferring"`
+	Cipher   string `long:"cipher" description:"only use this cipher: aes-256-gcm, chacha20-poly1305 or xchacha20-poly1305. by default AES-GCM is preferred if the cpu supports it"`
+	Curve    string `long:"curve" description:"only use this key exchange: p256 (SPAKE2 on P-256) or p256+x25519 (SPAKE2 on P-256 plus an X25519 exchange mixed into the key)"`
+	Progress string `long:"progress" default:"bar" choice:"bar" choice:"quiet" choice:"json" description:"how progress and status lines are shown on stderr: a progress bar below the status lines, nothing, or a json object per line"`
+
+	DiscoveryTimeout time.Duration `long:"discovery-timeout" default:"0" description:"give up if the other device isn't found within this time, like 30s or 5m. 0 waits until canceled"`
+	IdleTimeout      time.Duration `long:"idle-timeout" default:"5m" description:"give up once nothing was sent or received for this long. 0 waits forever"`
+	Timeout          time.Duration `long:"timeout" default:"0" description:"give up if the whole share takes longer than this. 0 for no limit"`
 }
 
 var options Options
 
+// console is where the user is told and asked things. With -o - stdout only
+// carries the received data, and console is stderr.
+var console io.Writer = os.Stdout
+
 var parser = flags.NewParser(&options, flags.Default)
 
 func main() {
@@ -26,8 +50,193 @@ func main() {
 	}
 }
 
+// shareContext is canceled by Ctrl-C, or once --timeout passed. Canceling
+// closes the connections, and a second Ctrl-C exits right away.
+func shareContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	context.AfterFunc(ctx, stop)
+
+	if options.Timeout == 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, options.Timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// shareError explains why ctx ended the share.
+func shareError(err error) error {
+	if errors.Is(err, context.Canceled) {
+		return fmt.Errorf("canceled")
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("share took longer than --timeout %s", options.Timeout)
+	}
+
+	return err
+}
+
+// confirmVerificationCode returns the fastshare.SenderOptions.Verify used with
+// --verify. The question is given up on once ctx is done.
+func confirmVerificationCode(ctx context.Context) func(code string) error {
+	return func(code string) error {
+		// the code is in the question, it isn't shown anywhere else with
+		// --progress quiet
+		yes, err := ask(ctx, fmt.Sprintf("Does the other device show the verification code %q?", code))
+		if err != nil {
+			return err
+		}
+
+		if !yes {
+			return transfer.ErrNotVerified
+		}
+
+		return nil
+	}
+}
+
+// ask asks a yes or no question on stdin, anything but yes is no. It is given
+// up on once ctx is done.
+func ask(ctx context.Context, question string) (bool, error) {
+	answer, err := readLine(ctx, question+" [y/N] ")
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+
+	answer = strings.ToLower(answer)
+	return answer == "y" || answer == "yes", nil
+}
+
+// readLine shows prompt and reads a line from stdin, without surrounding
+// spaces. It returns io.EOF once stdin ended, and is given up on once ctx is
+// done.
+func readLine(ctx context.Context, prompt string) (string, error) {
+	return stdinLines.read(ctx, prompt)
+}
+
+// stdinLines is the only reader of stdin lines, so lines that were buffered
+// are never dropped.
+var stdinLines = &lineReader{
+	want:  make(chan struct{}, 1),
+	lines: make(chan line, 1),
+}
+
+type line struct {
+	text string
+	err  error
+}
+
+// lineReader reads a line from stdin on a single goroutine whenever one is
+// wanted. A line that arrives after read was given up on is returned by the
+// next read.
+type lineReader struct {
+	once  sync.Once
+	want  chan struct{}
+	lines chan line
+
+	m sync.Mutex
+	// pending is set while a line was wanted but not returned yet
+	pending bool
+}
+
+func (r *lineReader) read(ctx context.Context, prompt string) (string, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.once.Do(func() {
+		go func() {
+			reader := bufio.NewReader(os.Stdin)
+			for range r.want {
+				text, err := reader.ReadString('\n')
+				r.lines <- line{text: text, err: err}
+			}
+		}()
+	})
+
+	fmt.Fprint(console, prompt)
+
+	if !r.pending {
+		r.want <- struct{}{}
+		r.pending = true
+	}
+
+	select {
+	case l := <-r.lines:
+		r.pending = false
+		if l.err != nil && l.text == "" {
+			fmt.Fprintln(console)
+			return "", l.err
+		}
+
+		return strings.TrimSpace(l.text), nil
+	case <-ctx.Done():
+		fmt.Fprintln(console)
+		return "", ctx.Err()
+	}
+}
+
+// shareOptions are the options shared by send and receive, peer names the
+// other side in status lines.
+func shareOptions(peer string) fastshare.Options {
+	progress := progress()
+	opts := fastshare.Options{
+		Port:     options.Port,
+		Offline:  options.Offline,
+		Cipher:   options.Cipher,
+		Curve:    options.Curve,
+		Progress: progress,
+		Log:      progress,
+		Verification: func(suite string, code string) {
+			fmt.Fprintln(progress, "encryption:", suite)
+			fmt.Fprintln(progress, "verification code:", code)
+		},
+		PeerFound: func(addr string) {
+			fmt.Fprintln(progress, peer, "found at", addr)
+		},
+
+		DiscoveryTimeout: options.DiscoveryTimeout,
+		IdleTimeout:      options.IdleTimeout,
+	}
+
+	if options.Web != "" {
+		opts.RelayURL = "wss://" + options.Web + "/ws"
+		if options.Insecure {
+			opts.RelayURL = "ws://" + options.Web + "/ws"
+		}
+	}
+
+	return opts
+}
+
+// reporter shows progress, and status lines written to it.
+type reporter interface {
+	encryptservice.ProgressReporter
+	io.Writer
+}
+
+// progress is the reporter of the command, status lines of the CLI go to it
+// as well.
+var progress = sync.OnceValue(progressReporter)
+
+// progressReporter reports to stderr as chosen with --progress, so it never
+// mixes with received data printed to stdout.
+func progressReporter() reporter {
+	switch options.Progress {
+	case "quiet":
+		return encryptservice.QuietProgress{}
+	case "json":
+		return encryptservice.NewJsonProgress(os.Stderr)
+	}
+
+	return encryptservice.NewTerminalProgress(os.Stderr)
+}
+
 func getSecretCode() string {
-	fmt.Println("Enter share code:")
+	fmt.Fprintln(console, "Enter share code:")
 	password, err := term.ReadPassword(int(os.Stdin.Fd()))
 	if err != nil {
 		os.Exit(1)
@@ -1,18 +1,33 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"strconv"
+	"strings"
 
-	"github.com/int32-dev/fastshare/internal/shareservice"
-	"github.com/int32-dev/fastshare/internal/ws"
+	"github.com/int32-dev/fastshare"
+	"github.com/int32-dev/fastshare/internal/transfer"
 )
 
 type ReceiveCommand struct {
-	Code string `short:"c" long:"code" description:"share code provided by sender. If not specified, will prompt for code."`
-	File string `short:"f" long:"file" description:"file to write output to. if not specified, prints to stdout"`
+	Code    string `short:"c" long:"code" description:"share code provided by sender. If not specified, will prompt for code."`
+	Output  string `short:"o" long:"output" description:"file to write output to when receiving a single file, directory archive or message, - streams it to stdout. if not specified, files are saved under the sender's file name and messages are printed to stdout"`
+	File    string `short:"f" long:"file" description:"same as -o"`
+	Session bool   `long:"session" description:"if the sender started a session, keep the connection open afterwards to send and receive more, see the session command"`
+	ReceiveOptions
+}
+
+// ReceiveOptions are shared by the commands that receive files.
+type ReceiveOptions struct {
+	Dir     string `short:"d" long:"dir" description:"directory to write received files and directories into. defaults to the current directory"`
+	Force   bool   `long:"force" description:"replace files and directories that already exist, once the new ones were received and verified"`
+	Rename  bool   `long:"rename" description:"keep files and directories that already exist and number the new ones, like \"report (1).pdf\""`
+	Yes     bool   `short:"y" long:"yes" description:"accept the share without asking"`
+	MaxSize string `long:"max-size" description:"reject shares larger than this without asking, like 500M or 2G. shares of unknown size are rejected too"`
 }
 
 var receiveCommand ReceiveCommand
@@ -23,56 +38,307 @@ func init() {
 }
 
 func (rc *ReceiveCommand) Execute(args []string) error {
+	output := receiveCommand.Output
+	if output == "" {
+		output = receiveCommand.File
+	}
+
+	if receiveCommand.Session && output != "" {
+		return fmt.Errorf("-o can't be used with --session, use -d")
+	}
+
+	// the data is the only thing on stdout, everything else goes to stderr
+	if output == "-" {
+		console = os.Stderr
+	}
+
+	ctx, cancel := shareContext()
+	defer cancel()
+
+	newSink, err := receiveCommand.sinks(ctx, output)
+	if err != nil {
+		return err
+	}
+
 	if receiveCommand.Code == "" {
 		receiveCommand.Code = getSecretCode()
-		fmt.Println("Waiting for sender...")
+		fmt.Fprintln(progress(), "Waiting for sender...")
 	}
 
-	var w io.Writer
+	receiver, err := fastshare.NewReceiver(receiveCommand.Code, shareOptions("Sender"))
+	if err != nil {
+		return err
+	}
 
-	printOutput := true
-	if receiveCommand.File != "" {
-		printOutput = false
-		file, err := os.OpenFile(receiveCommand.File, os.O_CREATE|os.O_RDWR, 0644)
-		if err != nil {
-			return err
-		}
+	var sink fastshare.Sink = newSink()
+	if output == "-" {
+		sink = &stdoutSink{prompts: newSink().prompts, out: os.Stdout}
+	}
+
+	if receiveCommand.Session {
+		peer := newSessionPeer(ctx, newSink)
+		defer peer.closeSources()
+
+		sink = &joiningSink{outputSink: newSink(), peer: peer}
+	}
+
+	err = receiver.Receive(ctx, sink)
+	if errors.Is(err, fastshare.ErrRejected) {
+		fmt.Fprintln(console, "Share rejected.")
+		return nil
+	}
 
-		defer file.Close()
+	if err != nil {
+		return shareError(err)
+	}
+
+	return nil
+}
 
-		w = file
-	} else {
-		w = bytes.NewBuffer(make([]byte, 0, 4096))
+// sinks checks the options, and returns a function that makes a new sink for
+// every share. They write a single entry to output if it is set.
+func (o *ReceiveOptions) sinks(ctx context.Context, output string) (func() *outputSink, error) {
+	if o.Force && o.Rename {
+		return nil, fmt.Errorf("--force and --rename can't be used together")
 	}
 
-	if options.Web != "" {
-		url := options.Web + "/ws"
-		if options.Insecure {
-			url = "ws://" + url
-		} else {
-			url = "wss://" + url
+	overwrite := transfer.OVERWRITE_REFUSE
+	if o.Force {
+		overwrite = transfer.OVERWRITE_REPLACE
+	} else if o.Rename {
+		overwrite = transfer.OVERWRITE_RENAME
+	}
+
+	maxSize, err := parseSize(o.MaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --max-size: %w", err)
+	}
+
+	p := &prompts{accept: acceptShare(ctx, maxSize, o.MaxSize, o.Yes)}
+	if options.Verify {
+		p.verify = confirmVerificationCode(ctx)
+	}
+
+	dir := o.Dir
+	if dir == "" {
+		dir = "."
+	}
+
+	return func() *outputSink {
+		sink := fastshare.NewDirSink(dir)
+		if output != "" {
+			sink = fastshare.NewFileSink(output)
 		}
 
-		err := ws.Receive(receiveCommand.Code, url, w)
-		if err != nil {
-			return err
+		sink.Overwrite = overwrite
+		return &outputSink{prompts: p, DirSink: sink, file: output}
+	}, nil
+}
+
+// acceptShare shows what the sender is about to send and asks whether to
+// receive it, unless --yes or --max-size decided already.
+func acceptShare(ctx context.Context, maxSize int64, maxSizeFlag string, yes bool) func(manifest *transfer.Manifest) error {
+	return func(manifest *transfer.Manifest) error {
+		// a session that starts with nothing
+		if len(manifest.Files) == 0 {
+			return nil
+		}
+
+		// only a status line if nobody is asked
+		w := console
+		if yes {
+			w = progress()
 		}
-	} else {
-		ss, err := shareservice.NewLocalShareService(options.Port, receiveCommand.Code)
+
+		fmt.Fprintln(w, "The sender wants to send:")
+		for _, info := range manifest.Files {
+			fmt.Fprintln(w, " ", transfer.Describe(info))
+		}
+
+		total, known := manifest.TotalSize()
+		if known {
+			fmt.Fprintf(w, "total: %.2f MB\n", float64(total)/1024.0/1024.0)
+		}
+
+		if maxSize > 0 && !known {
+			return fmt.Errorf("share is of unknown size, rejected because of --max-size")
+		}
+
+		if maxSize > 0 && total > maxSize {
+			return fmt.Errorf("share is larger than --max-size %s", maxSizeFlag)
+		}
+
+		if yes {
+			return nil
+		}
+
+		accepted, err := ask(ctx, "Accept?")
 		if err != nil {
 			return err
 		}
 
-		err = ss.Receive(w)
+		if !accepted {
+			return fastshare.ErrRejected
+		}
+
+		return nil
+	}
+}
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// parseSize parses a number of bytes with an optional K, M, G or T suffix, 0
+// if s is empty.
+func parseSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	s = strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B")
+	number := strings.TrimRight(s, "KMGT")
+	unit, ok := sizeUnits[s[len(number):]]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit in %q", s)
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a size", s)
+	}
+
+	return int64(n * float64(unit)), nil
+}
+
+// prompts ask the user about the share, with --verify and before accepting
+// it.
+type prompts struct {
+	// verify is nil without --verify
+	verify func(code string) error
+	accept func(manifest *transfer.Manifest) error
+}
+
+func (p *prompts) Verify(code string) error {
+	if p.verify == nil {
+		return nil
+	}
+
+	return p.verify(code)
+}
+
+func (p *prompts) Accept(manifest *transfer.Manifest) error {
+	return p.accept(manifest)
+}
+
+// stdoutSink streams the single entry of a share to stdout as its records are
+// verified, for piping it into another program. Directories arrive as a tar
+// archive. The sha256 of the whole entry can only be checked at the end, a
+// mismatch is reported after the data was written.
+type stdoutSink struct {
+	*prompts
+	out io.Writer
+}
+
+func (s *stdoutSink) Prepare(manifest *transfer.Manifest) error {
+	if len(manifest.Files) != 1 {
+		return fmt.Errorf("sender is sending %d files, use -d instead of -o -", len(manifest.Files))
+	}
+
+	return nil
+}
+
+func (s *stdoutSink) Open(info *transfer.FileInfo, offset int64) (transfer.EntryWriter, error) {
+	return &streamWriter{Writer: s.out}, nil
+}
+
+// outputSink writes a single received entry to the -o file if there is one.
+// Otherwise messages are printed to stdout, and files and directories go into
+// the -d directory under the sender's name, see fastshare.DirSink.
+type outputSink struct {
+	*prompts
+	*fastshare.DirSink
+	// file is the -o file, "" without it
+	file string
+}
+
+// Prepare picks the paths before anything is received, so an existing file
+// fails the share right away.
+func (s *outputSink) Prepare(manifest *transfer.Manifest) error {
+	if s.file != "" && len(manifest.Files) != 1 {
+		return fmt.Errorf("sender is sending %d files, use -d instead of -o", len(manifest.Files))
+	}
+
+	err := s.DirSink.Prepare(manifest)
+	if errors.Is(err, fastshare.ErrFileExists) {
+		return fmt.Errorf("%w, use --force to replace it or --rename to keep both", err)
+	}
+
+	return err
+}
+
+func (s *outputSink) Open(info *transfer.FileInfo, offset int64) (transfer.EntryWriter, error) {
+	if info.Mode.IsDir() {
+		if s.file != "" {
+			return nil, fmt.Errorf("sender is sending a directory, use -d or -o - instead of -o")
+		}
+
+		w, err := s.DirSink.Open(info, offset)
 		if err != nil {
-			return err
+			return nil, err
 		}
+
+		return &extractWriter{EntryWriter: w, path: s.Path(info)}, nil
 	}
 
-	if printOutput {
+	if s.Path(info) == "" {
 		fmt.Println("Received data:")
-		fmt.Printf("%s\n", w.(*bytes.Buffer).String())
+		return &streamWriter{Writer: os.Stdout, end: "\n"}, nil
+	}
+
+	fmt.Fprintln(progress(), "saving to", s.Path(info))
+	return s.DirSink.Open(info, offset)
+}
+
+// OpenStripe is only called for regular files, which always go to a file.
+func (s *outputSink) OpenStripe(info *transfer.FileInfo, offset int64) (transfer.StripeWriter, error) {
+	fmt.Fprintln(progress(), "saving to", s.Path(info))
+	return s.DirSink.OpenStripe(info, offset)
+}
+
+// streamWriter passes an entry on as it arrives, what was written can't be
+// taken back if it is aborted.
+type streamWriter struct {
+	io.Writer
+	// end is written once the entry is complete
+	end string
+}
+
+func (w *streamWriter) Close() error {
+	_, err := io.WriteString(w.Writer, w.end)
+	return err
+}
+
+func (w *streamWriter) Abort(err error) error {
+	return nil
+}
+
+// extractWriter tells the user where the directory went.
+type extractWriter struct {
+	transfer.EntryWriter
+	path string
+}
+
+func (w *extractWriter) Close() error {
+	err := w.EntryWriter.Close()
+	if err != nil {
+		return err
 	}
 
+	fmt.Fprintln(progress(), "Directory extracted to", w.path)
 	return nil
 }
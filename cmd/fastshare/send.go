@@ -1,20 +1,23 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
-	"io"
 	"os"
 
-	"github.com/int32-dev/fastshare/internal/sharephrase"
-	"github.com/int32-dev/fastshare/internal/shareservice"
-	"github.com/int32-dev/fastshare/internal/ws"
+	"github.com/int32-dev/fastshare"
 )
 
 type SendCommand struct {
-	File    string `short:"f" long:"file" description:"file to send"`
-	Message string `short:"m" long:"message" description:"message to send"`
-	Code    bool   `short:"c" long:"code" description:"enter share code manually. Will be prompted to enter password."`
+	Files          []string `short:"f" long:"file" description:"file or directory to send, - for stdin. can be specified multiple times, files can also be given as arguments"`
+	Message        string   `short:"m" long:"message" description:"message to send"`
+	Note           string   `short:"n" long:"note" description:"note shown to the receiver before the transfer starts"`
+	Code           bool     `short:"c" long:"code" description:"enter share code manually. Will be prompted to enter password."`
+	ChunkSize      int      `long:"chunk-size" description:"KiB of data per encrypted record, a multiple of 16 up to 1024 (defaults to 16)"`
+	Streams        int      `long:"streams" description:"number of connections large files are striped across in local mode, up to 64. 1 uses a single connection (defaults to 0, tuned from the measured throughput)"`
+	Compression    string   `long:"compression" description:"only offer this compression for file data: zstd, gzip or none. by default all are offered and the receiver picks"`
+	Session        bool     `long:"session" description:"keep the connection open after sending, so both sides can send more if the receiver uses --session too. see the session command"`
+	PairCode       string   `long:"pair-code" description:"use a pair code created with the web server's session API (-w) instead of a new one"`
+	ReceiveOptions `group:"Receiving in a session (with --session)"`
 }
 
 var sendCommand SendCommand
@@ -24,78 +27,98 @@ func init() {
 	parser.AddCommand("s", "send a message", "send a message or file to the receiver", &sendCommand)
 }
 
+// STDIN_NAME is what stdin is sent as, receivers without -o save it under it.
+const STDIN_NAME = "stdin"
+
 func (s *SendCommand) Execute(args []string) error {
-	var discoveryPhrase string
-	var r io.Reader
-	var totalSize int64
+	var sources []*fastshare.Source
 
 	if sendCommand.Message != "" {
-		r = bytes.NewBufferString(sendCommand.Message)
-		totalSize = int64(len(sendCommand.Message))
-	} else if sendCommand.File != "" {
-		file, err := os.OpenFile(sendCommand.File, os.O_RDONLY, 0644)
-		if err != nil {
-			return err
-		}
+		sources = append(sources, fastshare.MessageSource(sendCommand.Message))
+	}
+
+	stdin := false
+	for _, path := range append(sendCommand.Files, args...) {
+		if path == "-" {
+			if stdin {
+				return fmt.Errorf("stdin can only be sent once")
+			}
 
-		defer file.Close()
+			// sent until it ends, the length isn't known up front
+			stdin = true
+			sources = append(sources, fastshare.ReaderSource(STDIN_NAME, os.Stdin))
+			continue
+		}
 
-		info, err := file.Stat()
+		src, closer, err := fastshare.OpenSource(path)
 		if err != nil {
 			return err
 		}
 
-		totalSize = info.Size()
-		r = file
-	} else {
+		defer closer.Close()
+
+		sources = append(sources, src)
+	}
+
+	if sendCommand.Code && options.Offline {
+		return fmt.Errorf("-c can't be used with --offline, a stored share could be used to guess a chosen code")
+	}
+
+	if stdin && (sendCommand.Code || options.Verify || sendCommand.Session) {
+		return fmt.Errorf("-c, --verify and --session ask on stdin, which is being sent")
+	}
+
+	if len(sources) == 0 {
 		fmt.Println("Missing message or file to send.")
 		os.Exit(1)
 	}
 
-	if options.Web != "" {
-		url := options.Web + "/ws"
-		if options.Insecure {
-			url = "ws://" + url
-		} else {
-			url = "wss://" + url
-		}
+	// no default tag, "send" and "s" share the struct and the default of the
+	// unused one would overwrite the given value
+	opts := fastshare.SenderOptions{
+		Options:     shareOptions("Receiver"),
+		Note:        sendCommand.Note,
+		ChunkSize:   sendCommand.ChunkSize * 1024,
+		Streams:     sendCommand.Streams,
+		Compression: sendCommand.Compression,
+		PairCode:    sendCommand.PairCode,
+		ShareCode: func(code string) {
+			fmt.Println("share code:", code)
+		},
+	}
 
-		if sendCommand.Code {
-			discoveryPhrase = getSecretCode()
-			fmt.Println("Waiting for receiver...")
-		} else {
-			code, err := sharephrase.GetRandomPhrase(3, false)
-			if err != nil {
-				return err
-			}
+	if sendCommand.Code {
+		opts.Code = getSecretCode()
+		fmt.Fprintln(progress(), "Waiting for receiver...")
+	}
 
-			discoveryPhrase = code
-		}
+	ctx, cancel := shareContext()
+	defer cancel()
 
-		return ws.Send(discoveryPhrase, url, r, totalSize)
+	if options.Verify {
+		opts.Verify = confirmVerificationCode(ctx)
 	}
 
-	if sendCommand.Code {
-		discoveryPhrase = getSecretCode()
-		fmt.Println("Waiting for receiver...")
-	} else {
-		code, err := sharephrase.GetRandomPhrase(2, true)
+	if sendCommand.Session {
+		newSink, err := sendCommand.sinks(ctx, "")
 		if err != nil {
 			return err
 		}
 
-		discoveryPhrase = code
+		peer := newSessionPeer(ctx, newSink)
+		defer peer.closeSources()
+
+		opts.Session = peer
 	}
 
-	fmt.Println("share code:", discoveryPhrase)
-	ss, err := shareservice.NewLocalShareService(options.Port, discoveryPhrase)
+	sender, err := fastshare.NewSender(opts)
 	if err != nil {
 		return err
 	}
 
-	err = ss.Send(r, totalSize)
+	err = sender.Send(ctx, sources...)
 	if err != nil {
-		return err
+		return shareError(err)
 	}
 
 	fmt.Println("Message sent. Exiting.")
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/int32-dev/fastshare"
+)
+
+type SessionCommand struct {
+	Code string `short:"c" long:"code" description:"share code shown by the other device, to join its session. if not specified, a new session is started"`
+	ReceiveOptions
+}
+
+var sessionCommand SessionCommand
+
+func init() {
+	parser.AddCommand("session", "start or join a session", "keep a connection open and take turns sending files and messages both ways", &sessionCommand)
+}
+
+const SESSION_HELP = `your turn:
+  send <path>   send a file or directory
+  msg <text>    send a message
+  pass          let the other side go, an empty line does too
+  quit          end the session`
+
+func (sc *SessionCommand) Execute(args []string) error {
+	ctx, cancel := shareContext()
+	defer cancel()
+
+	newSink, err := sessionCommand.sinks(ctx, "")
+	if err != nil {
+		return err
+	}
+
+	peer := newSessionPeer(ctx, newSink)
+	defer peer.closeSources()
+
+	if sessionCommand.Code != "" {
+		receiver, err := fastshare.NewReceiver(sessionCommand.Code, shareOptions("Sender"))
+		if err != nil {
+			return err
+		}
+
+		err = receiver.Receive(ctx, &joiningSink{outputSink: newSink(), peer: peer})
+		if err != nil {
+			return shareError(err)
+		}
+
+		return nil
+	}
+
+	opts := fastshare.SenderOptions{
+		Options: shareOptions("Receiver"),
+		Session: peer,
+		ShareCode: func(code string) {
+			fmt.Println("share code:", code)
+		},
+	}
+
+	if options.Verify {
+		opts.Verify = confirmVerificationCode(ctx)
+	}
+
+	sender, err := fastshare.NewSender(opts)
+	if err != nil {
+		return err
+	}
+
+	// nothing is sent first, the device that joined goes first
+	err = sender.Send(ctx)
+	if err != nil {
+		return shareError(err)
+	}
+
+	return nil
+}
+
+// joiningSink receives the first share and joins the session the sender
+// offers.
+type joiningSink struct {
+	*outputSink
+	peer *sessionPeer
+}
+
+func (s *joiningSink) Session() fastshare.SessionPeer {
+	return s.peer
+}
+
+// sessionPeer asks the user what to send on every turn, and writes what the
+// other side sends like receive does.
+type sessionPeer struct {
+	ctx     context.Context
+	newSink func() *outputSink
+	// the sources sent on the last turn, closed on the next one
+	closers []io.Closer
+	helped  bool
+}
+
+func newSessionPeer(ctx context.Context, newSink func() *outputSink) *sessionPeer {
+	return &sessionPeer{ctx: ctx, newSink: newSink}
+}
+
+func (p *sessionPeer) Incoming() fastshare.Sink {
+	return p.newSink()
+}
+
+func (p *sessionPeer) Next() (*fastshare.Share, error) {
+	p.closeSources()
+
+	if !p.helped {
+		fmt.Println(SESSION_HELP)
+		p.helped = true
+	}
+
+	for {
+		line, err := readLine(p.ctx, "> ")
+		if errors.Is(err, io.EOF) {
+			return nil, fastshare.ErrSessionEnded
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		command, arg, _ := strings.Cut(line, " ")
+		arg = strings.TrimSpace(arg)
+
+		switch command {
+		case "", "pass":
+			return nil, nil
+		case "quit", "exit":
+			return nil, fastshare.ErrSessionEnded
+		case "msg":
+			if arg != "" {
+				return &fastshare.Share{Sources: []*fastshare.Source{fastshare.MessageSource(arg)}}, nil
+			}
+		case "send":
+			if arg == "" {
+				break
+			}
+
+			src, closer, err := fastshare.OpenSource(arg)
+			if err != nil {
+				fmt.Println(err)
+				continue
+			}
+
+			p.closers = append(p.closers, closer)
+
+			return &fastshare.Share{Sources: []*fastshare.Source{src}}, nil
+		}
+
+		fmt.Println(SESSION_HELP)
+	}
+}
+
+func (p *sessionPeer) closeSources() {
+	for _, c := range p.closers {
+		c.Close()
+	}
+
+	p.closers = nil
+}
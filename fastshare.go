@@ -0,0 +1,201 @@
+// Package fastshare sends files and messages between two devices, over the
+// local network or through a fastshare-server relay. Everything is end to end
+// encrypted with a key both devices agree on from a short share code.
+//
+// A Sender offers sources, a Receiver with the same share code writes them to
+// a Sink:
+//
+//	sender, err := fastshare.NewSender(fastshare.SenderOptions{})
+//	src, closer, err := fastshare.OpenSource("build/app.tar.gz")
+//	defer closer.Close()
+//	err = sender.Send(ctx, src)
+//
+//	receiver, err := fastshare.NewReceiver(code, fastshare.Options{})
+//	err = receiver.Receive(ctx, fastshare.NewDirSink("downloads"))
+//
+// Errors can be told apart with errors.Is and the Err variables below.
+package fastshare
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/discoverservice"
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+	"github.com/int32-dev/fastshare/internal/shareservice"
+	"github.com/int32-dev/fastshare/internal/transfer"
+	"github.com/int32-dev/fastshare/internal/ws"
+)
+
+const DEFAULT_PORT = 65432
+
+// Options are used by both the sender and the receiver.
+type Options struct {
+	// Port is used for discovery and the transfer on the local network, 0
+	// for DEFAULT_PORT
+	Port int
+	// RelayURL routes the share through a fastshare-server instead of the
+	// local network, like "wss://share.example.com/ws"
+	RelayURL string
+	// Offline stores the share on the relay, which keeps it for a while so
+	// the receiver can download it later. The receiver has to set it too.
+	Offline bool
+	// Cipher and Curve restrict the cipher suite, see encryption in the
+	// readme. Empty allows all of them.
+	Cipher string
+	Curve  string
+	// Progress is told how the file data is getting on, nil reports nothing
+	Progress ProgressReporter
+	// Log gets status lines like "waiting for receiver...", nil discards
+	// them
+	Log io.Writer
+	// Verification is called with the cipher suite and the verification
+	// code once both devices agreed on a key. They show the same code
+	// unless somebody sits between them, see SenderOptions.Verify.
+	Verification func(suite string, code string)
+	// PeerFound is called with the address of the peer found on the local
+	// network
+	PeerFound func(addr string)
+	// DiscoveryTimeout limits how long the peer is looked for, 0 looks until
+	// the context is done. Use a context deadline to limit the whole share.
+	DiscoveryTimeout time.Duration
+	// IdleTimeout fails the transfer once nothing could be sent or received
+	// for that long, 0 waits forever
+	IdleTimeout time.Duration
+}
+
+// Progress is how far the file data of one entry got.
+type Progress = encryptservice.Progress
+
+// ProgressReporter is told how a transfer is getting on, see ProgressFunc for
+// a simple one.
+type ProgressReporter = encryptservice.ProgressReporter
+
+type ProgressEvent int
+
+const (
+	PROGRESS_STARTED ProgressEvent = iota
+	PROGRESS_UPDATE
+	PROGRESS_FINISHED
+	PROGRESS_FAILED
+)
+
+// ProgressFunc is a ProgressReporter calling itself for every report, err is
+// only set for PROGRESS_FAILED.
+type ProgressFunc func(event ProgressEvent, p Progress, err error)
+
+func (f ProgressFunc) Started(p Progress)           { f(PROGRESS_STARTED, p, nil) }
+func (f ProgressFunc) Update(p Progress)            { f(PROGRESS_UPDATE, p, nil) }
+func (f ProgressFunc) Finished(p Progress)          { f(PROGRESS_FINISHED, p, nil) }
+func (f ProgressFunc) Failed(p Progress, err error) { f(PROGRESS_FAILED, p, err) }
+
+var (
+	// ErrInvalidOptions is returned by NewSender and NewReceiver
+	ErrInvalidOptions = fmt.Errorf("invalid options")
+	// ErrWrongShareCode means the peer used a different share code
+	ErrWrongShareCode = encryptservice.ErrWrongShareCode
+	// ErrNoCommonSuite means the peers allow no cipher suite in common
+	ErrNoCommonSuite = encryptservice.ErrNoCommonSuite
+	// ErrTooManyAttempts means too many receivers tried a wrong share code
+	ErrTooManyAttempts = discoverservice.ErrTooManyAttempts
+	// ErrNotVerified is returned when the verification code wasn't confirmed
+	ErrNotVerified = transfer.ErrNotVerified
+	// ErrRejected means the receiver didn't accept the share, see AcceptSink
+	ErrRejected = transfer.ErrRejected
+	// ErrSessionEnded is returned by SessionPeer.Next to end the session
+	ErrSessionEnded = transfer.ErrSessionEnded
+	// ErrTruncated means the peer stopped in the middle of a file
+	ErrTruncated = encryptservice.ErrTruncated
+	// ErrDigestMismatch means a received file doesn't match the sender's
+	// sha256, it is not kept
+	ErrDigestMismatch = transfer.ErrDigestMismatch
+	// ErrInvalidName is returned for a file name that isn't a single path
+	// element
+	ErrInvalidName = transfer.ErrInvalidName
+	// ErrDuplicateName is returned when two sources have the same name
+	ErrDuplicateName = transfer.ErrDuplicateName
+	// ErrFileExists means a received entry already exists and the sink
+	// refuses to overwrite it
+	ErrFileExists = transfer.ErrFileExists
+	// ErrUnsupportedVersion means the peer runs an incompatible version
+	ErrUnsupportedVersion = transfer.ErrUnsupportedVersion
+	// ErrDiscoveryTimeout means no peer was found within DiscoveryTimeout
+	ErrDiscoveryTimeout = transfer.ErrDiscoveryTimeout
+	// ErrIdleTimeout means nothing was sent or received for IdleTimeout
+	ErrIdleTimeout = transfer.ErrIdleTimeout
+	// ErrPeerCanceled means the peer canceled the transfer
+	ErrPeerCanceled = transfer.ErrPeerCanceled
+	// ErrNoSender means the relay has no sender for the share code
+	ErrNoSender = ws.ErrNoSender
+	// ErrSenderBusy means another receiver already connected to the sender
+	// through the relay
+	ErrSenderBusy = ws.ErrSenderBusy
+	// ErrLockedOut means the relay refuses share codes from this address for
+	// a while, after too many unknown ones
+	ErrLockedOut = ws.ErrLockedOut
+	// ErrNotStored means the relay keeps no offline share for the share code
+	ErrNotStored = ws.ErrNotStored
+	// ErrCanceledByRelay means the relay's admin canceled the share
+	ErrCanceledByRelay = ws.ErrCanceledByRelay
+	// ErrUnknownPairCode means the relay has no session for
+	// SenderOptions.PairCode
+	ErrUnknownPairCode = ws.ErrUnknownPairCode
+	// ErrPairCodeClaimed means another sender already uses
+	// SenderOptions.PairCode
+	ErrPairCodeClaimed = ws.ErrPairCodeClaimed
+)
+
+func (o *Options) port() int {
+	if o.Port == 0 {
+		return DEFAULT_PORT
+	}
+
+	return o.Port
+}
+
+// check rejects options that don't go together.
+func (o *Options) check() error {
+	if o.Offline && o.RelayURL == "" {
+		return fmt.Errorf("%w: offline shares are stored on a relay, RelayURL is missing", ErrInvalidOptions)
+	}
+
+	return nil
+}
+
+func (o *Options) suites() (encryptservice.Suites, error) {
+	suites, err := encryptservice.NewSuites(o.Cipher, o.Curve)
+	if err != nil {
+		return suites, fmt.Errorf("%w: %w", ErrInvalidOptions, err)
+	}
+
+	return suites, nil
+}
+
+func (o *Options) relay(suites encryptservice.Suites) *ws.Options {
+	return &ws.Options{
+		Suites:           suites,
+		Progress:         o.Progress,
+		Status:           o.status(),
+		DiscoveryTimeout: o.DiscoveryTimeout,
+		IdleTimeout:      o.IdleTimeout,
+	}
+}
+
+func (o *Options) local(suites encryptservice.Suites) *shareservice.Options {
+	return &shareservice.Options{
+		Suites:           suites,
+		Progress:         o.Progress,
+		Status:           o.status(),
+		DiscoveryTimeout: o.DiscoveryTimeout,
+		IdleTimeout:      o.IdleTimeout,
+	}
+}
+
+func (o *Options) status() encryptservice.Status {
+	return encryptservice.Status{
+		Log:          o.Log,
+		Verification: o.Verification,
+		PeerFound:    o.PeerFound,
+	}
+}
@@ -0,0 +1,254 @@
+package fastshare
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+	"github.com/int32-dev/fastshare/internal/transfer"
+)
+
+const TEST_SHARE_CODE = "test share code"
+
+func TestInvalidOptions(t *testing.T) {
+	_, err := NewSender(SenderOptions{Options: Options{Cipher: "rot13"}})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Error("unknown cipher:", err)
+	}
+
+	_, err = NewSender(SenderOptions{ChunkSize: 1000})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Error("odd chunk size:", err)
+	}
+
+	_, err = NewSender(SenderOptions{Streams: -1})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Error("negative streams:", err)
+	}
+
+	_, err = NewSender(SenderOptions{Compression: "lzma"})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Error("unknown compression:", err)
+	}
+
+	_, err = NewSender(SenderOptions{Options: Options{RelayURL: "wss://share.example.com/ws", Offline: true}, Code: "short"})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Error("chosen offline code:", err)
+	}
+
+	_, err = NewReceiver("", Options{})
+	if !errors.Is(err, ErrInvalidOptions) {
+		t.Error("missing code:", err)
+	}
+
+	s, err := NewSender(SenderOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Code() == "" {
+		t.Error("no share code generated")
+	}
+}
+
+func TestDirSink(t *testing.T) {
+	src := t.TempDir()
+	err := os.WriteFile(filepath.Join(src, "a.txt"), []byte("hello"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Join(src, "dir", "sub"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(src, "dir", "sub", "b.txt"), []byte("world"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file, closer, err := OpenSource(filepath.Join(src, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	dir, closer, err := OpenSource(filepath.Join(src, "dir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	sender, receiver := newServicePair(t)
+
+	out := t.TempDir()
+	sink := NewDirSink(out)
+
+	c1, c2 := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		defer c1.Close()
+		share := &transfer.Share{Sources: []*Source{MessageSource("hi"), file, dir}}
+		errs <- transfer.Send(sender, c1, share)
+	}()
+
+	err = transfer.Receive(receiver, c2, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-errs
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(sink.Messages()) != 1 || sink.Messages()[0] != "hi" {
+		t.Error("got messages", sink.Messages())
+	}
+
+	for path, want := range map[string]string{"a.txt": "hello", "dir/sub/b.txt": "world"} {
+		got, err := os.ReadFile(filepath.Join(out, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != want {
+			t.Errorf("%s is %q", path, got)
+		}
+	}
+}
+
+func TestReceiveCanceled(t *testing.T) {
+	r, err := NewReceiver(TEST_SHARE_CODE, Options{Port: 65431})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- r.Receive(ctx, NewDirSink(t.TempDir()))
+	}()
+
+	select {
+	case err = <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Error("got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("receive ignored the canceled context")
+	}
+}
+
+func TestDirSinkOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info := &FileInfo{Name: "a.txt", Size: 3, Mode: 0644}
+	manifest := &Manifest{Files: []*FileInfo{info}}
+
+	err = NewDirSink(dir).Prepare(manifest)
+	if !errors.Is(err, ErrFileExists) {
+		t.Error("existing file not refused:", err)
+	}
+
+	sink := NewDirSink(dir)
+	sink.Overwrite = OVERWRITE_RENAME
+	err = sink.Prepare(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sink.Path(info) != filepath.Join(dir, "a (1).txt") {
+		t.Error("renamed to", sink.Path(info))
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out", "note.txt")
+	sender, receiver := newServicePair(t)
+
+	sink := NewFileSink(path)
+	c1, c2 := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		defer c1.Close()
+		errs <- transfer.Send(sender, c1, &transfer.Share{Sources: []*Source{MessageSource("hi")}})
+	}()
+
+	err := transfer.Receive(receiver, c2, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-errs
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != "hi" || len(sink.Messages()) != 0 {
+		t.Errorf("message not written to the file, got %q", got)
+	}
+
+	manifest := &Manifest{Files: []*FileInfo{{Name: "a.txt", Size: 1}, {Name: "b.txt", Size: 1}}}
+	err = NewFileSink(path).Prepare(manifest)
+	if err == nil {
+		t.Error("more than one entry accepted")
+	}
+}
+
+// newServicePair runs a handshake like the two sides of a share would.
+func newServicePair(t *testing.T) (*encryptservice.GcmService, *encryptservice.GcmService) {
+	offerer, err := encryptservice.NewHandshake(TEST_SHARE_CODE, encryptservice.PAKE_RECEIVER, encryptservice.DefaultSuites())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chooser, err := encryptservice.NewHandshake(TEST_SHARE_CODE, encryptservice.PAKE_SENDER, encryptservice.DefaultSuites())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offer, err := offerer.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer, chosen, err := chooser.Answer(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offered, err := offerer.Finish(offer, answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := chosen.NewService(TEST_SHARE_CODE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := offered.NewService(TEST_SHARE_CODE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sender, receiver
+}
@@ -5,8 +5,13 @@ go 1.22.6
 require (
 	github.com/coder/websocket v1.8.12
 	github.com/jessevdk/go-flags v1.6.1
+	github.com/klauspost/compress v1.18.0
 	golang.org/x/crypto v0.27.0
+	golang.org/x/sys v0.25.0
 	golang.org/x/term v0.24.0
 )
 
-require golang.org/x/sys v0.25.0 // indirect
+require (
+	golang.org/x/net v0.21.0 // indirect
+	golang.org/x/text v0.18.0 // indirect
+)
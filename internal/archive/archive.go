@@ -0,0 +1,423 @@
+package archive
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrUnsafePath = fmt.Errorf("unsafe path in archive")
+
+// Size returns the exact number of bytes NewReader will produce for dir.
+// File contents are not read, only their sizes, so this is cheap even for
+// large trees.
+func Size(dir string) (int64, error) {
+	cw := &countWriter{}
+	tw := tar.NewWriter(cw)
+
+	err := walk(dir, func(hdr *tar.Header, path string) error {
+		err := tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			_, err = io.CopyN(tw, zeroReader{}, hdr.Size)
+		}
+
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	return cw.n, nil
+}
+
+// NewReader streams dir as a tar archive. Entries are named relative to the
+// parent of dir, so extracting into a target directory recreates dir itself
+// inside it.
+func NewReader(dir string) io.ReadCloser {
+	pr, pw := io.Pipe()
+
+	go func() {
+		tw := tar.NewWriter(pw)
+
+		err := walk(dir, func(hdr *tar.Header, path string) error {
+			err := tw.WriteHeader(hdr)
+			if err != nil {
+				return err
+			}
+
+			if hdr.Typeflag != tar.TypeReg {
+				return nil
+			}
+
+			file, err := os.Open(path)
+			if err != nil {
+				return err
+			}
+
+			defer file.Close()
+
+			_, err = io.CopyN(tw, file, hdr.Size)
+			if errors.Is(err, io.EOF) {
+				return fmt.Errorf("%s changed size while sending", path)
+			}
+
+			return err
+		})
+		if err == nil {
+			err = tw.Close()
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	return pr
+}
+
+func walk(dir string, fn func(hdr *tar.Header, path string) error) error {
+	dir = filepath.Clean(dir)
+	base := filepath.Dir(dir)
+
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		link := ""
+		switch {
+		case info.Mode().IsRegular(), info.IsDir():
+		case info.Mode()&fs.ModeSymlink != 0:
+			link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		default:
+			// sockets, devices, pipes etc. can't be recreated on the other side
+			return nil
+		}
+
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+
+		name, err := filepath.Rel(base, path)
+		if err != nil {
+			return err
+		}
+
+		hdr.Name = filepath.ToSlash(name)
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		return fn(hdr, path)
+	})
+}
+
+// Extract recreates the archive read from r under dest. Permissions and
+// modification times are restored. Entries that would land outside of dest,
+// either directly or through a symlink, are rejected, as are entries inside
+// or replacing a symlink.
+func Extract(r io.Reader, dest string) error {
+	err := os.MkdirAll(dest, 0755)
+	if err != nil {
+		return err
+	}
+
+	type dirInfo struct {
+		path  string
+		mode  fs.FileMode
+		mtime time.Time
+	}
+
+	var dirs []dirInfo
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		name := filepath.FromSlash(strings.TrimSuffix(hdr.Name, "/"))
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("%w: %s", ErrUnsafePath, hdr.Name)
+		}
+
+		// a symlink's target is only checked against its own directory, a
+		// chain of them could still lead out of dest
+		err = checkNoSymlinks(dest, name)
+		if err != nil {
+			return err
+		}
+
+		path := filepath.Join(dest, name)
+		mode := hdr.FileInfo().Mode().Perm()
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(path, 0755)
+			if err != nil {
+				return err
+			}
+
+			dirs = append(dirs, dirInfo{path: path, mode: mode, mtime: hdr.ModTime})
+		case tar.TypeReg:
+			err = extractFile(tr, path, mode, hdr.ModTime)
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			target := filepath.FromSlash(hdr.Linkname)
+			if filepath.IsAbs(target) || !filepath.IsLocal(filepath.Join(filepath.Dir(name), target)) {
+				return fmt.Errorf("%w: %s -> %s", ErrUnsafePath, hdr.Name, hdr.Linkname)
+			}
+
+			err = os.Symlink(target, path)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported archive entry %s", hdr.Name)
+		}
+	}
+
+	// directories are fixed up last, writing their children changes the mtime
+	// and a read only directory couldn't have been filled in
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err = os.Chmod(dirs[i].path, dirs[i].mode)
+		if err != nil {
+			return err
+		}
+
+		err = os.Chtimes(dirs[i].path, dirs[i].mtime, dirs[i].mtime)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkNoSymlinks rejects name if it or any directory it is in is a symlink
+// under dest, so nothing is ever written through one.
+func checkNoSymlinks(dest string, name string) error {
+	path := dest
+	for _, part := range strings.Split(name, string(filepath.Separator)) {
+		path = filepath.Join(path, part)
+
+		info, err := os.Lstat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return fmt.Errorf("%w: %s goes through a symlink", ErrUnsafePath, name)
+		}
+	}
+
+	return nil
+}
+
+// ExtractWriter extracts the archive written to it into a directory, as the
+// data arrives. Close returns once extraction has finished.
+type ExtractWriter struct {
+	*io.PipeWriter
+	done chan error
+	// tmp and target are set by NewDirWriter
+	tmp    string
+	target string
+}
+
+func NewExtractWriter(dest string) *ExtractWriter {
+	pr, pw := io.Pipe()
+	w := &ExtractWriter{
+		PipeWriter: pw,
+		done:       make(chan error, 1),
+	}
+
+	go func() {
+		err := Extract(pr, dest)
+		pr.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w
+}
+
+// NewDirWriter extracts an archive of a single directory, as made by
+// NewReader, into a temporary directory next to target. Close moves it to
+// target, replacing whatever is there, Abort removes it. The archive has to
+// hold exactly one directory, Close returns an error and keeps target as it
+// was otherwise.
+func NewDirWriter(target string) (*ExtractWriter, error) {
+	tmp, err := os.MkdirTemp(filepath.Dir(target), "."+filepath.Base(target)+"-*.fastshare-partial")
+	if err != nil {
+		return nil, err
+	}
+
+	w := NewExtractWriter(tmp)
+	w.tmp = tmp
+	w.target = target
+
+	return w, nil
+}
+
+// Abort stops the extraction. Whatever was extracted so far stays, unless it
+// went into a temporary directory.
+func (w *ExtractWriter) Abort(err error) error {
+	w.PipeWriter.CloseWithError(err)
+	<-w.done
+
+	if w.tmp != "" {
+		return os.RemoveAll(w.tmp)
+	}
+
+	return nil
+}
+
+func (w *ExtractWriter) Close() error {
+	w.PipeWriter.Close()
+
+	err := <-w.done
+	if err != nil {
+		if w.tmp != "" {
+			os.RemoveAll(w.tmp)
+		}
+
+		return fmt.Errorf("failed to extract directory: %w", err)
+	}
+
+	if w.tmp == "" {
+		return nil
+	}
+
+	return w.moveToTarget()
+}
+
+// rename is os.Rename, tests make it fail.
+var rename = os.Rename
+
+// moveToTarget renames the extracted directory to target, and removes the
+// temporary directory. An existing target is moved into the temporary
+// directory first and removed with it, or moved back if the new one can't
+// take its place.
+func (w *ExtractWriter) moveToTarget() error {
+	// unless it holds the old target, which couldn't be moved back
+	keep := false
+	defer func() {
+		if !keep {
+			os.RemoveAll(w.tmp)
+		}
+	}()
+
+	entries, err := os.ReadDir(w.tmp)
+	if err != nil {
+		return err
+	}
+
+	if len(entries) != 1 || !entries[0].IsDir() {
+		return fmt.Errorf("archive doesn't hold a single directory")
+	}
+
+	extracted := filepath.Join(w.tmp, entries[0].Name())
+	old := ""
+
+	_, err = os.Lstat(w.target)
+	if err == nil {
+		old = filepath.Join(w.tmp, entries[0].Name()+".old")
+		err = rename(w.target, old)
+		if err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	err = rename(extracted, w.target)
+	if err == nil || old == "" {
+		return err
+	}
+
+	restoreErr := rename(old, w.target)
+	if restoreErr != nil {
+		keep = true
+		return fmt.Errorf("%w, the old %s is kept in %s: %w", err, w.target, old, restoreErr)
+	}
+
+	return err
+}
+
+func extractFile(r io.Reader, path string, mode fs.FileMode, mtime time.Time) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(file, r)
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(path, mode)
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(path, mtime, mtime)
+}
+
+type countWriter struct {
+	n int64
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,322 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "project")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	err := os.MkdirAll(filepath.Join(src, "sub", "deeper"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"readme.txt":            "hello",
+		"sub/data.bin":          string(bytes.Repeat([]byte{1, 2, 3}, 10000)),
+		"sub/deeper/script.sh":  "#!/bin/sh\necho hi\n",
+		"sub/deeper/empty.file": "",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(src, filepath.FromSlash(name))
+		err = os.WriteFile(path, []byte(content), 0640)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = os.Chmod(filepath.Join(src, "sub", "deeper", "script.sh"), 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := Size(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(src)
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int64(len(data)) != size {
+		t.Fatalf("size mismatch: calculated %d, streamed %d", size, len(data))
+	}
+
+	dest := t.TempDir()
+	err = Extract(bytes.NewReader(data), dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dest, "project", filepath.FromSlash(name))
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(got) != content {
+			t.Errorf("%s: content mismatch", name)
+		}
+
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !info.ModTime().Equal(mtime) {
+			t.Errorf("%s: mtime %v, expected %v", name, info.ModTime(), mtime)
+		}
+	}
+
+	info, err := os.Stat(filepath.Join(dest, "project", "sub", "deeper", "script.sh"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("mode %v, expected %v", info.Mode().Perm(), os.FileMode(0750))
+	}
+}
+
+func TestExtractRejectsTraversal(t *testing.T) {
+	entries := []tar.Header{
+		{Name: "../escape.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "/etc/escape.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "dir/../../escape.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "../outside", Mode: 0777},
+		{Name: "abslink", Typeflag: tar.TypeSymlink, Linkname: "/etc", Mode: 0777},
+	}
+
+	for _, hdr := range entries {
+		buf := &bytes.Buffer{}
+		tw := tar.NewWriter(buf)
+		err := tw.WriteHeader(&hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tw.Close()
+
+		err = Extract(buf, t.TempDir())
+		if !errors.Is(err, ErrUnsafePath) {
+			t.Errorf("%s: expected ErrUnsafePath, got %v", hdr.Name, err)
+		}
+	}
+}
+
+func TestExtractRejectsSymlinkChains(t *testing.T) {
+	for name, entries := range map[string][]tar.Header{
+		// each link stays inside dest on its own, together they point at
+		// its parent
+		"dir": {
+			{Name: "a", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+			{Name: "a/b", Typeflag: tar.TypeSymlink, Linkname: "..", Mode: 0777},
+			{Name: "a/b/evil", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		"file": {
+			{Name: "x", Typeflag: tar.TypeSymlink, Linkname: ".", Mode: 0777},
+			{Name: "s", Typeflag: tar.TypeSymlink, Linkname: "x/../evil", Mode: 0777},
+			{Name: "s", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			parent := t.TempDir()
+			dest := filepath.Join(parent, "dest")
+
+			buf := &bytes.Buffer{}
+			tw := tar.NewWriter(buf)
+			for _, hdr := range entries {
+				err := tw.WriteHeader(&hdr)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			tw.Close()
+
+			err := Extract(buf, dest)
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("expected ErrUnsafePath, got %v", err)
+			}
+
+			_, err = os.Lstat(filepath.Join(parent, "evil"))
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Fatalf("a file was written outside of dest: %v", err)
+			}
+		})
+	}
+}
+
+func TestDirWriterReplacesTarget(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "project")
+	err := os.MkdirAll(src, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(src, "new.txt"), []byte("new"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	target := filepath.Join(dest, "renamed")
+	err = os.MkdirAll(target, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(target, "old.txt"), []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := NewDirWriter(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(src)
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = os.Stat(filepath.Join(target, "old.txt"))
+	if err != nil {
+		t.Error("target replaced before the archive was complete")
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(target, "new.txt"))
+	if err != nil || string(got) != "new" {
+		t.Errorf("new.txt is %q, %v", got, err)
+	}
+
+	_, err = os.Stat(filepath.Join(target, "old.txt"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Error("old directory kept")
+	}
+
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("temporary directory left behind: %v", entries)
+	}
+}
+
+func TestDirWriterKeepsTargetOnFailedMove(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "project")
+	err := os.MkdirAll(src, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	target := filepath.Join(dest, "project")
+	err = os.MkdirAll(target, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(filepath.Join(target, "old.txt"), []byte("old"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// moving the old target away works, moving the new one in doesn't
+	failed := errors.New("rename failed")
+	rename = func(from, to string) error {
+		if filepath.Base(from) == "project" && filepath.Dir(from) != dest {
+			return failed
+		}
+
+		return os.Rename(from, to)
+	}
+
+	defer func() { rename = os.Rename }()
+
+	w, err := NewDirWriter(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(src)
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Close()
+	if !errors.Is(err, failed) {
+		t.Fatalf("expected the rename error, got %v", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(target, "old.txt"))
+	if err != nil || string(got) != "old" {
+		t.Errorf("old target not restored: %q, %v", got, err)
+	}
+
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 1 {
+		t.Errorf("temporary directory left behind: %v", entries)
+	}
+}
+
+func TestDirWriterAbortRemovesTemp(t *testing.T) {
+	dest := t.TempDir()
+	w, err := NewDirWriter(filepath.Join(dest, "project"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Abort(io.ErrUnexpectedEOF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("left behind: %v", entries)
+	}
+}
@@ -2,8 +2,11 @@ package discoverservice
 
 import (
 	"bytes"
-	"crypto/ecdh"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"sync"
@@ -14,78 +17,107 @@ import (
 
 type DiscoverResponse struct {
 	Addr      net.Addr
-	PublicKey *ecdh.PublicKey
+	Handshake *encryptservice.HandshakeResult
 }
 
+// Discovery runs the handshake over udp, the receiver offers the cipher
+// suites and the sender chooses:
+//
+//	receiver broadcasts: DISCOVER_HELLO + json offer
+//	sender answers:      DISCOVER_REPLY + receiver share + json answer
+//
+// The receiver then connects over tcp and sends its confirmation first.
 type DiscoverService struct {
 	discoveryPhrase string
 	port            int
 	sock            net.PacketConn
+	suites          encryptservice.Suites
+	handshake       *encryptservice.Handshake
+	offer           *encryptservice.Hello
 	message         []byte
 	stop            chan struct{}
 	once            *sync.Once
-	hmacService     *encryptservice.HmacService
+	m               sync.Mutex
+	sessions        map[string]*session
+	// Log gets status lines, like senders that were ignored. nil drops them.
+	Log io.Writer
 }
 
-const HMAC_SIZE = 64
-const ECDH_SIZE = encryptservice.ECDH_PUBKEY_SIZE
+type session struct {
+	addr   net.Addr
+	result *encryptservice.HandshakeResult
+	reply  []byte
+}
 
-func NewDiscoveryService(pubKey *ecdh.PublicKey, discoveryPhrase string, port int) (*DiscoverService, error) {
-	sock, err := net.ListenPacket("udp4", ":"+strconv.Itoa((port)))
-	if err != nil {
-		return nil, err
+const (
+	DISCOVER_HELLO = 1
+	DISCOVER_REPLY = 2
+)
+
+const SHARE_SIZE = encryptservice.PAKE_SHARE_SIZE
+const CONFIRMATION_SIZE = encryptservice.PAKE_CONFIRMATION_SIZE
+
+// MAX_MESSAGE_SIZE is plenty for the json hellos.
+const MAX_MESSAGE_SIZE = 2048
+
+// MAX_PAIRING_ATTEMPTS limits how many receivers a sender answers. Every
+// answer lets the receiver try one share code.
+const MAX_PAIRING_ATTEMPTS = 16
+
+const CONFIRMATION_TIMEOUT = 10 * time.Second
+
+var ErrTooManyAttempts = fmt.Errorf("too many pairing attempts, stopping")
+var ErrMessageTooShort = fmt.Errorf("message too short")
+
+func NewDiscoveryService(discoveryPhrase string, port int, role encryptservice.PakeRole, suites encryptservice.Suites) (*DiscoverService, error) {
+	// senders start a new handshake for every receiver that says hello
+	var handshake *encryptservice.Handshake
+	var offer *encryptservice.Hello
+	var message []byte
+	if role == encryptservice.PAKE_RECEIVER {
+		var err error
+		handshake, err = encryptservice.NewHandshake(discoveryPhrase, role, suites)
+		if err != nil {
+			return nil, err
+		}
+
+		offer, err = handshake.Offer()
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := json.Marshal(offer)
+		if err != nil {
+			return nil, err
+		}
+
+		message = append([]byte{DISCOVER_HELLO}, data...)
 	}
 
-	hmacService := encryptservice.NewHmacService(discoveryPhrase)
-	salt, err := encryptservice.GenreateSalt()
+	sock, err := net.ListenPacket("udp4", ":"+strconv.Itoa((port)))
 	if err != nil {
 		return nil, err
 	}
 
-	message := make([]byte, 0, ECDH_SIZE+encryptservice.SALT_SIZE+HMAC_SIZE)
-	pubkeyBytes := pubKey.Bytes()
-	mac := hmacService.Sign(pubkeyBytes, salt)
-	message = append(message, pubkeyBytes...)
-	message = append(message, salt...)
-	message = append(message, mac...)
-
 	return &DiscoverService{
 		discoveryPhrase: discoveryPhrase,
 		port:            port,
 		sock:            sock,
+		suites:          suites,
+		handshake:       handshake,
+		offer:           offer,
 		message:         message,
-		hmacService:     hmacService,
 		stop:            make(chan struct{}),
 		once:            &sync.Once{},
+		sessions:        make(map[string]*session),
 	}, nil
 }
 
-var ErrInvalidHmac = fmt.Errorf("invalid hmac")
-var ErrMessageTooShort = fmt.Errorf("message too short")
-
-func (s *DiscoverService) ParseMessage(message []byte) (*ecdh.PublicKey, error) {
-	if len(message) < ECDH_SIZE+encryptservice.SALT_SIZE+HMAC_SIZE {
-		return nil, ErrMessageTooShort
-	}
-
-	pubKeyBytes := message[:ECDH_SIZE]
-	salt := message[ECDH_SIZE : ECDH_SIZE+encryptservice.SALT_SIZE]
-	sig := message[ECDH_SIZE+encryptservice.SALT_SIZE:]
-
-	pubkey, err := encryptservice.ParsePublicKey(pubKeyBytes)
-	if err != nil {
-		return nil, err
-	}
-
-	if !s.hmacService.Verify(pubkey.Bytes(), sig, salt) {
-		return nil, ErrInvalidHmac
-	}
-
-	return pubkey, nil
-}
-
-func (s *DiscoverService) listenForMessage() (*DiscoverResponse, error) {
-	buf := make([]byte, 1024)
+// waitForReply reads replies to our hello until one comes from a sender
+// with the same share code.
+func (s *DiscoverService) waitForReply() (*DiscoverResponse, error) {
+	buf := make([]byte, MAX_MESSAGE_SIZE)
+	ignored := make(map[string]bool)
 
 	for {
 		n, addr, err := s.sock.ReadFrom(buf)
@@ -93,19 +125,37 @@ func (s *DiscoverService) listenForMessage() (*DiscoverResponse, error) {
 			return nil, err
 		}
 
-		pkey, err := s.ParseMessage(buf[:n])
+		msg := buf[:n]
+		if n <= 1+SHARE_SIZE || msg[0] != DISCOVER_REPLY {
+			continue
+		}
+
+		if !bytes.Equal(msg[1:1+SHARE_SIZE], s.offer.Share) {
+			// answer to another receiver
+			continue
+		}
+
+		answer := &encryptservice.Hello{}
+		err = json.Unmarshal(msg[1+SHARE_SIZE:], answer)
 		if err != nil {
 			continue
 		}
 
-		if bytes.Equal(pkey.Bytes(), s.message[:ECDH_SIZE]) {
-			// ignore self
+		result, err := s.handshake.Finish(s.offer, answer)
+		if err != nil {
+			// a sender with a different share code, or without a suite we
+			// support
+			if errors.Is(err, encryptservice.ErrInvalidHello) && !ignored[addr.String()] {
+				encryptservice.Logf(s.Log, "ignoring sender at %s: %v", addr, err)
+				ignored[addr.String()] = true
+			}
+
 			continue
 		}
 
 		return &DiscoverResponse{
 			Addr:      addr,
-			PublicKey: pkey,
+			Handshake: result,
 		}, nil
 	}
 }
@@ -191,31 +241,171 @@ func (s *DiscoverService) getBroadcastAddresses() ([]*net.UDPAddr, error) {
 	return addrs, nil
 }
 
-func (s *DiscoverService) DiscoverSender() (*DiscoverResponse, error) {
+// DiscoverSender broadcasts our hello until a sender with the same share code
+// answers. Once ctx is done the service is closed and ctx.Err() returned.
+func (s *DiscoverService) DiscoverSender(ctx context.Context) (*DiscoverResponse, error) {
 	addrs, err := s.getBroadcastAddresses()
 	if err != nil {
 		return nil, err
 	}
 
+	defer context.AfterFunc(ctx, s.Close)()
+
 	go s.sendPings(addrs)
 
-	response, err := s.listenForMessage()
+	response, err := s.waitForReply()
 	if err != nil {
-		return nil, err
+		return nil, canceled(ctx, err)
 	}
 
 	return response, nil
 }
 
-func (s *DiscoverService) ListenForReceiver() (*DiscoverResponse, error) {
-	response, err := s.listenForMessage()
+// AnswerReceivers answers the hello of every receiver until Close is called
+// or ctx is done. Whether a receiver used the same share code is only known
+// once it connects, see ConfirmReceiver.
+func (s *DiscoverService) AnswerReceivers(ctx context.Context) error {
+	defer context.AfterFunc(ctx, s.Close)()
+
+	buf := make([]byte, MAX_MESSAGE_SIZE)
+
+	for {
+		n, addr, err := s.sock.ReadFrom(buf)
+		if err != nil {
+			return canceled(ctx, err)
+		}
+
+		if n < 2 || buf[0] != DISCOVER_HELLO {
+			continue
+		}
+
+		offer := &encryptservice.Hello{}
+		err = json.Unmarshal(buf[1:n], offer)
+		if err != nil || len(offer.Share) != SHARE_SIZE {
+			continue
+		}
+
+		share := string(offer.Share)
+
+		s.m.Lock()
+		sess, ok := s.sessions[share]
+		if !ok {
+			if len(s.sessions) >= MAX_PAIRING_ATTEMPTS {
+				s.m.Unlock()
+				return ErrTooManyAttempts
+			}
+
+			// every receiver gets a fresh exchange
+			sess, err = s.newSession(addr, offer)
+			if errors.Is(err, encryptservice.ErrNoCommonSuite) {
+				// remembered without a reply, so it's only reported once
+				encryptservice.Logf(s.Log, "ignoring receiver at %s: %v", addr, err)
+				sess = &session{addr: addr}
+			} else if err != nil {
+				s.m.Unlock()
+				continue
+			}
+
+			s.sessions[share] = sess
+		}
+		s.m.Unlock()
+
+		if sess.reply != nil {
+			s.sock.WriteTo(sess.reply, addr)
+		}
+	}
+}
+
+func (s *DiscoverService) newSession(addr net.Addr, offer *encryptservice.Hello) (*session, error) {
+	handshake, err := encryptservice.NewHandshake(s.discoveryPhrase, encryptservice.PAKE_SENDER, s.suites)
 	if err != nil {
 		return nil, err
 	}
 
-	go s.sendPings([]*net.UDPAddr{response.Addr.(*net.UDPAddr)})
+	answer, result, err := handshake.Answer(offer)
+	if err != nil {
+		return nil, err
+	}
 
-	return response, nil
+	data, err := json.Marshal(answer)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := make([]byte, 0, 1+SHARE_SIZE+len(data))
+	reply = append(reply, DISCOVER_REPLY)
+	reply = append(reply, offer.Share...)
+	reply = append(reply, data...)
+
+	return &session{
+		addr:   addr,
+		result: result,
+		reply:  reply,
+	}, nil
+}
+
+// ConfirmReceiver reads the confirmation a receiver sends after connecting,
+// and checks it against the exchanges with receivers at the same address.
+// It waits at most CONFIRMATION_TIMEOUT, and not past the deadline of ctx.
+func (s *DiscoverService) ConfirmReceiver(ctx context.Context, conn net.Conn) (*DiscoverResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, CONFIRMATION_TIMEOUT)
+	defer cancel()
+
+	confirmation := make([]byte, CONFIRMATION_SIZE)
+
+	deadline, _ := ctx.Deadline()
+	conn.SetReadDeadline(deadline)
+	stop := context.AfterFunc(ctx, func() {
+		// unblocks the read if ctx is canceled before the deadline
+		conn.SetReadDeadline(time.Now())
+	})
+
+	_, err := io.ReadFull(conn, confirmation)
+	if !stop() && err != nil {
+		return nil, ctx.Err()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Time{})
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for _, sess := range s.sessions {
+		if sess.result == nil || getIP(sess.addr) != getIP(conn.RemoteAddr()) {
+			continue
+		}
+
+		if sess.result.Verify(confirmation) == nil {
+			return &DiscoverResponse{
+				Addr:      sess.addr,
+				Handshake: sess.result,
+			}, nil
+		}
+	}
+
+	return nil, encryptservice.ErrWrongShareCode
+}
+
+// canceled returns the error of ctx if it ended the discovery, err otherwise.
+func canceled(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+func getIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	return host
 }
 
 func (s *DiscoverService) Close() {
@@ -1,9 +1,16 @@
 package discoverservice
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"testing"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/encryptservice"
 )
 
 func TestGetInterfaces(t *testing.T) {
@@ -49,3 +56,164 @@ func TestGetInterfaces(t *testing.T) {
 		}
 	}
 }
+
+func TestAnswerReceivers(t *testing.T) {
+	const code = "BluePenguin23"
+	const port = 46231
+
+	ds, err := NewDiscoveryService(code, port, encryptservice.PAKE_SENDER, encryptservice.DefaultSuites())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ds.Close()
+
+	answerErr := make(chan error, 1)
+	go func() {
+		answerErr <- ds.AnswerReceivers(context.Background())
+	}()
+
+	sock, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer sock.Close()
+
+	sender := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+	sendHello := func(code string) (*encryptservice.Handshake, *encryptservice.Hello) {
+		handshake, err := encryptservice.NewHandshake(code, encryptservice.PAKE_RECEIVER, encryptservice.DefaultSuites())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		offer, err := handshake.Offer()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := json.Marshal(offer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = sock.WriteTo(append([]byte{DISCOVER_HELLO}, data...), sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return handshake, offer
+	}
+
+	hello := func(code string) (*encryptservice.HandshakeResult, error) {
+		handshake, offer := sendHello(code)
+
+		sock.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, MAX_MESSAGE_SIZE)
+		n, _, err := sock.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		reply := buf[:n]
+		if len(reply) <= 1+SHARE_SIZE || reply[0] != DISCOVER_REPLY || !bytes.Equal(reply[1:1+SHARE_SIZE], offer.Share) {
+			t.Fatal("invalid reply")
+		}
+
+		answer := &encryptservice.Hello{}
+		err = json.Unmarshal(reply[1+SHARE_SIZE:], answer)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return handshake.Finish(offer, answer)
+	}
+
+	_, err = hello("BluePenguin24")
+	if err == nil {
+		t.Error("receiver accepted a sender with a different code")
+	}
+
+	result, err := hello(code)
+	if err != nil {
+		t.Fatal("receiver rejected the sender:", err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	go func() {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+
+		conn.Write(result.Confirmation())
+	}()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+
+	response, err := ds.ConfirmReceiver(context.Background(), conn)
+	if err != nil {
+		t.Fatal("sender rejected the receiver:", err)
+	}
+
+	if response.Handshake.Suite != result.Suite {
+		t.Errorf("sender uses %v, receiver %v", response.Handshake.Suite, result.Suite)
+	}
+
+	senderService, err := response.Handshake.NewService(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiverService, err := result.NewService(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(senderService.VerificationCode(), receiverService.VerificationCode()) {
+		t.Error("sender and receiver secrets differ")
+	}
+
+	for range MAX_PAIRING_ATTEMPTS - 2 {
+		hello("SomethingElse1")
+	}
+
+	sendHello(code)
+
+	select {
+	case err := <-answerErr:
+		if !errors.Is(err, ErrTooManyAttempts) {
+			t.Error("expected ErrTooManyAttempts, got", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("sender kept answering after too many attempts")
+	}
+}
+
+func TestDiscoverSenderCanceled(t *testing.T) {
+	ds, err := NewDiscoveryService("BluePenguin23", 46232, encryptservice.PAKE_RECEIVER, encryptservice.DefaultSuites())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer ds.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err = ds.DiscoverSender(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected the deadline to stop discovery, got", err)
+	}
+}
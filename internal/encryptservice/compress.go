@@ -0,0 +1,249 @@
+package encryptservice
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// File data can be compressed before it is sealed. Every record is compressed
+// on its own, so records stay independent of each other and can still be
+// sealed, opened and striped in any order. A compressed record has
+// RECORD_COMPRESSED set and its header holds the compressed length, a record
+// is only sent compressed if that made it smaller. Messages are never
+// compressed.
+const COMPRESSION_NONE = "none"
+const COMPRESSION_GZIP = "gzip"
+const COMPRESSION_ZSTD = "zstd"
+
+// COMPRESSION_SAMPLE_CHUNKS chunks at the start of every file are compressed
+// to find out whether it compresses at all. If they didn't shrink below
+// COMPRESSION_MIN_RATIO of their size, the rest of the file is sent as is,
+// already compressed content like video or archives would only cost CPU time.
+const COMPRESSION_SAMPLE_CHUNKS = 4
+const COMPRESSION_MIN_RATIO = 0.9
+
+var ErrUnknownCompression = fmt.Errorf("unknown compression")
+
+type codec interface {
+	// compress appends the compressed src to dst.
+	compress(dst, src []byte) []byte
+	// decompress appends the decompressed src to dst, failing if it is more
+	// than limit bytes.
+	decompress(dst, src []byte, limit int) ([]byte, error)
+}
+
+var codecs = map[string]codec{
+	COMPRESSION_NONE: nil,
+	COMPRESSION_GZIP: &gzipCodec{},
+	COMPRESSION_ZSTD: &zstdCodec{},
+}
+
+// DefaultCompressions are offered by the sender, the ones it prefers first.
+func DefaultCompressions() []string {
+	return []string{COMPRESSION_ZSTD, COMPRESSION_GZIP, COMPRESSION_NONE}
+}
+
+// NewCompressions restricts the default compressions to compression, if it is
+// set.
+func NewCompressions(compression string) ([]string, error) {
+	compressions := DefaultCompressions()
+	if compression == "" {
+		return compressions, nil
+	}
+
+	if _, ok := codecs[compression]; !ok {
+		return compressions, fmt.Errorf("%w %q, use one of %s", ErrUnknownCompression, compression, strings.Join(compressions, ", "))
+	}
+
+	return []string{compression}, nil
+}
+
+// ChooseCompression picks the compression both peers support and prefer most,
+// COMPRESSION_NONE if there is none.
+func ChooseCompression(offer, own []string) string {
+	compression := choose(offer, own, codecs)
+	if compression == "" {
+		return COMPRESSION_NONE
+	}
+
+	return compression
+}
+
+// SetCompression sets how file data is compressed, both peers have to agree on
+// it. An empty compression is COMPRESSION_NONE.
+func (g *GcmService) SetCompression(compression string) error {
+	if compression == "" {
+		compression = COMPRESSION_NONE
+	}
+
+	c, ok := codecs[compression]
+	if !ok {
+		return fmt.Errorf("%w %q", ErrUnknownCompression, compression)
+	}
+
+	g.compression = compression
+	g.codec = c
+	g.startFile()
+
+	return nil
+}
+
+func (g *GcmService) Compression() string {
+	return g.compression
+}
+
+// startFile starts sampling whether the next file compresses.
+func (g *GcmService) startFile() {
+	g.sampled = 0
+	g.sampledIn = 0
+	g.sampledOut = 0
+}
+
+// compressChunk returns what to seal for a chunk of file data, and the flag to
+// send it with. Compressed data is only valid until the next call.
+func (g *GcmService) compressChunk(data []byte) ([]byte, byte) {
+	if g.codec == nil || len(data) == 0 {
+		return data, 0
+	}
+
+	sampling := g.sampled < COMPRESSION_SAMPLE_CHUNKS
+	if !sampling && float64(g.sampledOut) >= float64(g.sampledIn)*COMPRESSION_MIN_RATIO {
+		return data, 0
+	}
+
+	g.compressBuf = g.codec.compress(g.compressBuf[:0], data)
+	if sampling {
+		g.sampled++
+		g.sampledIn += int64(len(data))
+		g.sampledOut += int64(min(len(g.compressBuf), len(data)))
+	}
+
+	if len(g.compressBuf) >= len(data) {
+		return data, 0
+	}
+
+	return g.compressBuf, RECORD_COMPRESSED
+}
+
+// decompressChunk returns the data of a record opened with flags. Decompressed
+// data is only valid until the next call.
+func (g *GcmService) decompressChunk(flags byte, data []byte) ([]byte, error) {
+	if flags&RECORD_COMPRESSED == 0 {
+		return data, nil
+	}
+
+	var err error
+	g.decompressBuf, err = decompress(g.codec, g.decompressBuf[:0], data, g.chunkSize)
+	return g.decompressBuf, err
+}
+
+func decompress(c codec, dst, src []byte, limit int) ([]byte, error) {
+	if c == nil {
+		return nil, fmt.Errorf("%w: compressed record without compression", ErrUnexpectedRecord)
+	}
+
+	out, err := c.decompress(dst, src, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress: %w", err)
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("%w: empty compressed record", ErrUnexpectedRecord)
+	}
+
+	return out, nil
+}
+
+type gzipCodec struct {
+	writers sync.Pool
+	readers sync.Pool
+}
+
+func (c *gzipCodec) compress(dst, src []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+
+	w, ok := c.writers.Get().(*gzip.Writer)
+	if ok {
+		w.Reset(buf)
+	} else {
+		w, _ = gzip.NewWriterLevel(buf, gzip.BestSpeed)
+	}
+
+	defer c.writers.Put(w)
+
+	// writing to a bytes.Buffer can't fail
+	w.Write(src)
+	w.Close()
+
+	return buf.Bytes()
+}
+
+func (c *gzipCodec) decompress(dst, src []byte, limit int) ([]byte, error) {
+	r, ok := c.readers.Get().(*gzip.Reader)
+	var err error
+	if ok {
+		err = r.Reset(bytes.NewReader(src))
+	} else {
+		r, err = gzip.NewReader(bytes.NewReader(src))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer c.readers.Put(r)
+
+	buf := bytes.NewBuffer(dst)
+	n, err := buf.ReadFrom(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if n > int64(limit) {
+		return nil, fmt.Errorf("%w: more than %d bytes decompressed", ErrRecordTooLarge, limit)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// zstdCodec shares one encoder and decoder, EncodeAll and DecodeAll can be
+// used from several goroutines at once.
+type zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func (c *zstdCodec) init() {
+	c.once.Do(func() {
+		c.encoder, _ = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		c.decoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0), zstd.WithDecoderMaxMemory(MAX_CHUNK_SIZE))
+	})
+}
+
+func (c *zstdCodec) compress(dst, src []byte) []byte {
+	c.init()
+	return c.encoder.EncodeAll(src, dst)
+}
+
+func (c *zstdCodec) decompress(dst, src []byte, limit int) ([]byte, error) {
+	c.init()
+
+	start := len(dst)
+	out, err := c.decoder.DecodeAll(src, dst)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(out)-start > limit {
+		return nil, fmt.Errorf("%w: more than %d bytes decompressed", ErrRecordTooLarge, limit)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,151 @@
+package encryptservice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func compressiblePair(t *testing.T, compression string) (*GcmService, *GcmService) {
+	sender, receiver := newServicePair(t)
+
+	err := sender.SetCompression(compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = receiver.SetCompression(compression)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sender, receiver
+}
+
+func TestCompressionRoundTrip(t *testing.T) {
+	data := []byte(strings.Repeat("2024-01-01 12:00:00 INFO request served in 3ms\n", 20000))
+
+	for _, compression := range []string{COMPRESSION_ZSTD, COMPRESSION_GZIP} {
+		for _, workers := range []int{1, 4} {
+			sender, receiver := compressiblePair(t, compression)
+			sender.SetWorkers(workers)
+			receiver.SetWorkers(workers)
+
+			wire := &bytes.Buffer{}
+			err := sender.Encrypt(bytes.NewReader(data), wire, int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if wire.Len() > len(data)/4 {
+				t.Errorf("%s: %d bytes on the wire for %d bytes of data", compression, wire.Len(), len(data))
+			}
+
+			out := &bytes.Buffer{}
+			err = receiver.Decrypt(wire, out, int64(len(data)))
+			if err != nil {
+				t.Fatal(compression, workers, err)
+			}
+
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Error("data differs for", compression, workers)
+			}
+		}
+	}
+}
+
+func TestCompressionSkipsIncompressibleData(t *testing.T) {
+	sender, receiver := compressiblePair(t, COMPRESSION_ZSTD)
+
+	data := make([]byte, 20*CHUNK_SIZE)
+	rand.Read(data)
+
+	wire := &bytes.Buffer{}
+	err := sender.Encrypt(bytes.NewReader(data), wire, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sender.sampled != COMPRESSION_SAMPLE_CHUNKS {
+		t.Errorf("compressed %d chunks, expected only the %d sampled", sender.sampled, COMPRESSION_SAMPLE_CHUNKS)
+	}
+
+	for _, record := range records(t, wire.Bytes()) {
+		if record[0]&RECORD_COMPRESSED != 0 {
+			t.Fatal("random data sent compressed")
+		}
+	}
+
+	out := &bytes.Buffer{}
+	err = receiver.Decrypt(wire, out, int64(len(data)))
+	if err != nil || !bytes.Equal(out.Bytes(), data) {
+		t.Error("data differs", err)
+	}
+}
+
+func TestCompressedRecordNeedsCompression(t *testing.T) {
+	sender, receiver := compressiblePair(t, COMPRESSION_GZIP)
+	receiver.SetCompression(COMPRESSION_NONE)
+
+	data := make([]byte, CHUNK_SIZE)
+	wire := &bytes.Buffer{}
+	err := sender.Encrypt(bytes.NewReader(data), wire, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = receiver.Decrypt(wire, &bytes.Buffer{}, int64(len(data)))
+	if !errors.Is(err, ErrUnexpectedRecord) {
+		t.Error("expected ErrUnexpectedRecord, got", err)
+	}
+}
+
+func TestCompressedStreamChunks(t *testing.T) {
+	sender, receiver := compressiblePair(t, COMPRESSION_ZSTD)
+
+	s0, _ := sender.Stream(0)
+	r0, _ := receiver.Stream(0)
+
+	data := bytes.Repeat([]byte(TEST_STRING), CHUNK_SIZE/len(TEST_STRING))
+	wire := &bytes.Buffer{}
+	err := s0.WriteChunk(wire, CHUNK_SIZE, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if wire.Len() >= len(data) {
+		t.Error("chunk not compressed")
+	}
+
+	offset, chunk, err := r0.ReadChunk(wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if offset != CHUNK_SIZE || !bytes.Equal(chunk, data) {
+		t.Errorf("got %d bytes at %d", len(chunk), offset)
+	}
+}
+
+func TestChooseCompression(t *testing.T) {
+	own := DefaultCompressions()
+	if c := ChooseCompression([]string{COMPRESSION_GZIP, COMPRESSION_NONE}, own); c != COMPRESSION_GZIP {
+		t.Error("expected gzip, got", c)
+	}
+
+	// senders from before compression don't offer any
+	if c := ChooseCompression(nil, own); c != COMPRESSION_NONE {
+		t.Error("expected none, got", c)
+	}
+
+	if c := ChooseCompression([]string{"brotli"}, own); c != COMPRESSION_NONE {
+		t.Error("expected none, got", c)
+	}
+
+	_, err := NewCompressions("brotli")
+	if !errors.Is(err, ErrUnknownCompression) {
+		t.Error("expected ErrUnknownCompression, got", err)
+	}
+}
@@ -1,184 +1,332 @@
 package encryptservice
 
 import (
-	"crypto/aes"
+	"bytes"
 	"crypto/cipher"
-	"crypto/ecdh"
-	"crypto/hmac"
-	"crypto/rand"
 	"crypto/sha512"
-	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
-	"time"
+	"runtime"
 
 	"golang.org/x/crypto/hkdf"
-	"golang.org/x/crypto/pbkdf2"
 )
 
+// GcmService encrypts the records of a session. Despite the name the AEAD can
+// be any of the ciphers in suite.go.
 type GcmService struct {
 	discoverPhrase string
+	suite          Suite
+	newAEAD        func(key []byte) (cipher.AEAD, error)
 	gcm            cipher.AEAD
 	nonce          []byte
-	kdf            io.Reader
+	key            []byte
+	verification   []byte
+	streamSecret   []byte
+	chunkSize      int
+	recordBuf      []byte
+
+	// records are sealed and opened on this many goroutines, see pipeline.go
+	workers int
+
+	// file data compression, see compress.go. The first chunks of every file
+	// are sampled to decide whether the rest is compressed.
+	compression   string
+	codec         codec
+	compressBuf   []byte
+	decompressBuf []byte
+	sampled       int
+	sampledIn     int64
+	sampledOut    int64
+
+	// where progress is reported to, see progress.go
+	reporter     ProgressReporter
+	progressName string
+	// status lines and callbacks, see status.go
+	status Status
+
+	// usage of the current key, counted for sealed and opened records since
+	// both directions share the nonce
+	records int64
+	bytes   int64
+	// limits for the current key, see REKEY_RECORDS and REKEY_BYTES
+	rekeyRecords int64
+	rekeyBytes   int64
 }
 
-const SALT_SIZE = 32
+// NewGcmServiceFromSecret derives the key from a shared secret, like the one
+// agreed on by a Handshake, and encrypts with the cipher of suite.
+func NewGcmServiceFromSecret(secret []byte, discoverPhrase string, suite Suite) (*GcmService, error) {
+	newAEAD, ok := ciphers[suite.Cipher]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownCipher, suite.Cipher)
+	}
 
-func GenreateSalt() ([]byte, error) {
-	salt := make([]byte, SALT_SIZE)
-	_, err := rand.Read(salt)
+	kdf := hkdf.New(sha512.New, secret, nil, []byte(discoverPhrase))
+	key := make([]byte, 32)
+	_, err := io.ReadFull(kdf, key)
 	if err != nil {
 		return nil, err
 	}
 
-	return salt, nil
-}
-
-func NewGcmService(priKey *ecdh.PrivateKey, pubKey *ecdh.PublicKey, discoverPhrase string) (*GcmService, error) {
-	ecdhBytes, err := priKey.ECDH(pubKey)
+	verification := make([]byte, VERIFICATION_CODE_SIZE)
+	_, err = io.ReadFull(hkdf.New(sha512.New, secret, nil, []byte(VERIFICATION_INFO)), verification)
 	if err != nil {
 		return nil, err
 	}
 
-	kdf := hkdf.New(sha512.New, ecdhBytes, nil, []byte(discoverPhrase))
-	key := make([]byte, 32)
-	_, err = io.ReadFull(kdf, key)
+	streamSecret := make([]byte, 32)
+	_, err = io.ReadFull(hkdf.New(sha512.New, secret, nil, []byte(STREAM_INFO)), streamSecret)
 	if err != nil {
 		return nil, err
 	}
 
-	aes, err := aes.NewCipher(key)
+	g := &GcmService{
+		discoverPhrase: discoverPhrase,
+		suite:          suite,
+		newAEAD:        newAEAD,
+		verification:   verification,
+		streamSecret:   streamSecret,
+		chunkSize:      CHUNK_SIZE,
+		workers:        runtime.GOMAXPROCS(0),
+		compression:    COMPRESSION_NONE,
+		reporter:       QuietProgress{},
+		rekeyRecords:   REKEY_RECORDS,
+		rekeyBytes:     REKEY_BYTES,
+	}
+
+	err = g.setKey(key)
 	if err != nil {
 		return nil, err
 	}
 
-	gcm, err := cipher.NewGCM(aes)
+	return g, nil
+}
+
+func (s *GcmService) setKey(key []byte) error {
+	aead, err := s.newAEAD(key)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	nonce := make([]byte, gcm.NonceSize())
+	s.gcm = aead
+	s.key = key
+	s.nonce = make([]byte, aead.NonceSize())
+	s.records = 0
+	s.bytes = 0
 
-	return &GcmService{
-		discoverPhrase: discoverPhrase,
-		gcm:            gcm,
-		nonce:          nonce,
-		kdf:            kdf,
-	}, nil
+	return nil
+}
+
+// Suite is the cipher suite the peers agreed on.
+func (s *GcmService) Suite() Suite {
+	return s.suite
+}
+
+const VERIFICATION_CODE_SIZE = 12
+const VERIFICATION_INFO = "fastshare verification code"
+
+// VerificationCode is the same on both peers only if nobody sits between them.
+// Comparing it lets the users detect a man in the middle that got hold of the
+// share code.
+func (s *GcmService) VerificationCode() []byte {
+	return s.verification
 }
 
-func (s *GcmService) incrementNonce() {
+var ErrNonceExhausted = fmt.Errorf("nonce exhausted, refusing to reuse it")
+
+func (s *GcmService) incrementNonce() error {
 	for i, b := range s.nonce {
 		if b == 255 {
 			s.nonce[i] = 0
 		} else {
 			s.nonce[i] += 1
-			break
+			return nil
 		}
 	}
+
+	// wrapped around to zero, the nonce would be used again
+	return ErrNonceExhausted
+}
+
+func (s *GcmService) additionalData(header []byte) []byte {
+	return append([]byte(s.discoverPhrase), header...)
 }
 
-func (s *GcmService) encryptGCM(data []byte) ([]byte, error) {
-	cipherText := s.gcm.Seal(data[:0], s.nonce, data, []byte(s.discoverPhrase))
+// recordSeal is what a record is sealed or opened with. Records get it in
+// order from nextRecord, the sealing itself can happen on any goroutine.
+type recordSeal struct {
+	aead  cipher.AEAD
+	nonce []byte
+	ad    []byte
+}
 
-	s.incrementNonce()
+func (rs recordSeal) seal(data []byte) []byte {
+	return rs.aead.Seal(data[:0], rs.nonce, data, rs.ad)
+}
 
-	return cipherText, nil
+func (rs recordSeal) open(ciphertext []byte) ([]byte, error) {
+	return rs.aead.Open(ciphertext[:0], rs.nonce, ciphertext, rs.ad)
 }
 
-func (s *GcmService) decryptGCM(ciphertext []byte) ([]byte, error) {
-	plaintext, err := s.gcm.Open(ciphertext[:0], s.nonce, ciphertext, []byte(s.discoverPhrase))
+// nextRecord hands out the cipher and nonce for the record with header, and
+// moves the nonce, the key usage and, after a record with RECORD_REKEY, the
+// key past it.
+func (s *GcmService) nextRecord(header []byte, size int) (recordSeal, error) {
+	rs := recordSeal{
+		aead:  s.gcm,
+		nonce: bytes.Clone(s.nonce),
+		ad:    s.additionalData(header),
+	}
+
+	err := s.incrementNonce()
 	if err != nil {
-		return nil, err
+		return rs, err
 	}
 
-	s.incrementNonce()
+	s.countRecord(size)
+	if header[0]&RECORD_REKEY != 0 {
+		err = s.rekey()
+		if err != nil {
+			return rs, err
+		}
+	}
 
-	return plaintext, nil
+	return rs, nil
 }
 
-const CHUNK_SIZE = 8192 * 2
+// UNKNOWN_SIZE is passed to Encrypt and Decrypt for a stream whose length
+// isn't known up front, like a pipe. The sender then reads until EOF, and the
+// stream ends with the authenticated RECORD_LAST flag like any other.
+const UNKNOWN_SIZE = -1
 
+// Encrypt sends exactly totalPlaintextSize bytes of r as a stream of records,
+// or everything until EOF with UNKNOWN_SIZE.
 func (g *GcmService) Encrypt(r io.Reader, w io.Writer, totalPlaintextSize int64) error {
-	start := time.Now()
-	updated := time.Time{}
-	sent := int64(0)
-	encSent := int64(0)
-	sentSinceLastUpdate := int64(0)
+	g.startFile()
+	progress := g.newProgress(totalPlaintextSize)
+
+	var err error
+	if g.workers <= 1 || sequential(totalPlaintextSize, g.chunkSize) {
+		err = g.encryptSequential(r, w, totalPlaintextSize, progress)
+	} else {
+		err = g.encryptPipelined(r, w, totalPlaintextSize, progress)
+	}
 
-	defer fmt.Println()
+	if err != nil {
+		progress.fail(err)
+	}
 
-	buf := make([]byte, CHUNK_SIZE)
-	for {
-		n, readErr := io.ReadFull(r, buf)
-		if readErr != nil && !errors.Is(readErr, io.EOF) && !errors.Is(readErr, io.ErrUnexpectedEOF) {
-			return fmt.Errorf("failed to read data: %w", readErr)
-		}
+	return err
+}
 
-		ciphertext, err := g.encryptGCM(buf[:n])
+func (g *GcmService) encryptSequential(r io.Reader, w io.Writer, totalPlaintextSize int64, progress *progress) error {
+	sent := int64(0)
+
+	buf := make([]byte, g.chunkSize+g.gcm.Overhead())
+	for {
+		chunk, flags, err := readChunk(r, buf[:g.chunkSize], sent, totalPlaintextSize)
 		if err != nil {
-			return fmt.Errorf("failed to encrypt: %w", err)
+			return err
 		}
 
-		_, err = w.Write(ciphertext)
+		size := len(chunk)
+		sent += int64(size)
+		data, compressed := g.compressChunk(chunk)
+
+		written, err := g.writeRecord(w, flags|compressed, data)
 		if err != nil {
 			return fmt.Errorf("failed to write data: %w", err)
 		}
 
-		sent += int64(n)
-		encSent += int64(len(ciphertext))
-		sentSinceLastUpdate += int64(n)
-
-		if totalPlaintextSize > 0 && time.Since(updated) > time.Second {
-			progress := float64(sent) / float64(totalPlaintextSize) * 100
-			fmt.Printf("\r%.2f%%", progress)
-			fmt.Printf(" %.2f MB/s    ", float64(sentSinceLastUpdate)/1024.0/1024.0/time.Since(updated).Seconds())
+		progress.add(size, written)
 
-			updated = time.Now()
-			sentSinceLastUpdate = 0
+		if flags&RECORD_LAST != 0 {
+			progress.finish()
+			return nil
 		}
+	}
+}
 
-		if sent >= totalPlaintextSize {
-			fmt.Printf("\r100.00%%")
-			fmt.Printf(" %.2f MB/s  \n", float64(encSent)/1024.0/1024.0/time.Since(start).Seconds())
+// sequential tells whether a stream is too short to be worth pipelining.
+func sequential(totalPlaintextSize int64, chunkSize int) bool {
+	return totalPlaintextSize != UNKNOWN_SIZE && totalPlaintextSize <= int64(chunkSize)
+}
 
-			return nil
+// readChunk reads the next chunk of a source of totalPlaintextSize bytes into
+// buf, which holds a whole chunk. sent bytes are read already. It returns the
+// chunk and RECORD_LAST if it is the last one. With UNKNOWN_SIZE the last
+// chunk is the one that hit EOF, it can be empty.
+func readChunk(r io.Reader, buf []byte, sent, totalPlaintextSize int64) ([]byte, byte, error) {
+	if totalPlaintextSize == UNKNOWN_SIZE {
+		n, err := io.ReadFull(r, buf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return buf[:n], RECORD_LAST, nil
 		}
 
-		if readErr != nil {
-			return readErr
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read data: %w", err)
 		}
+
+		return buf, 0, nil
+	}
+
+	size := int(min(totalPlaintextSize-sent, int64(len(buf))))
+	n, err := io.ReadFull(r, buf[:size])
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, 0, fmt.Errorf("source ended after %d of %d bytes", sent+int64(n), totalPlaintextSize)
 	}
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read data: %w", err)
+	}
+
+	if sent+int64(size) >= totalPlaintextSize {
+		return buf[:size], RECORD_LAST, nil
+	}
+
+	return buf[:size], 0, nil
 }
 
+// Decrypt receives a stream of records sent by Encrypt and checks that it
+// holds exactly totalPlaintextSize bytes. With UNKNOWN_SIZE it holds whatever
+// came before the last record.
 func (g *GcmService) Decrypt(r io.Reader, w io.Writer, totalPlaintextSize int64) error {
-	buf := make([]byte, CHUNK_SIZE+g.gcm.Overhead())
+	progress := g.newProgress(totalPlaintextSize)
 
-	start := time.Now()
-	updated := time.Time{}
-	received := int64(0)
-	receivedPlain := int64(0)
-	receivedSinceLastUpdate := int64(0)
+	var err error
+	if g.workers <= 1 || sequential(totalPlaintextSize, g.chunkSize) {
+		err = g.decryptSequential(r, w, totalPlaintextSize, progress)
+	} else {
+		err = g.decryptPipelined(r, w, totalPlaintextSize, progress)
+	}
+
+	if err != nil {
+		progress.fail(err)
+	}
+
+	return err
+}
 
-	defer fmt.Println()
+func (g *GcmService) decryptSequential(r io.Reader, w io.Writer, totalPlaintextSize int64, progress *progress) error {
+	received := int64(0)
 
 	for {
-		n, readErr := io.ReadFull(r, buf)
-		if readErr != nil && !errors.Is(readErr, io.EOF) && !errors.Is(readErr, io.ErrUnexpectedEOF) {
-			return fmt.Errorf("failed to read data: %w", readErr)
+		flags, data, err := g.readRecord(r, g.chunkSize)
+		if err != nil {
+			return streamReadError(err)
 		}
 
-		if readErr != nil {
-			if receivedPlain+int64(n)-int64(g.gcm.Overhead()) < totalPlaintextSize {
-				return fmt.Errorf("error: sender stopped sending file")
-			}
+		plaintext, err := g.decompressChunk(flags, data)
+		if err != nil {
+			return fmt.Errorf("failed to read data: %w", err)
 		}
 
-		plaintext, err := g.decryptGCM(buf[:n])
+		flags &^= RECORD_COMPRESSED
+		received += int64(len(plaintext))
+		err = checkDataRecord(flags, len(plaintext), received, totalPlaintextSize)
 		if err != nil {
-			return fmt.Errorf("failed to decrypt: %w", err)
+			return err
 		}
 
 		_, err = w.Write(plaintext)
@@ -186,65 +334,46 @@ func (g *GcmService) Decrypt(r io.Reader, w io.Writer, totalPlaintextSize int64)
 			return fmt.Errorf("failed to write data: %w", err)
 		}
 
-		received += int64(n)
-		receivedPlain += int64(len(plaintext))
-		receivedSinceLastUpdate += int64(n)
-
-		if time.Since(updated) > time.Second {
-			progress := float64(receivedPlain) / float64(totalPlaintextSize) * 100
-			fmt.Printf("\r%.2f%% %.2f MB/s   ", progress, float64(receivedSinceLastUpdate)/1024.0/1024.0/time.Since(updated).Seconds())
-			updated = time.Now()
-			receivedSinceLastUpdate = 0
-		}
+		progress.add(len(plaintext), RECORD_HEADER_SIZE+len(data)+g.gcm.Overhead())
 
-		if receivedPlain >= totalPlaintextSize {
-			fmt.Printf("\r100.00%% %.2f MB/s    \n", float64(received)/1024.0/1024.0/time.Since(start).Seconds())
+		if flags&RECORD_LAST != 0 {
+			progress.finish()
 			return nil
 		}
-
-		if readErr != nil {
-			return readErr
-		}
 	}
 }
 
-type HmacService struct {
-	shareCode string
-}
-
-const PBKDF_ITERATIONS = 100000
-
-func NewHmacService(shareCode string) *HmacService {
-	return &HmacService{
-		shareCode: shareCode,
+func streamReadError(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("error: sender stopped sending file: %w", ErrTruncated)
 	}
-}
 
-func (h *HmacService) Sign(data, salt []byte) []byte {
-	key := pbkdf2.Key([]byte(h.shareCode), salt, PBKDF_ITERATIONS, 128, sha512.New)
-	signer := hmac.New(sha512.New, key)
-	signer.Write(data)
-	sig := signer.Sum(nil)
-	return sig
+	return fmt.Errorf("failed to read data: %w", err)
 }
 
-func (h *HmacService) Verify(data, signature, salt []byte) bool {
-	sig := h.Sign(data, salt)
-	return hmac.Equal(sig, signature)
-}
+// checkDataRecord checks an opened record of size bytes, after which received
+// of totalPlaintextSize bytes are there.
+func checkDataRecord(flags byte, size int, received, totalPlaintextSize int64) error {
+	if flags&RECORD_MESSAGE != 0 {
+		return fmt.Errorf("%w: expected file data", ErrUnexpectedRecord)
+	}
 
-func ShareCodeHash(shareCode string) string {
-	hash := sha512.New().Sum([]byte(shareCode))
-	return base64.StdEncoding.EncodeToString(hash)
-}
+	last := flags&RECORD_LAST != 0
+	if size == 0 && !last {
+		return fmt.Errorf("%w: empty record", ErrUnexpectedRecord)
+	}
 
-func GenerateEcdhKeypair() (*ecdh.PrivateKey, error) {
-	return ecdh.P256().GenerateKey(rand.Reader)
-}
+	if totalPlaintextSize == UNKNOWN_SIZE {
+		return nil
+	}
 
-// 65 for P-256, 32 for X25519
-const ECDH_PUBKEY_SIZE = 65
+	if received > totalPlaintextSize {
+		return fmt.Errorf("%w: sender sent more than %d bytes", ErrUnexpectedRecord, totalPlaintextSize)
+	}
+
+	if last && received != totalPlaintextSize {
+		return fmt.Errorf("error: sender ended file after %d of %d bytes: %w", received, totalPlaintextSize, ErrTruncated)
+	}
 
-func ParsePublicKey(pubKey []byte) (*ecdh.PublicKey, error) {
-	return ecdh.P256().NewPublicKey(pubKey)
+	return nil
 }
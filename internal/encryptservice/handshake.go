@@ -0,0 +1,225 @@
+package encryptservice
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"slices"
+	"strings"
+)
+
+// A handshake negotiates the cipher suite while running the pake exchange.
+// One peer offers the suites it supports, the other one chooses:
+//
+//	offerer: Hello{Share, Suites, Key}
+//	chooser: Hello{Share, Suite, Key, Confirmation}
+//	offerer: Hello{Confirmation}
+//
+// Key is an X25519 public key, sent if X25519 is offered or chosen. The offer,
+// the choice and both keys are bound into the confirmations, a peer in the
+// middle that changes them (to force a weaker suite, say) fails confirmation.
+
+// Hello is the message sent to the peer during a handshake.
+type Hello struct {
+	Share        []byte  `json:",omitempty"`
+	Suites       *Suites `json:",omitempty"`
+	Suite        *Suite  `json:",omitempty"`
+	Key          []byte  `json:",omitempty"`
+	Confirmation []byte  `json:",omitempty"`
+}
+
+var ErrInvalidHello = fmt.Errorf("invalid handshake message")
+
+// Handshake is one side of a handshake.
+type Handshake struct {
+	pake   *Pake
+	suites Suites
+	key    *ecdh.PrivateKey
+}
+
+// HandshakeResult is the outcome of a handshake, usable once the peer's
+// confirmation is verified.
+type HandshakeResult struct {
+	Suite Suite
+
+	pake   *PakeResult
+	secret []byte
+}
+
+func NewHandshake(shareCode string, role PakeRole, suites Suites) (*Handshake, error) {
+	pake, err := NewPake(shareCode, role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Handshake{
+		pake:   pake,
+		suites: suites,
+	}, nil
+}
+
+// Share is our pake share.
+func (h *Handshake) Share() []byte {
+	return h.pake.Share()
+}
+
+// Offer is sent by the offering peer.
+func (h *Handshake) Offer() (*Hello, error) {
+	hello := &Hello{
+		Share:  h.pake.Share(),
+		Suites: &h.suites,
+	}
+
+	if slices.Contains(h.suites.Curves, CURVE_P256_X25519) {
+		key, err := h.generateKey()
+		if err != nil {
+			return nil, err
+		}
+
+		hello.Key = key.PublicKey().Bytes()
+	}
+
+	return hello, nil
+}
+
+// Answer chooses the suite for an offer. The returned hello carries our
+// confirmation, the offerer's one still has to be verified.
+func (h *Handshake) Answer(offer *Hello) (*Hello, *HandshakeResult, error) {
+	if offer.Suites == nil {
+		return nil, nil, ErrInvalidHello
+	}
+
+	suite, err := ChooseSuite(*offer.Suites, h.suites)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	answer := &Hello{
+		Share: h.pake.Share(),
+		Suite: &suite,
+	}
+
+	if suite.Curve == CURVE_P256_X25519 {
+		key, err := h.generateKey()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		answer.Key = key.PublicKey().Bytes()
+	}
+
+	result, err := h.finish(offer, answer, offer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	answer.Confirmation = result.Confirmation()
+
+	return answer, result, nil
+}
+
+// Finish completes the handshake for the offering peer. It checks the
+// chooser's confirmation, ours is sent back to it.
+func (h *Handshake) Finish(offer, answer *Hello) (*HandshakeResult, error) {
+	if answer.Suite == nil || !h.suites.supports(*answer.Suite) {
+		return nil, fmt.Errorf("%w: peer chose a suite that wasn't offered", ErrInvalidHello)
+	}
+
+	result, err := h.finish(offer, answer, answer)
+	if err != nil {
+		return nil, err
+	}
+
+	err = result.Verify(answer.Confirmation)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (h *Handshake) finish(offer, answer, peer *Hello) (*HandshakeResult, error) {
+	suite := *answer.Suite
+
+	pake, err := h.pake.Finish(peer.Share, handshakeAAD(offer, answer))
+	if err != nil {
+		return nil, err
+	}
+
+	result := &HandshakeResult{
+		Suite:  suite,
+		pake:   pake,
+		secret: pake.Secret,
+	}
+
+	if suite.Curve == CURVE_P256_X25519 {
+		if h.key == nil {
+			return nil, ErrInvalidHello
+		}
+
+		peerKey, err := ecdh.X25519().NewPublicKey(peer.Key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidHello, err)
+		}
+
+		shared, err := h.key.ECDH(peerKey)
+		if err != nil {
+			return nil, err
+		}
+
+		result.secret = append(slices.Clone(pake.Secret), shared...)
+	}
+
+	return result, nil
+}
+
+func (h *Handshake) generateKey() (*ecdh.PrivateKey, error) {
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	h.key = key
+	return key, nil
+}
+
+// handshakeAAD is everything negotiated besides the pake shares, those are
+// part of the pake transcript already.
+func handshakeAAD(offer, answer *Hello) []byte {
+	h := sha256.New()
+	for _, part := range []string{
+		strings.Join(offer.Suites.Ciphers, ","),
+		strings.Join(offer.Suites.Curves, ","),
+		answer.Suite.Cipher,
+		answer.Suite.Curve,
+		string(offer.Key),
+		string(answer.Key),
+	} {
+		writePart(h, []byte(part))
+	}
+
+	return h.Sum(nil)
+}
+
+func writePart(h hash.Hash, part []byte) {
+	binary.Write(h, binary.LittleEndian, uint64(len(part)))
+	h.Write(part)
+}
+
+// Confirmation is sent to the peer.
+func (r *HandshakeResult) Confirmation() []byte {
+	return r.pake.Confirmation
+}
+
+// Verify checks the confirmation sent by the peer.
+func (r *HandshakeResult) Verify(confirmation []byte) error {
+	return r.pake.Verify(confirmation)
+}
+
+// NewService sets up the encryption for the session.
+func (r *HandshakeResult) NewService(discoverPhrase string) (*GcmService, error) {
+	return NewGcmServiceFromSecret(r.secret, discoverPhrase, r.Suite)
+}
@@ -0,0 +1,203 @@
+package encryptservice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// runHandshake lets the receiver offer and the sender choose, like in local
+// mode. tamper can change the messages on the way.
+func runHandshake(t testing.TB, offerSuites, chooseSuites Suites, tamper func(offer, answer *Hello)) (*HandshakeResult, *HandshakeResult, error) {
+	offerer, err := NewHandshake(TEST_DISCOVER_PHRASE, PAKE_RECEIVER, offerSuites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chooser, err := NewHandshake(TEST_DISCOVER_PHRASE, PAKE_SENDER, chooseSuites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offer, err := offerer.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the chooser gets its own copy, like it would over the network
+	received := *offer
+	receivedSuites := *offer.Suites
+	received.Suites = &receivedSuites
+	if tamper != nil {
+		tamper(&received, nil)
+	}
+
+	answer, chosen, err := chooser.Answer(&received)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if tamper != nil {
+		tamper(nil, answer)
+	}
+
+	offered, err := offerer.Finish(offer, answer)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = chosen.Verify(offered.Confirmation())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return offered, chosen, nil
+}
+
+func TestHandshakeSuites(t *testing.T) {
+	for cipher := range ciphers {
+		for curve := range curveNames {
+			suites, err := NewSuites(cipher, curve)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			offered, chosen, err := runHandshake(t, suites, DefaultSuites(), nil)
+			if err != nil {
+				t.Fatal(cipher, curve, err)
+			}
+
+			want := Suite{Cipher: cipher, Curve: curve}
+			if offered.Suite != want || chosen.Suite != want {
+				t.Errorf("expected %v, got %v and %v", want, offered.Suite, chosen.Suite)
+			}
+
+			sender, err := chosen.NewService(TEST_DISCOVER_PHRASE)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			receiver, err := offered.NewService(TEST_DISCOVER_PHRASE)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data := make([]byte, 3*CHUNK_SIZE+5)
+			rand.Read(data)
+
+			wire := &bytes.Buffer{}
+			err = sender.Encrypt(bytes.NewReader(data), wire, int64(len(data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := &bytes.Buffer{}
+			err = receiver.Decrypt(wire, out, int64(len(data)))
+			if err != nil {
+				t.Fatal(want, err)
+			}
+
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Error("data differs for", want)
+			}
+		}
+	}
+}
+
+func TestChooseSuite(t *testing.T) {
+	aes := Suites{
+		Ciphers: []string{CIPHER_AES_256_GCM, CIPHER_CHACHA20_POLY1305, CIPHER_XCHACHA20_POLY1305},
+		Curves:  []string{CURVE_P256, CURVE_P256_X25519},
+	}
+	noAES := Suites{
+		Ciphers: []string{CIPHER_CHACHA20_POLY1305, CIPHER_XCHACHA20_POLY1305, CIPHER_AES_256_GCM},
+		Curves:  []string{CURVE_P256, CURVE_P256_X25519},
+	}
+
+	tests := []struct {
+		offer, own Suites
+		cipher     string
+	}{
+		{aes, aes, CIPHER_AES_256_GCM},
+		{noAES, noAES, CIPHER_CHACHA20_POLY1305},
+		// a peer without AES instructions gets ChaCha20 either way
+		{aes, noAES, CIPHER_CHACHA20_POLY1305},
+		{noAES, aes, CIPHER_CHACHA20_POLY1305},
+	}
+
+	for _, test := range tests {
+		suite, err := ChooseSuite(test.offer, test.own)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if suite.Cipher != test.cipher || suite.Curve != CURVE_P256 {
+			t.Errorf("offer %v, own %v: expected %s, got %v", test.offer.Ciphers, test.own.Ciphers, test.cipher, suite)
+		}
+	}
+
+	_, err := ChooseSuite(Suites{Ciphers: []string{"rot13"}, Curves: aes.Curves}, aes)
+	if !errors.Is(err, ErrNoCommonSuite) {
+		t.Error("expected ErrNoCommonSuite, got", err)
+	}
+}
+
+func TestHandshakeNoCommonSuite(t *testing.T) {
+	chacha, _ := NewSuites(CIPHER_CHACHA20_POLY1305, "")
+	aes, _ := NewSuites(CIPHER_AES_256_GCM, "")
+
+	_, _, err := runHandshake(t, chacha, aes, nil)
+	if !errors.Is(err, ErrNoCommonSuite) {
+		t.Error("expected ErrNoCommonSuite, got", err)
+	}
+
+	_, err = NewSuites("rot13", "")
+	if !errors.Is(err, ErrUnknownCipher) {
+		t.Error("expected ErrUnknownCipher, got", err)
+	}
+
+	_, err = NewSuites("", "p384")
+	if !errors.Is(err, ErrUnknownCurve) {
+		t.Error("expected ErrUnknownCurve, got", err)
+	}
+}
+
+func TestHandshakeDowngrade(t *testing.T) {
+	tampers := map[string]func(offer, answer *Hello){
+		"offered suites": func(offer, answer *Hello) {
+			if offer != nil {
+				offer.Suites.Ciphers = []string{CIPHER_XCHACHA20_POLY1305}
+				offer.Suites.Curves = []string{CURVE_P256}
+			}
+		},
+		"offered key": func(offer, answer *Hello) {
+			if offer != nil {
+				offer.Key = nil
+				offer.Suites.Curves = []string{CURVE_P256}
+			}
+		},
+		"chosen suite": func(offer, answer *Hello) {
+			if answer != nil {
+				answer.Suite.Cipher = CIPHER_XCHACHA20_POLY1305
+			}
+		},
+	}
+
+	for name, tamper := range tampers {
+		_, _, err := runHandshake(t, DefaultSuites(), DefaultSuites(), tamper)
+		if !errors.Is(err, ErrWrongShareCode) {
+			t.Errorf("%s: expected ErrWrongShareCode, got %v", name, err)
+		}
+	}
+
+	// a suite that wasn't offered is rejected before checking anything else
+	_, _, err := runHandshake(t, DefaultSuites(), DefaultSuites(), func(offer, answer *Hello) {
+		if answer != nil {
+			answer.Suite.Cipher = "rot13"
+		}
+	})
+	if !errors.Is(err, ErrInvalidHello) {
+		t.Error("expected ErrInvalidHello, got", err)
+	}
+}
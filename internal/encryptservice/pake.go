@@ -0,0 +1,240 @@
+package encryptservice
+
+import (
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// SPAKE2 (RFC 9382) over P-256. Both peers only learn whether the other one
+// knows the share code by completing the exchange, a captured share can't be
+// used to guess the code offline. Every run of the exchange lets an attacker
+// try a single code.
+//
+// The sender uses M and the receiver N. Both are derived from fixed seeds by
+// hashing to the curve, so nobody knows their discrete logarithm.
+const PAKE_SEED_M = "fastshare SPAKE2 P-256 M"
+const PAKE_SEED_N = "fastshare SPAKE2 P-256 N"
+
+// PAKE_SHARE_SIZE is the size of an uncompressed P-256 point.
+const PAKE_SHARE_SIZE = 65
+
+// PAKE_CONFIRMATION_SIZE is the size of a key confirmation MAC.
+const PAKE_CONFIRMATION_SIZE = sha256.Size
+
+type PakeRole int
+
+const (
+	PAKE_SENDER PakeRole = iota
+	PAKE_RECEIVER
+)
+
+var ErrInvalidShare = fmt.Errorf("invalid pake share")
+var ErrWrongShareCode = fmt.Errorf("key confirmation failed, the peer used a different share code")
+
+type pakePoint struct {
+	x, y *big.Int
+}
+
+var pakePoints struct {
+	once sync.Once
+	m, n pakePoint
+}
+
+// hashToCurve returns the first point with an even y coordinate whose x
+// coordinate is sha256(seed, counter).
+func hashToCurve(seed string) pakePoint {
+	curve := elliptic.P256()
+	for i := uint32(0); ; i++ {
+		h := sha256.New()
+		h.Write([]byte(seed))
+		binary.Write(h, binary.BigEndian, i)
+
+		compressed := append([]byte{2}, h.Sum(nil)...)
+		x, y := elliptic.UnmarshalCompressed(curve, compressed)
+		if x != nil {
+			return pakePoint{x, y}
+		}
+	}
+}
+
+func pakeMN() (pakePoint, pakePoint) {
+	pakePoints.once.Do(func() {
+		pakePoints.m = hashToCurve(PAKE_SEED_M)
+		pakePoints.n = hashToCurve(PAKE_SEED_N)
+	})
+
+	return pakePoints.m, pakePoints.n
+}
+
+// Pake is one side of a SPAKE2 exchange.
+type Pake struct {
+	role  PakeRole
+	w     []byte
+	x     []byte
+	share []byte
+}
+
+// PakeResult is the outcome of a finished exchange.
+type PakeResult struct {
+	// Secret is the shared secret, only usable after the peer's
+	// confirmation was verified
+	Secret []byte
+	// Confirmation is sent to the peer
+	Confirmation []byte
+
+	peerConfirmation []byte
+}
+
+// NewPake starts an exchange for shareCode.
+func NewPake(shareCode string, role PakeRole) (*Pake, error) {
+	curve := elliptic.P256()
+	order := curve.Params().N
+
+	// w doesn't need to be slow to compute, a guess can only be checked by
+	// running the exchange with one of the peers
+	h := sha512.New()
+	h.Write([]byte("fastshare SPAKE2 password"))
+	h.Write([]byte(shareCode))
+	w := new(big.Int).Mod(new(big.Int).SetBytes(h.Sum(nil)), order)
+
+	x, err := randomScalar(order)
+	if err != nil {
+		return nil, err
+	}
+
+	m, n := pakeMN()
+	own := m
+	if role == PAKE_RECEIVER {
+		own = n
+	}
+
+	// share = x*G + w*M (or N)
+	xx, xy := curve.ScalarBaseMult(x)
+	wx, wy := curve.ScalarMult(own.x, own.y, scalarBytes(w))
+	sx, sy := curve.Add(xx, xy, wx, wy)
+
+	return &Pake{
+		role:  role,
+		w:     scalarBytes(w),
+		x:     x,
+		share: elliptic.Marshal(curve, sx, sy),
+	}, nil
+}
+
+// Share is sent to the peer.
+func (p *Pake) Share() []byte {
+	return p.share
+}
+
+// Finish computes the shared secret from the peer's share. Whether the peer
+// knows the share code is only known once its confirmation is verified.
+// aad is bound into the confirmations, both peers must pass the same.
+func (p *Pake) Finish(peerShare []byte, aad []byte) (*PakeResult, error) {
+	curve := elliptic.P256()
+
+	if len(peerShare) != PAKE_SHARE_SIZE {
+		return nil, ErrInvalidShare
+	}
+
+	px, py := elliptic.Unmarshal(curve, peerShare)
+	if px == nil {
+		return nil, ErrInvalidShare
+	}
+
+	m, n := pakeMN()
+	peer := n
+	senderShare, receiverShare := p.share, peerShare
+	if p.role == PAKE_RECEIVER {
+		peer = m
+		senderShare, receiverShare = peerShare, p.share
+	}
+
+	// K = x * (peer share - w*N (or M))
+	wx, wy := curve.ScalarMult(peer.x, peer.y, p.w)
+	wy.Sub(curve.Params().P, wy)
+	dx, dy := curve.Add(px, py, wx, wy)
+	kx, ky := curve.ScalarMult(dx, dy, p.x)
+	if kx.Sign() == 0 && ky.Sign() == 0 {
+		return nil, ErrInvalidShare
+	}
+
+	transcript := sha512.New()
+	for _, part := range [][]byte{
+		senderShare,
+		receiverShare,
+		elliptic.Marshal(curve, kx, ky),
+		p.w,
+	} {
+		binary.Write(transcript, binary.LittleEndian, uint64(len(part)))
+		transcript.Write(part)
+	}
+
+	tt := transcript.Sum(nil)
+	secret, auth := tt[:32], tt[32:]
+
+	kdf := hkdf.New(sha256.New, auth, nil, append([]byte("ConfirmationKeys"), aad...))
+	senderKey := make([]byte, 32)
+	receiverKey := make([]byte, 32)
+	_, err := io.ReadFull(kdf, senderKey)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.ReadFull(kdf, receiverKey)
+	if err != nil {
+		return nil, err
+	}
+
+	senderConfirmation := confirm(senderKey, tt)
+	receiverConfirmation := confirm(receiverKey, tt)
+
+	result := &PakeResult{
+		Secret:           secret,
+		Confirmation:     senderConfirmation,
+		peerConfirmation: receiverConfirmation,
+	}
+
+	if p.role == PAKE_RECEIVER {
+		result.Confirmation, result.peerConfirmation = receiverConfirmation, senderConfirmation
+	}
+
+	return result, nil
+}
+
+// Verify checks the confirmation sent by the peer.
+func (r *PakeResult) Verify(confirmation []byte) error {
+	if !hmac.Equal(confirmation, r.peerConfirmation) {
+		return ErrWrongShareCode
+	}
+
+	return nil
+}
+
+func confirm(key, transcript []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(transcript)
+	return mac.Sum(nil)
+}
+
+func randomScalar(order *big.Int) ([]byte, error) {
+	k, err := rand.Int(rand.Reader, new(big.Int).Sub(order, big.NewInt(1)))
+	if err != nil {
+		return nil, err
+	}
+
+	return scalarBytes(k.Add(k, big.NewInt(1))), nil
+}
+
+func scalarBytes(k *big.Int) []byte {
+	return k.FillBytes(make([]byte, 32))
+}
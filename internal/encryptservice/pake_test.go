@@ -0,0 +1,97 @@
+package encryptservice
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func runPake(t *testing.T, senderCode, receiverCode string) (*PakeResult, *PakeResult) {
+	sender, err := NewPake(senderCode, PAKE_SENDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := NewPake(receiverCode, PAKE_RECEIVER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	senderResult, err := sender.Finish(receiver.Share(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiverResult, err := receiver.Finish(sender.Share(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return senderResult, receiverResult
+}
+
+func TestPakeSameCode(t *testing.T) {
+	sender, receiver := runPake(t, TEST_DISCOVER_PHRASE, TEST_DISCOVER_PHRASE)
+
+	if !bytes.Equal(sender.Secret, receiver.Secret) {
+		t.Error("secrets differ")
+	}
+
+	if err := sender.Verify(receiver.Confirmation); err != nil {
+		t.Error("sender rejected receiver:", err)
+	}
+
+	if err := receiver.Verify(sender.Confirmation); err != nil {
+		t.Error("receiver rejected sender:", err)
+	}
+
+	// a peer echoing our own confirmation must not pass
+	if sender.Verify(sender.Confirmation) == nil {
+		t.Error("reflected confirmation accepted")
+	}
+}
+
+func TestPakeDifferentCode(t *testing.T) {
+	sender, receiver := runPake(t, TEST_DISCOVER_PHRASE, "bluepenguin24")
+
+	if bytes.Equal(sender.Secret, receiver.Secret) {
+		t.Error("different codes agreed on a secret")
+	}
+
+	if err := sender.Verify(receiver.Confirmation); !errors.Is(err, ErrWrongShareCode) {
+		t.Error("expected ErrWrongShareCode, got", err)
+	}
+
+	if err := receiver.Verify(sender.Confirmation); !errors.Is(err, ErrWrongShareCode) {
+		t.Error("expected ErrWrongShareCode, got", err)
+	}
+}
+
+func TestPakeInvalidShare(t *testing.T) {
+	sender, err := NewPake(TEST_DISCOVER_PHRASE, PAKE_SENDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	notOnCurve := bytes.Clone(sender.Share())
+	notOnCurve[PAKE_SHARE_SIZE-1] ^= 1
+
+	for _, share := range [][]byte{nil, sender.Share()[:33], notOnCurve} {
+		_, err = sender.Finish(share, nil)
+		if !errors.Is(err, ErrInvalidShare) {
+			t.Errorf("share %x: expected ErrInvalidShare, got %v", share, err)
+		}
+	}
+}
+
+func TestPakePoints(t *testing.T) {
+	m, n := pakeMN()
+	if m.x.Cmp(n.x) == 0 {
+		t.Error("M and N are the same point")
+	}
+
+	// derivation must not change, or peers of different versions can't pair
+	if m2 := hashToCurve(PAKE_SEED_M); m2.x.Cmp(m.x) != 0 || m2.y.Cmp(m.y) != 0 {
+		t.Error("M is not deterministic")
+	}
+}
@@ -0,0 +1,64 @@
+package encryptservice
+
+import (
+	"crypto/rand"
+	"fmt"
+	"slices"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// A stored share has no peer to run the pake exchange with, so its key is
+// derived from the share code. Whoever holds the stored records can guess
+// share codes offline, the share code has to be long and argon2id makes every
+// guess expensive.
+const KDF_ARGON2ID = "argon2id"
+
+const SALT_SIZE = 16
+
+const (
+	ARGON2_TIME    = 3
+	ARGON2_MEMORY  = 64 * 1024
+	ARGON2_THREADS = 4
+)
+
+// PasswordKey is what's needed besides the share code to derive the key of a
+// stored share. It isn't secret and is stored in front of the records.
+type PasswordKey struct {
+	Suite Suite
+	Salt  []byte
+}
+
+// NewPasswordKey picks a random salt and the cipher suites prefers.
+func NewPasswordKey(suites Suites) (*PasswordKey, error) {
+	if len(suites.Ciphers) == 0 {
+		return nil, ErrNoCommonSuite
+	}
+
+	salt := make([]byte, SALT_SIZE)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PasswordKey{
+		Suite: Suite{Cipher: suites.Ciphers[0], Curve: KDF_ARGON2ID},
+		Salt:  salt,
+	}, nil
+}
+
+// NewService derives the key from shareCode. suites are the ciphers this side
+// accepts.
+func (k *PasswordKey) NewService(shareCode string, suites Suites) (*GcmService, error) {
+	if k.Suite.Curve != KDF_ARGON2ID || len(k.Salt) != SALT_SIZE {
+		return nil, fmt.Errorf("unsupported key derivation %q", k.Suite.Curve)
+	}
+
+	if !slices.Contains(suites.Ciphers, k.Suite.Cipher) {
+		return nil, ErrNoCommonSuite
+	}
+
+	secret := argon2.IDKey([]byte(shareCode), k.Salt, ARGON2_TIME, ARGON2_MEMORY, ARGON2_THREADS, 32)
+
+	return NewGcmServiceFromSecret(secret, shareCode, k.Suite)
+}
@@ -0,0 +1,60 @@
+package encryptservice
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestPasswordKey(t *testing.T) {
+	suites := DefaultSuites()
+	key, err := NewPasswordKey(suites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := key.NewService("BlueOrangeHorseBatteryStaple", suites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	err = sender.WriteMessage(buf, []byte("stored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed := bytes.Clone(buf.Bytes())
+
+	receiver, err := key.NewService("BlueOrangeHorseBatteryStaple", suites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	message, err := receiver.ReadMessage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(message) != "stored" {
+		t.Fatalf("expected %q, got %q", "stored", message)
+	}
+
+	wrong, err := key.NewService("BlueOrangeHorseBatteryStapler", suites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = wrong.ReadMessage(bytes.NewReader(sealed))
+	if !errors.Is(err, ErrDecrypt) {
+		t.Fatalf("expected ErrDecrypt for the wrong share code, got %v", err)
+	}
+
+	other := Suites{Ciphers: []string{CIPHER_XCHACHA20_POLY1305}, Curves: suites.Curves}
+	if key.Suite.Cipher != CIPHER_XCHACHA20_POLY1305 {
+		_, err = key.NewService("BlueOrangeHorseBatteryStaple", other)
+		if !errors.Is(err, ErrNoCommonSuite) {
+			t.Fatalf("expected ErrNoCommonSuite, got %v", err)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package encryptservice
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The pipeline seals or opens the records of a stream on a pool of workers.
+// The goroutine reading the input decides the flags of every record and hands
+// out nonces and keys in order with nextRecord, so the records on the wire are
+// the same as the ones of the sequential loops. A second goroutine waits for
+// the records in the order they were read and writes them out.
+//
+// Every record in flight has its own buffer, at most PIPELINE_DEPTH per
+// worker, so memory use stays at about workers * PIPELINE_DEPTH * chunk size.
+const PIPELINE_DEPTH = 4
+
+// SetWorkers sets how many goroutines seal and open records. With 1 records
+// are handled one after another, like before the pipeline.
+func (g *GcmService) SetWorkers(workers int) {
+	g.workers = max(workers, 1)
+}
+
+type pipelineJob struct {
+	seal   recordSeal
+	header []byte
+	// buf holds the header and the data of a sealed record, or the
+	// ciphertext of a record to open
+	buf  []byte
+	size int
+	// plain is the size of a chunk before it was compressed
+	plain int
+	// inflated holds a decompressed record after it was opened
+	inflated []byte
+	out      []byte
+	err      error
+	done     chan struct{}
+}
+
+type pipeline struct {
+	open bool
+	// opened records are decompressed with codec, up to limit bytes
+	codec codec
+	limit int
+	// jobs go to the workers, ordered to the writer in the same order
+	jobs    chan *pipelineJob
+	ordered chan *pipelineJob
+	free    chan *pipelineJob
+	stop    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+}
+
+func (g *GcmService) newPipeline(open bool) *pipeline {
+	inFlight := g.workers * PIPELINE_DEPTH
+	p := &pipeline{
+		open:    open,
+		codec:   g.codec,
+		limit:   g.chunkSize,
+		jobs:    make(chan *pipelineJob, inFlight),
+		ordered: make(chan *pipelineJob, inFlight),
+		free:    make(chan *pipelineJob, inFlight),
+		stop:    make(chan struct{}),
+	}
+
+	for range inFlight {
+		p.free <- &pipelineJob{
+			header: make([]byte, RECORD_HEADER_SIZE),
+			done:   make(chan struct{}, 1),
+		}
+	}
+
+	for range g.workers {
+		p.wg.Add(1)
+		go p.work()
+	}
+
+	return p
+}
+
+func (p *pipeline) work() {
+	defer p.wg.Done()
+
+	for job := range p.jobs {
+		if p.open {
+			job.out, job.err = job.seal.open(job.buf)
+			if job.err == nil && job.header[0]&RECORD_COMPRESSED != 0 {
+				job.inflated, job.err = decompress(p.codec, job.inflated[:0], job.out, p.limit)
+				job.out = job.inflated
+			}
+		} else {
+			job.out = job.seal.seal(job.buf[RECORD_HEADER_SIZE : RECORD_HEADER_SIZE+job.size])
+		}
+
+		job.done <- struct{}{}
+	}
+}
+
+// acquire returns a free job, or false once the writer gave up.
+func (p *pipeline) acquire(size int) (*pipelineJob, bool) {
+	select {
+	case job := <-p.free:
+		if cap(job.buf) < size {
+			job.buf = make([]byte, size)
+		}
+
+		job.buf = job.buf[:size]
+		return job, true
+	case <-p.stop:
+		return nil, false
+	}
+}
+
+// submit never blocks, there are no more jobs than room in the channels.
+func (p *pipeline) submit(job *pipelineJob) {
+	p.jobs <- job
+	p.ordered <- job
+}
+
+// results calls handle with every finished job in order. After handle returns
+// an error the remaining jobs are only drained, and the reader is stopped.
+func (p *pipeline) results(handle func(job *pipelineJob) error) chan error {
+	errc := make(chan error, 1)
+
+	go func() {
+		var err error
+		for job := range p.ordered {
+			<-job.done
+			if err == nil {
+				err = handle(job)
+				if err != nil {
+					p.once.Do(func() { close(p.stop) })
+				}
+			}
+
+			p.free <- job
+		}
+
+		errc <- err
+	}()
+
+	return errc
+}
+
+// finish waits for the writer and the workers, readErr is what stopped the
+// reading goroutine. An error of the writer is about an earlier record, so it
+// wins.
+func (p *pipeline) finish(readErr error, errc chan error) error {
+	close(p.jobs)
+	close(p.ordered)
+
+	writeErr := <-errc
+	p.wg.Wait()
+
+	if writeErr != nil {
+		return writeErr
+	}
+
+	return readErr
+}
+
+func (g *GcmService) encryptPipelined(r io.Reader, w io.Writer, totalPlaintextSize int64, progress *progress) error {
+	p := g.newPipeline(false)
+
+	errc := p.results(func(job *pipelineJob) error {
+		record := job.buf[:RECORD_HEADER_SIZE+len(job.out)]
+		_, err := w.Write(record)
+		if err != nil {
+			return fmt.Errorf("failed to write data: %w", err)
+		}
+
+		progress.add(job.plain, len(record))
+		if job.header[0]&RECORD_LAST != 0 {
+			progress.finish()
+		}
+
+		return nil
+	})
+
+	return p.finish(g.dispatchSeal(p, r, totalPlaintextSize), errc)
+}
+
+// dispatchSeal reads the chunks of r and hands them to the workers.
+func (g *GcmService) dispatchSeal(p *pipeline, r io.Reader, totalPlaintextSize int64) error {
+	sent := int64(0)
+
+	for {
+		job, ok := p.acquire(RECORD_HEADER_SIZE + g.chunkSize + g.gcm.Overhead())
+		if !ok {
+			return nil
+		}
+
+		chunk, flags, err := readChunk(r, job.buf[RECORD_HEADER_SIZE:RECORD_HEADER_SIZE+g.chunkSize], sent, totalPlaintextSize)
+		if err != nil {
+			return err
+		}
+
+		size := len(chunk)
+		sent += int64(size)
+		job.plain = size
+
+		data, compressed := g.compressChunk(chunk)
+		if compressed != 0 {
+			size = copy(job.buf[RECORD_HEADER_SIZE:], data)
+			flags |= compressed
+		}
+
+		if g.needsRekey(size) {
+			flags |= RECORD_REKEY
+		}
+
+		binary.BigEndian.PutUint32(job.buf, uint32(size))
+		job.buf[0] = flags
+		copy(job.header, job.buf[:RECORD_HEADER_SIZE])
+		job.size = size
+
+		job.seal, err = g.nextRecord(job.header, size)
+		if err != nil {
+			return fmt.Errorf("failed to write data: %w", err)
+		}
+
+		p.submit(job)
+
+		if flags&RECORD_LAST != 0 {
+			return nil
+		}
+	}
+}
+
+func (g *GcmService) decryptPipelined(r io.Reader, w io.Writer, totalPlaintextSize int64, progress *progress) error {
+	p := g.newPipeline(true)
+	received := int64(0)
+
+	errc := p.results(func(job *pipelineJob) error {
+		if job.err != nil {
+			return fmt.Errorf("failed to read data: %w: %w", ErrDecrypt, job.err)
+		}
+
+		flags := job.header[0] &^ (RECORD_REKEY | RECORD_COMPRESSED)
+		received += int64(len(job.out))
+		err := checkDataRecord(flags, len(job.out), received, totalPlaintextSize)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(job.out)
+		if err != nil {
+			return fmt.Errorf("failed to write data: %w", err)
+		}
+
+		progress.add(len(job.out), RECORD_HEADER_SIZE+len(job.buf))
+		if flags&RECORD_LAST != 0 {
+			progress.finish()
+		}
+
+		return nil
+	})
+
+	return p.finish(g.dispatchOpen(p, r), errc)
+}
+
+// dispatchOpen reads records from r and hands them to the workers. It stops
+// after the last record of the stream, whatever follows belongs to the caller.
+func (g *GcmService) dispatchOpen(p *pipeline, r io.Reader) error {
+	for {
+		header, size, err := g.readHeader(r, g.chunkSize)
+		if err != nil {
+			return streamReadError(err)
+		}
+
+		job, ok := p.acquire(size + g.gcm.Overhead())
+		if !ok {
+			return nil
+		}
+
+		_, err = io.ReadFull(r, job.buf)
+		if err != nil {
+			return streamReadError(err)
+		}
+
+		copy(job.header, header)
+		job.size = size
+
+		job.seal, err = g.nextRecord(job.header, size)
+		if err != nil {
+			return streamReadError(err)
+		}
+
+		p.submit(job)
+
+		if header[0]&RECORD_LAST != 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package encryptservice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestPipelineInterop(t *testing.T) {
+	for _, workers := range [][2]int{{1, 4}, {4, 1}, {4, 4}, {3, 7}} {
+		sender, receiver := newServicePair(t)
+		sender.SetWorkers(workers[0])
+		receiver.SetWorkers(workers[1])
+		sender.rekeyRecords = 5
+		receiver.rekeyRecords = 5
+
+		data := make([]byte, 37*CHUNK_SIZE+11)
+		rand.Read(data)
+
+		wire := &bytes.Buffer{}
+		err := sender.Encrypt(bytes.NewReader(data), wire, int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = sender.WriteMessage(wire, []byte(TEST_STRING))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := &bytes.Buffer{}
+		err = receiver.Decrypt(wire, out, int64(len(data)))
+		if err != nil {
+			t.Fatal(workers, err)
+		}
+
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Error("data differs for workers", workers)
+		}
+
+		// both ends must be left at the same nonce and key
+		msg, err := receiver.ReadMessage(wire)
+		if err != nil || string(msg) != TEST_STRING {
+			t.Error("message after stream not received", workers, err)
+		}
+	}
+}
+
+func TestPipelineTampering(t *testing.T) {
+	sender, receiver := newServicePair(t)
+	sender.SetWorkers(4)
+	receiver.SetWorkers(4)
+
+	data := make([]byte, 20*CHUNK_SIZE)
+	wire := &bytes.Buffer{}
+	err := sender.Encrypt(bytes.NewReader(data), wire, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recs := records(t, wire.Bytes())
+	recs[7][RECORD_HEADER_SIZE] ^= 1
+
+	out := &bytes.Buffer{}
+	err = receiver.Decrypt(bytes.NewReader(bytes.Join(recs, nil)), out, int64(len(data)))
+	if err == nil {
+		t.Fatal("tampered record accepted")
+	}
+
+	if out.Len() != 7*CHUNK_SIZE {
+		t.Errorf("expected the %d bytes before the tampered record, got %d", 7*CHUNK_SIZE, out.Len())
+	}
+
+	// a stream that ends early is reported as truncated
+	recs = records(t, wire.Bytes())
+	err = receiver.Decrypt(bytes.NewReader(bytes.Join(recs[:10], nil)), &bytes.Buffer{}, int64(len(data)))
+	if err == nil {
+		t.Error("truncated stream accepted")
+	}
+}
+
+// failingWriter fails after n bytes.
+type failingWriter struct {
+	n int
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		return 0, io.ErrClosedPipe
+	}
+
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestPipelineWriteError(t *testing.T) {
+	sender, _ := newServicePair(t)
+	sender.SetWorkers(4)
+
+	data := make([]byte, 100*CHUNK_SIZE)
+	err := sender.Encrypt(bytes.NewReader(data), &failingWriter{n: 3 * CHUNK_SIZE}, int64(len(data)))
+	if err == nil {
+		t.Error("write error not returned")
+	}
+}
+
+const BENCHMARK_SIZE = 64 * 1024 * 1024
+
+func benchmarkModes(b *testing.B, run func(b *testing.B, workers, chunkSize int)) {
+	for _, chunkSize := range []int{CHUNK_SIZE, MAX_CHUNK_SIZE} {
+		b.Run(fmt.Sprintf("sequential/%dKiB", chunkSize/1024), func(b *testing.B) {
+			run(b, 1, chunkSize)
+		})
+
+		b.Run(fmt.Sprintf("pipelined/%dKiB", chunkSize/1024), func(b *testing.B) {
+			run(b, 0, chunkSize)
+		})
+	}
+}
+
+func newBenchmarkPair(b *testing.B, workers, chunkSize int) (*GcmService, *GcmService) {
+	sender, receiver := newServicePair(b)
+	for _, s := range []*GcmService{sender, receiver} {
+		if workers > 0 {
+			s.SetWorkers(workers)
+		}
+
+		err := s.SetChunkSize(chunkSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	return sender, receiver
+}
+
+func BenchmarkEncrypt(b *testing.B) {
+	data := make([]byte, BENCHMARK_SIZE)
+
+	benchmarkModes(b, func(b *testing.B, workers, chunkSize int) {
+		sender, _ := newBenchmarkPair(b, workers, chunkSize)
+		b.SetBytes(BENCHMARK_SIZE)
+
+		for range b.N {
+			err := sender.Encrypt(bytes.NewReader(data), io.Discard, BENCHMARK_SIZE)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDecrypt(b *testing.B) {
+	data := make([]byte, BENCHMARK_SIZE)
+
+	benchmarkModes(b, func(b *testing.B, workers, chunkSize int) {
+		b.SetBytes(BENCHMARK_SIZE)
+
+		for range b.N {
+			b.StopTimer()
+			sender, receiver := newBenchmarkPair(b, workers, chunkSize)
+			wire := &bytes.Buffer{}
+			err := sender.Encrypt(bytes.NewReader(data), wire, BENCHMARK_SIZE)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+
+			err = receiver.Decrypt(wire, io.Discard, BENCHMARK_SIZE)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
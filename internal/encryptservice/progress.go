@@ -0,0 +1,324 @@
+package encryptservice
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PROGRESS_INTERVAL is how often a reporter gets an update at most.
+const PROGRESS_INTERVAL = time.Second
+
+// Progress is how far the file data of one entry got.
+type Progress struct {
+	// Name is the entry, as set with SetProgressName
+	Name string
+	// Total and Done are bytes of file data before compression, Total is
+	// UNKNOWN_SIZE for a stream that is sent until it ends
+	Total int64
+	Done  int64
+	// Wire is the bytes sent or received for it, with headers and tags
+	Wire    int64
+	Elapsed time.Duration
+	// Rate is bytes of file data per second, over the last interval until
+	// finished, over the whole file after
+	Rate float64
+	// ETA is 0 if it isn't known yet
+	ETA time.Duration
+}
+
+// ProgressReporter is told how a transfer is getting on. The calls for an
+// entry are never made concurrently, even if it is striped across streams.
+type ProgressReporter interface {
+	Started(p Progress)
+	// Update is called at most every PROGRESS_INTERVAL.
+	Update(p Progress)
+	Finished(p Progress)
+	Failed(p Progress, err error)
+}
+
+// SetProgressReporter sets where the progress of Encrypt, Decrypt and
+// NewStreamProgress is reported. nil reports nothing.
+func (g *GcmService) SetProgressReporter(reporter ProgressReporter) {
+	if reporter == nil {
+		reporter = QuietProgress{}
+	}
+
+	g.reporter = reporter
+}
+
+// SetProgressName names the entry reported by the next Encrypt or Decrypt.
+func (g *GcmService) SetProgressName(name string) {
+	g.progressName = name
+}
+
+// progress tracks one entry for a reporter, it can be used from several
+// goroutines at once.
+type progress struct {
+	m           sync.Mutex
+	reporter    ProgressReporter
+	p           Progress
+	sinceUpdate int64
+	start       time.Time
+	updated     time.Time
+}
+
+func (g *GcmService) newProgress(total int64) *progress {
+	p := &progress{
+		reporter: g.reporter,
+		p:        Progress{Name: g.progressName, Total: total},
+		start:    time.Now(),
+	}
+
+	p.updated = p.start
+	p.reporter.Started(p.p)
+
+	return p
+}
+
+// add counts a record holding plain bytes of data, wire bytes with header and
+// tag. plain is the size before compression, so the percentage is of the
+// original size.
+func (p *progress) add(plain, wire int) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.p.Done += int64(plain)
+	p.p.Wire += int64(wire)
+	p.sinceUpdate += int64(plain)
+
+	now := time.Now()
+	if now.Sub(p.updated) < PROGRESS_INTERVAL {
+		return
+	}
+
+	p.p.Elapsed = now.Sub(p.start)
+	p.p.Rate = float64(p.sinceUpdate) / now.Sub(p.updated).Seconds()
+	p.p.ETA = 0
+	if p.p.Rate > 0 && p.p.Total != UNKNOWN_SIZE {
+		p.p.ETA = time.Duration(float64(p.p.Total-p.p.Done) / p.p.Rate * float64(time.Second))
+	}
+
+	p.updated = now
+	p.sinceUpdate = 0
+	p.reporter.Update(p.p)
+}
+
+func (p *progress) finish() {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.p.Elapsed = time.Since(p.start)
+	p.p.ETA = 0
+	if p.p.Elapsed > 0 {
+		p.p.Rate = float64(p.p.Done) / p.p.Elapsed.Seconds()
+	}
+
+	p.reporter.Finished(p.p)
+}
+
+func (p *progress) fail(err error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	p.p.Elapsed = time.Since(p.start)
+	p.reporter.Failed(p.p, err)
+}
+
+// QuietProgress reports nothing. As an io.Writer it drops status lines, see
+// Status.Log.
+type QuietProgress struct{}
+
+func (QuietProgress) Started(p Progress)           {}
+func (QuietProgress) Update(p Progress)            {}
+func (QuietProgress) Finished(p Progress)          {}
+func (QuietProgress) Failed(p Progress, err error) {}
+
+func (QuietProgress) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+const PROGRESS_BAR_WIDTH = 30
+
+// TerminalProgress draws a progress bar, redrawn in place on every update.
+// As an io.Writer it writes status lines, see Status.Log, above the bar.
+type TerminalProgress struct {
+	m sync.Mutex
+	w io.Writer
+	// drawn is set while the cursor is at the end of a bar
+	drawn bool
+}
+
+// NewTerminalProgress draws to w, usually os.Stderr so the bar doesn't end up
+// in received data printed to stdout.
+func NewTerminalProgress(w io.Writer) *TerminalProgress {
+	return &TerminalProgress{w: w}
+}
+
+func (t *TerminalProgress) Started(p Progress) {}
+
+func (t *TerminalProgress) Update(p Progress) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	eta := "--:--"
+	if p.Total == UNKNOWN_SIZE {
+		t.draw(p, fmt.Sprintf("after %s", formatDuration(p.Elapsed)))
+		return
+	}
+
+	if p.ETA > 0 {
+		eta = formatDuration(p.ETA)
+	}
+
+	t.draw(p, fmt.Sprintf("ETA %s", eta))
+}
+
+func (t *TerminalProgress) Finished(p Progress) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	t.draw(p, fmt.Sprintf("in %s", formatDuration(p.Elapsed)))
+	fmt.Fprintln(t.w)
+	t.drawn = false
+}
+
+func (t *TerminalProgress) Failed(p Progress, err error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.drawn {
+		fmt.Fprintln(t.w)
+		t.drawn = false
+	}
+}
+
+// Write clears the bar and writes p in its place, the next update draws the
+// bar again below it.
+func (t *TerminalProgress) Write(p []byte) (int, error) {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.drawn {
+		// back to the start of the line and erase it
+		fmt.Fprint(t.w, "\r\x1b[K")
+		t.drawn = false
+	}
+
+	return t.w.Write(p)
+}
+
+func (t *TerminalProgress) draw(p Progress, suffix string) {
+	if p.Total == UNKNOWN_SIZE {
+		// no bar without knowing where it ends
+		fmt.Fprintf(t.w, "\r%.2f MB %.2f MB/s %s    ", float64(p.Done)/1024.0/1024.0, p.Rate/1024.0/1024.0, suffix)
+		t.drawn = true
+		return
+	}
+
+	fraction := 1.0
+	if p.Total > 0 {
+		fraction = float64(p.Done) / float64(p.Total)
+	}
+
+	filled := int(fraction * PROGRESS_BAR_WIDTH)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", PROGRESS_BAR_WIDTH-filled)
+
+	fmt.Fprintf(t.w, "\r[%s] %6.2f%% %.2f MB/s %s    ", bar, fraction*100, p.Rate/1024.0/1024.0, suffix)
+	t.drawn = true
+}
+
+func formatDuration(d time.Duration) string {
+	s := int(d.Round(time.Second).Seconds())
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
+
+// JsonProgress writes every report as a line of json, for other programs to
+// read.
+type JsonProgress struct {
+	m   sync.Mutex
+	enc *json.Encoder
+}
+
+type progressEvent struct {
+	Event   string  `json:"event"`
+	Name    string  `json:"name"`
+	Total   int64   `json:"total"`
+	Done    int64   `json:"done"`
+	Wire    int64   `json:"wire"`
+	Elapsed float64 `json:"elapsed"`
+	Rate    float64 `json:"rate"`
+	ETA     float64 `json:"eta,omitempty"`
+	Error   string  `json:"error,omitempty"`
+}
+
+// statusEvent is a status line written to JsonProgress.
+type statusEvent struct {
+	Event   string `json:"event"`
+	Message string `json:"message"`
+}
+
+func NewJsonProgress(w io.Writer) *JsonProgress {
+	return &JsonProgress{enc: json.NewEncoder(w)}
+}
+
+func (j *JsonProgress) Started(p Progress) {
+	j.write("started", p, nil)
+}
+
+func (j *JsonProgress) Update(p Progress) {
+	j.write("progress", p, nil)
+}
+
+func (j *JsonProgress) Finished(p Progress) {
+	j.write("finished", p, nil)
+}
+
+func (j *JsonProgress) Failed(p Progress, err error) {
+	j.write("failed", p, err)
+}
+
+// Write writes every line of p as a "status" event, see Status.Log.
+func (j *JsonProgress) Write(p []byte) (int, error) {
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		err := j.enc.Encode(&statusEvent{Event: "status", Message: line})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (j *JsonProgress) write(event string, p Progress, err error) {
+	e := &progressEvent{
+		Event:   event,
+		Name:    p.Name,
+		Total:   p.Total,
+		Done:    p.Done,
+		Wire:    p.Wire,
+		Elapsed: p.Elapsed.Seconds(),
+		Rate:    p.Rate,
+		ETA:     p.ETA.Seconds(),
+	}
+
+	if err != nil {
+		e.Error = err.Error()
+	}
+
+	j.m.Lock()
+	defer j.m.Unlock()
+
+	// nothing to do if the reader went away
+	j.enc.Encode(e)
+}
@@ -0,0 +1,146 @@
+package encryptservice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type recordingProgress struct {
+	events []string
+	last   Progress
+	err    error
+}
+
+func (r *recordingProgress) Started(p Progress) {
+	r.events = append(r.events, "started")
+	r.last = p
+}
+
+func (r *recordingProgress) Update(p Progress) {
+	r.last = p
+}
+
+func (r *recordingProgress) Finished(p Progress) {
+	r.events = append(r.events, "finished")
+	r.last = p
+}
+
+func (r *recordingProgress) Failed(p Progress, err error) {
+	r.events = append(r.events, "failed")
+	r.last = p
+	r.err = err
+}
+
+func TestProgressReported(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		sender, receiver := newServicePair(t)
+		sender.SetWorkers(workers)
+		receiver.SetWorkers(workers)
+
+		sent := &recordingProgress{}
+		sender.SetProgressReporter(sent)
+		sender.SetProgressName("a.txt")
+
+		data := make([]byte, 10*CHUNK_SIZE+5)
+		rand.Read(data)
+
+		wire := &bytes.Buffer{}
+		err := sender.Encrypt(bytes.NewReader(data), wire, int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Join(sent.events, ",") != "started,finished" {
+			t.Error("sender reported", sent.events)
+		}
+
+		if sent.last.Name != "a.txt" || sent.last.Done != int64(len(data)) || sent.last.Wire != int64(wire.Len()) {
+			t.Errorf("sender finished with %+v", sent.last)
+		}
+
+		// a stream that ends early fails
+		received := &recordingProgress{}
+		receiver.SetProgressReporter(received)
+		err = receiver.Decrypt(bytes.NewReader(wire.Bytes()[:wire.Len()/2]), &bytes.Buffer{}, int64(len(data)))
+		if err == nil {
+			t.Fatal("truncated stream accepted")
+		}
+
+		if strings.Join(received.events, ",") != "started,failed" || received.err != err {
+			t.Error("receiver reported", received.events, received.err)
+		}
+	}
+}
+
+func TestJsonProgress(t *testing.T) {
+	sender, _ := newServicePair(t)
+
+	out := &bytes.Buffer{}
+	sender.SetProgressReporter(NewJsonProgress(out))
+	sender.SetProgressName("message")
+
+	err := sender.Encrypt(strings.NewReader(TEST_STRING), &bytes.Buffer{}, int64(len(TEST_STRING)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var events []progressEvent
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		e := progressEvent{}
+		err = dec.Decode(&e)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		events = append(events, e)
+	}
+
+	if len(events) != 2 || events[0].Event != "started" || events[1].Event != "finished" {
+		t.Fatalf("got %+v", events)
+	}
+
+	if events[1].Name != "message" || events[1].Done != int64(len(TEST_STRING)) || events[1].Total != int64(len(TEST_STRING)) {
+		t.Errorf("got %+v", events[1])
+	}
+}
+
+func TestTerminalProgress(t *testing.T) {
+	out := &bytes.Buffer{}
+	bar := NewTerminalProgress(out)
+
+	bar.Update(Progress{Total: 100, Done: 50})
+	bar.Finished(Progress{Total: 100, Done: 100})
+
+	if !strings.Contains(out.String(), " 50.00% ") || !strings.HasSuffix(strings.TrimRight(out.String(), " \n"), "in 0:00") {
+		t.Errorf("got %q", out.String())
+	}
+}
+
+func TestProgressStatusLines(t *testing.T) {
+	out := &bytes.Buffer{}
+	bar := NewTerminalProgress(out)
+
+	bar.Update(Progress{Total: 100, Done: 50})
+	Logf(bar, "sha256: %x", []byte{1, 2})
+
+	if !strings.HasSuffix(out.String(), "\r\x1b[Ksha256: 0102\n") {
+		t.Errorf("bar not cleared before the status line: %q", out.String())
+	}
+
+	out.Reset()
+	Logf(NewJsonProgress(out), "receiver connected")
+
+	e := statusEvent{}
+	err := json.Unmarshal(out.Bytes(), &e)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if e.Event != "status" || e.Message != "receiver connected" {
+		t.Errorf("got %+v", e)
+	}
+}
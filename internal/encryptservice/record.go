@@ -0,0 +1,219 @@
+package encryptservice
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Everything sent over the encrypted channel is split into records:
+//
+//	flags (1 byte) | plaintext length (3 bytes, big endian) | sealed data
+//
+// The 4 byte header is part of the additional data of the seal, so a
+// changed length or flag fails to decrypt. Records are sealed with
+// consecutive nonces, so dropped or reordered records fail to decrypt as
+// well. A stream always ends with a record that has RECORD_LAST set, which
+// lets the receiver tell a complete stream from a truncated one. A record with
+// RECORD_REKEY set is the last one sealed with the current key.
+//
+// A side that stops in the middle of a share sends a header with just
+// RECORD_CANCEL and no data before closing the connection, see CancelRecord.
+const RECORD_HEADER_SIZE = 4
+
+const (
+	RECORD_LAST       = 1 << 0 // last record of a stream
+	RECORD_MESSAGE    = 1 << 1 // record holds a message, not file data
+	RECORD_REKEY      = 1 << 2 // next record uses the next key
+	RECORD_COMPRESSED = 1 << 3 // record holds compressed file data
+
+	RECORD_FLAGS = RECORD_LAST | RECORD_MESSAGE | RECORD_REKEY | RECORD_COMPRESSED
+
+	RECORD_CANCEL = 1 << 7 // the peer stopped, never sealed
+)
+
+// CHUNK_SIZE is the default amount of data in a record. Negotiated chunk sizes
+// are multiples of it, so resume offsets stay on chunk boundaries.
+const CHUNK_SIZE = 8192 * 2
+
+const MAX_CHUNK_SIZE = 1024 * 1024
+
+const MAX_MESSAGE_SIZE = 1024 * 1024
+
+// MAX_OVERHEAD is the size of the authentication tag added by the ciphers.
+const MAX_OVERHEAD = 16
+
+// MAX_RECORD_SIZE is the largest record that can appear on the wire.
+const MAX_RECORD_SIZE = RECORD_HEADER_SIZE + max(STREAM_OFFSET_SIZE+MAX_CHUNK_SIZE, MAX_MESSAGE_SIZE) + MAX_OVERHEAD
+
+var ErrMessageTooLarge = fmt.Errorf("message too large")
+var ErrRecordTooLarge = fmt.Errorf("record too large")
+var ErrInvalidChunkSize = fmt.Errorf("chunk size must be a multiple of %d between %d and %d", CHUNK_SIZE, CHUNK_SIZE, MAX_CHUNK_SIZE)
+var ErrUnexpectedRecord = fmt.Errorf("unexpected record")
+var ErrTruncated = fmt.Errorf("stream truncated")
+var ErrPeerCanceled = fmt.Errorf("peer canceled the transfer")
+
+// ErrDecrypt means a record failed authentication, it was changed or sealed
+// with another key
+var ErrDecrypt = fmt.Errorf("failed to decrypt")
+
+func ValidateChunkSize(size int) error {
+	if size < CHUNK_SIZE || size > MAX_CHUNK_SIZE || size%CHUNK_SIZE != 0 {
+		return fmt.Errorf("%w, got %d", ErrInvalidChunkSize, size)
+	}
+
+	return nil
+}
+
+// SetChunkSize changes how much data is put in one record. The receiver has to
+// use the same size, it rejects larger records.
+func (g *GcmService) SetChunkSize(size int) error {
+	err := ValidateChunkSize(size)
+	if err != nil {
+		return err
+	}
+
+	g.chunkSize = size
+	return nil
+}
+
+func (g *GcmService) ChunkSize() int {
+	return g.chunkSize
+}
+
+// writeRecord seals data in place and writes it as one record. data needs
+// room for the overhead of the cipher after its length.
+func (g *GcmService) writeRecord(w io.Writer, flags byte, data []byte) (int, error) {
+	if len(data) >= 1<<24 {
+		return 0, ErrRecordTooLarge
+	}
+
+	if g.needsRekey(len(data)) {
+		flags |= RECORD_REKEY
+	}
+
+	record := make([]byte, RECORD_HEADER_SIZE, RECORD_HEADER_SIZE+len(data)+g.gcm.Overhead())
+	binary.BigEndian.PutUint32(record, uint32(len(data)))
+	record[0] = flags
+
+	rs, err := g.nextRecord(record[:RECORD_HEADER_SIZE], len(data))
+	if err != nil {
+		return 0, err
+	}
+
+	// one write per record, so each record is one websocket message
+	record = append(record, rs.seal(data)...)
+	_, err = w.Write(record)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(record), nil
+}
+
+// readRecord reads and opens the next record. Records holding more than limit
+// bytes are rejected before their data is read. The returned data is only
+// valid until the next call. Rekeying is handled here, RECORD_REKEY is never
+// returned.
+func (g *GcmService) readRecord(r io.Reader, limit int) (byte, []byte, error) {
+	header, size, err := g.readHeader(r, limit)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	flags := header[0]
+	if cap(g.recordBuf) < size+g.gcm.Overhead() {
+		g.recordBuf = make([]byte, size+g.gcm.Overhead())
+	}
+
+	data := g.recordBuf[:size+g.gcm.Overhead()]
+	_, err = io.ReadFull(r, data)
+	if errors.Is(err, io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+
+	if err != nil {
+		return 0, nil, err
+	}
+
+	rs, err := g.nextRecord(header, size)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	plaintext, err := rs.open(data)
+	if err != nil {
+		return 0, nil, fmt.Errorf("%w: %w", ErrDecrypt, err)
+	}
+
+	return flags &^ RECORD_REKEY, plaintext, nil
+}
+
+// readHeader reads the header of the next record and checks that a record of
+// its size can be opened.
+func (g *GcmService) readHeader(r io.Reader, limit int) ([]byte, int, error) {
+	header := make([]byte, RECORD_HEADER_SIZE)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	flags := header[0]
+	if flags == RECORD_CANCEL && binary.BigEndian.Uint32(header)&0xffffff == 0 {
+		return nil, 0, ErrPeerCanceled
+	}
+
+	if flags&^RECORD_FLAGS != 0 {
+		return nil, 0, fmt.Errorf("%w: unknown flags %#x", ErrUnexpectedRecord, flags)
+	}
+
+	size := int(binary.BigEndian.Uint32(header) & 0xffffff)
+	if size > limit {
+		return nil, 0, fmt.Errorf("%w: %d bytes, at most %d expected", ErrRecordTooLarge, size, limit)
+	}
+
+	err = g.checkUsage()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return header, size, nil
+}
+
+// CancelRecord is written instead of the next record when the share is
+// canceled, just before the connection is closed. The peer then reads
+// ErrPeerCanceled instead of a closed connection. Like a websocket close
+// frame it isn't authenticated, anybody who can close the connection could
+// send it as well.
+func CancelRecord() []byte {
+	return []byte{RECORD_CANCEL, 0, 0, 0}
+}
+
+// WriteMessage encrypts a small message, like the transfer manifest, and
+// writes it to w as a single record.
+func (g *GcmService) WriteMessage(w io.Writer, message []byte) error {
+	if len(message) > MAX_MESSAGE_SIZE {
+		return ErrMessageTooLarge
+	}
+
+	data := make([]byte, len(message), len(message)+g.gcm.Overhead())
+	copy(data, message)
+
+	_, err := g.writeRecord(w, RECORD_MESSAGE|RECORD_LAST, data)
+	return err
+}
+
+// ReadMessage reads and decrypts a message written by WriteMessage.
+func (g *GcmService) ReadMessage(r io.Reader) ([]byte, error) {
+	flags, data, err := g.readRecord(r, MAX_MESSAGE_SIZE)
+	if err != nil {
+		return nil, err
+	}
+
+	if flags != RECORD_MESSAGE|RECORD_LAST {
+		return nil, fmt.Errorf("%w: expected a message", ErrUnexpectedRecord)
+	}
+
+	return append([]byte(nil), data...), nil
+}
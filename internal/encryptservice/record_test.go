@@ -0,0 +1,361 @@
+package encryptservice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+	"testing/iotest"
+)
+
+func newServicePair(t testing.TB) (*GcmService, *GcmService) {
+	offered, chosen, err := runHandshake(t, DefaultSuites(), DefaultSuites(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := chosen.NewService(TEST_DISCOVER_PHRASE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := offered.NewService(TEST_DISCOVER_PHRASE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sender, receiver
+}
+
+// records splits an encrypted stream into its records.
+func records(t *testing.T, data []byte) [][]byte {
+	var result [][]byte
+	for len(data) > 0 {
+		size := RECORD_HEADER_SIZE + int(data[1])<<16 + int(data[2])<<8 + int(data[3]) + MAX_OVERHEAD
+		if size > len(data) {
+			t.Fatal("incomplete record")
+		}
+
+		result = append(result, data[:size])
+		data = data[size:]
+	}
+
+	return result
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 1, CHUNK_SIZE, CHUNK_SIZE + 1, 5*CHUNK_SIZE - 3} {
+		sender, receiver := newServicePair(t)
+
+		data := make([]byte, size)
+		rand.Read(data)
+
+		wire := &bytes.Buffer{}
+		err := sender.Encrypt(bytes.NewReader(data), wire, int64(size))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = sender.WriteMessage(wire, []byte(TEST_STRING))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := &bytes.Buffer{}
+		err = receiver.Decrypt(wire, out, int64(size))
+		if err != nil {
+			t.Fatal(size, err)
+		}
+
+		if !bytes.Equal(out.Bytes(), data) {
+			t.Error("data differs for size", size)
+		}
+
+		msg, err := receiver.ReadMessage(wire)
+		if err != nil || string(msg) != TEST_STRING {
+			t.Error("message after stream not received", err)
+		}
+	}
+}
+
+func TestUnknownSizeRoundTrip(t *testing.T) {
+	for _, workers := range []int{1, 4} {
+		for _, size := range []int{0, 1, CHUNK_SIZE, 5*CHUNK_SIZE - 3} {
+			sender, receiver := newServicePair(t)
+			sender.SetWorkers(workers)
+			receiver.SetWorkers(workers)
+
+			data := make([]byte, size)
+			rand.Read(data)
+
+			// a pipe hands out data in small pieces
+			wire := &bytes.Buffer{}
+			err := sender.Encrypt(iotest.HalfReader(bytes.NewReader(data)), wire, UNKNOWN_SIZE)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = sender.WriteMessage(wire, []byte(TEST_STRING))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out := &bytes.Buffer{}
+			err = receiver.Decrypt(wire, out, UNKNOWN_SIZE)
+			if err != nil {
+				t.Fatal(size, err)
+			}
+
+			if !bytes.Equal(out.Bytes(), data) {
+				t.Error("data differs for size", size)
+			}
+
+			msg, err := receiver.ReadMessage(wire)
+			if err != nil || string(msg) != TEST_STRING {
+				t.Error("message after stream not received", err)
+			}
+		}
+	}
+}
+
+func TestUnknownSizeNeedsLastRecord(t *testing.T) {
+	sender, _ := newServicePair(t)
+
+	wire := &bytes.Buffer{}
+	err := sender.Encrypt(bytes.NewReader(make([]byte, 2*CHUNK_SIZE)), wire, UNKNOWN_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two full chunks, and the empty one that ends the stream
+	recs := records(t, wire.Bytes())
+	if len(recs) != 3 {
+		t.Fatal("expected 3 records, got", len(recs))
+	}
+
+	for name, truncated := range map[string][][]byte{
+		"missing last": recs[:2],
+		"flags":        {recs[0], flipLast(recs[1])},
+	} {
+		receiver := replayReceiver(t, sender)
+		err = receiver.Decrypt(bytes.NewReader(bytes.Join(truncated, nil)), &bytes.Buffer{}, UNKNOWN_SIZE)
+		if err == nil {
+			t.Errorf("%s: stream accepted", name)
+		}
+	}
+}
+
+func TestCancelRecord(t *testing.T) {
+	sender, _ := newServicePair(t)
+
+	wire := &bytes.Buffer{}
+	err := sender.Encrypt(bytes.NewReader(make([]byte, 2*CHUNK_SIZE)), wire, UNKNOWN_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recs := records(t, wire.Bytes())
+	canceled := append(bytes.Join(recs[:1], nil), CancelRecord()...)
+
+	receiver := replayReceiver(t, sender)
+	err = receiver.Decrypt(bytes.NewReader(canceled), &bytes.Buffer{}, UNKNOWN_SIZE)
+	if !errors.Is(err, ErrPeerCanceled) {
+		t.Errorf("expected ErrPeerCanceled, got %v", err)
+	}
+
+	// only without data, anything else is a broken record
+	receiver = replayReceiver(t, sender)
+	_, err = receiver.ReadMessage(bytes.NewReader([]byte{RECORD_CANCEL, 0, 0, 1, 0}))
+	if err == nil || errors.Is(err, ErrPeerCanceled) {
+		t.Errorf("expected a broken record, got %v", err)
+	}
+}
+
+func TestStreamTampering(t *testing.T) {
+	sender, _ := newServicePair(t)
+
+	wire := &bytes.Buffer{}
+	err := sender.SetChunkSize(2 * CHUNK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = sender.Encrypt(bytes.NewReader(make([]byte, 5*CHUNK_SIZE)), wire, 5*CHUNK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recs := records(t, wire.Bytes())
+	if len(recs) != 3 {
+		t.Fatal("expected 3 records, got", len(recs))
+	}
+
+	tests := map[string]struct {
+		records   [][]byte
+		chunkSize int
+		want      error
+	}{
+		"truncated":  {records: recs[:2], chunkSize: 2 * CHUNK_SIZE, want: ErrTruncated},
+		"reordered":  {records: [][]byte{recs[1], recs[0], recs[2]}, chunkSize: 2 * CHUNK_SIZE},
+		"oversized":  {records: recs, chunkSize: CHUNK_SIZE, want: ErrRecordTooLarge},
+		"flags":      {records: [][]byte{recs[0], flipLast(recs[1])}, chunkSize: 2 * CHUNK_SIZE},
+		"duplicated": {records: [][]byte{recs[0], recs[0], recs[1], recs[2]}, chunkSize: 2 * CHUNK_SIZE},
+	}
+
+	for name, test := range tests {
+		receiver := replayReceiver(t, sender)
+		err := receiver.SetChunkSize(test.chunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = receiver.Decrypt(bytes.NewReader(bytes.Join(test.records, nil)), &bytes.Buffer{}, 5*CHUNK_SIZE)
+		if err == nil {
+			t.Errorf("%s: tampered stream accepted", name)
+			continue
+		}
+
+		if test.want != nil && !errors.Is(err, test.want) {
+			t.Errorf("%s: expected %v, got %v", name, test.want, err)
+		}
+	}
+}
+
+func flipLast(record []byte) []byte {
+	flipped := append([]byte(nil), record...)
+	flipped[0] ^= RECORD_LAST
+	return flipped
+}
+
+// replayReceiver returns a service that can open what sender sealed from the
+// start.
+func replayReceiver(t *testing.T, sender *GcmService) *GcmService {
+	receiver := *sender
+	receiver.nonce = make([]byte, len(sender.nonce))
+	receiver.recordBuf = nil
+	receiver.records = 0
+	receiver.bytes = 0
+	return &receiver
+}
+
+func TestMessageIsNotData(t *testing.T) {
+	sender, receiver := newServicePair(t)
+
+	wire := &bytes.Buffer{}
+	err := sender.WriteMessage(wire, []byte(TEST_STRING))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = receiver.Decrypt(wire, &bytes.Buffer{}, int64(len(TEST_STRING)))
+	if !errors.Is(err, ErrUnexpectedRecord) {
+		t.Error("message accepted as file data:", err)
+	}
+}
+
+func TestInvalidChunkSize(t *testing.T) {
+	for _, size := range []int{0, CHUNK_SIZE - 1, CHUNK_SIZE + 1, 2 * MAX_CHUNK_SIZE} {
+		if ValidateChunkSize(size) == nil {
+			t.Error("accepted chunk size", size)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	sender, receiver := newServicePair(t)
+	sender.rekeyRecords = 3
+	receiver.rekeyRecords = 3
+	firstKey := sender.key
+
+	data := make([]byte, 10*CHUNK_SIZE)
+	rand.Read(data)
+
+	wire := &bytes.Buffer{}
+	err := sender.Encrypt(bytes.NewReader(data), wire, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rekeys := 0
+	for _, record := range records(t, wire.Bytes()) {
+		if record[0]&RECORD_REKEY != 0 {
+			rekeys++
+		}
+	}
+
+	if rekeys != 3 {
+		t.Errorf("expected 3 rekeys, got %d", rekeys)
+	}
+
+	out := &bytes.Buffer{}
+	err = receiver.Decrypt(wire, out, int64(len(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Error("data differs after rekeying")
+	}
+
+	// replies are sealed with the new key as well
+	err = receiver.WriteMessage(wire, []byte(TEST_STRING))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := sender.ReadMessage(wire)
+	if err != nil || string(msg) != TEST_STRING {
+		t.Error("reply after rekeying not received", err)
+	}
+
+	if bytes.Equal(sender.key, firstKey) || !bytes.Equal(sender.key, receiver.key) {
+		t.Error("peers did not switch to the same new key")
+	}
+}
+
+func TestRekeyFlagIsAuthenticated(t *testing.T) {
+	sender, receiver := newServicePair(t)
+	sender.rekeyRecords = 1
+
+	wire := &bytes.Buffer{}
+	err := sender.Encrypt(bytes.NewReader(make([]byte, 2*CHUNK_SIZE)), wire, 2*CHUNK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recs := records(t, wire.Bytes())
+	recs[1][0] &^= RECORD_REKEY
+
+	err = receiver.Decrypt(bytes.NewReader(bytes.Join(recs, nil)), &bytes.Buffer{}, 2*CHUNK_SIZE)
+	if err == nil {
+		t.Error("stream with a removed rekey flag accepted")
+	}
+}
+
+func TestMissedRekey(t *testing.T) {
+	sender, receiver := newServicePair(t)
+	receiver.rekeyRecords = 2
+
+	wire := &bytes.Buffer{}
+	err := sender.Encrypt(bytes.NewReader(make([]byte, 5*CHUNK_SIZE)), wire, 5*CHUNK_SIZE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = receiver.Decrypt(wire, &bytes.Buffer{}, 5*CHUNK_SIZE)
+	if !errors.Is(err, ErrMissedRekey) {
+		t.Error("expected ErrMissedRekey, got", err)
+	}
+}
+
+func TestNonceExhausted(t *testing.T) {
+	sender, _ := newServicePair(t)
+	for i := range sender.nonce {
+		sender.nonce[i] = 255
+	}
+
+	err := sender.WriteMessage(&bytes.Buffer{}, []byte(TEST_STRING))
+	if !errors.Is(err, ErrNonceExhausted) {
+		t.Error("expected ErrNonceExhausted, got", err)
+	}
+}
@@ -0,0 +1,55 @@
+package encryptservice
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// A key is replaced after REKEY_RECORDS records or REKEY_BYTES bytes, whichever
+// comes first. That keeps every key far below the usage limits of AES-GCM, so
+// transfers of any size are safe.
+const REKEY_RECORDS = 1 << 24
+const REKEY_BYTES = 1 << 34
+
+const REKEY_INFO = "fastshare rekey"
+
+var ErrMissedRekey = fmt.Errorf("peer did not rekey in time")
+
+// needsRekey is checked before sealing a record of size bytes. If the record
+// uses up the key it is sent with RECORD_REKEY set and both peers switch to the
+// next key after it.
+func (g *GcmService) needsRekey(size int) bool {
+	return g.records+1 >= g.rekeyRecords || g.bytes+int64(size) >= g.rekeyBytes
+}
+
+// checkUsage is called before opening a record. The peer rekeys when its
+// limits are reached, a peer that keeps using a key far beyond them is
+// rejected.
+func (g *GcmService) checkUsage() error {
+	if g.records >= 2*g.rekeyRecords || g.bytes >= 2*g.rekeyBytes {
+		return ErrMissedRekey
+	}
+
+	return nil
+}
+
+func (g *GcmService) countRecord(size int) {
+	g.records++
+	g.bytes += int64(size)
+}
+
+// rekey replaces the key with the next one of a hkdf ratchet. The old key can't
+// be derived from the new one.
+func (g *GcmService) rekey() error {
+	kdf := hkdf.New(sha512.New, g.key, nil, []byte(REKEY_INFO))
+	key := make([]byte, len(g.key))
+	_, err := io.ReadFull(kdf, key)
+	if err != nil {
+		return err
+	}
+
+	return g.setKey(key)
+}
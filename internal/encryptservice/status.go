@@ -0,0 +1,48 @@
+package encryptservice
+
+import (
+	"fmt"
+	"io"
+)
+
+// Status is told what a share is doing, apart from the progress of file data.
+// The zero value drops everything.
+type Status struct {
+	// Log gets status lines, like "receiver connected"
+	Log io.Writer
+	// Verification is called with the cipher suite and the verification code
+	// once both sides agreed on a key
+	Verification func(suite string, code string)
+	// PeerFound is called with the address of the peer found on the local
+	// network
+	PeerFound func(addr string)
+}
+
+// Logf writes a status line to Log, if there is one.
+func (s Status) Logf(format string, args ...any) {
+	Logf(s.Log, format, args...)
+}
+
+// Logf writes a status line to w, nil drops it.
+func Logf(w io.Writer, format string, args ...any) {
+	if w == nil {
+		return
+	}
+
+	fmt.Fprintf(w, format+"\n", args...)
+}
+
+// SetStatus sets what the service tells about the share besides progress.
+func (g *GcmService) SetStatus(status Status) {
+	g.status = status
+}
+
+// Status is what was set with SetStatus.
+func (g *GcmService) Status() Status {
+	return g.status
+}
+
+// Logf writes a status line, see Status.Log.
+func (g *GcmService) Logf(format string, args ...any) {
+	g.status.Logf(format, args...)
+}
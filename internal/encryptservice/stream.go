@@ -0,0 +1,123 @@
+package encryptservice
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Large files can be striped across several extra connections, called streams.
+// Every stream has its own key derived from the session secret, so each has
+// its own nonces. A file is sent over a stream as records holding
+//
+//	offset (8 bytes, big endian) | data
+//
+// and ends with an empty record with RECORD_LAST set.
+const STREAM_OFFSET_SIZE = 8
+
+const STREAM_INFO = "fastshare stream"
+
+// Stream returns the encryption for the i-th stream of the session.
+func (g *GcmService) Stream(i int) (*GcmService, error) {
+	secret := make([]byte, 32)
+	kdf := hkdf.New(sha512.New, g.streamSecret, nil, []byte(fmt.Sprintf("%s %d", STREAM_INFO, i)))
+	_, err := io.ReadFull(kdf, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	s, err := NewGcmServiceFromSecret(secret, g.discoverPhrase, g.suite)
+	if err != nil {
+		return nil, err
+	}
+
+	// every stream seals its records on its own goroutine
+	s.chunkSize = g.chunkSize
+	s.workers = 1
+	s.compression = g.compression
+	s.codec = g.codec
+	s.rekeyRecords = g.rekeyRecords
+	s.rekeyBytes = g.rekeyBytes
+
+	return s, nil
+}
+
+// WriteChunk sends the data of a file at offset as one record.
+func (g *GcmService) WriteChunk(w io.Writer, offset int64, data []byte) error {
+	if len(data) == 0 || len(data) > g.chunkSize {
+		return fmt.Errorf("%w: chunk of %d bytes", ErrRecordTooLarge, len(data))
+	}
+
+	data, compressed := g.compressChunk(data)
+	record := make([]byte, STREAM_OFFSET_SIZE+len(data), STREAM_OFFSET_SIZE+len(data)+g.gcm.Overhead())
+	binary.BigEndian.PutUint64(record, uint64(offset))
+	copy(record[STREAM_OFFSET_SIZE:], data)
+
+	_, err := g.writeRecord(w, compressed, record)
+	return err
+}
+
+// EndChunks tells the receiver that no more chunks of the file follow on this
+// stream.
+func (g *GcmService) EndChunks(w io.Writer) error {
+	g.startFile()
+	_, err := g.writeRecord(w, RECORD_LAST, nil)
+	return err
+}
+
+// ReadChunk returns the next chunk and its offset, or io.EOF once the sender
+// called EndChunks. The data is only valid until the next call.
+func (g *GcmService) ReadChunk(r io.Reader) (int64, []byte, error) {
+	flags, data, err := g.readRecord(r, STREAM_OFFSET_SIZE+g.chunkSize)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if flags == RECORD_LAST && len(data) == 0 {
+		return 0, nil, io.EOF
+	}
+
+	if flags&^RECORD_COMPRESSED != 0 || len(data) <= STREAM_OFFSET_SIZE {
+		return 0, nil, fmt.Errorf("%w: expected a chunk", ErrUnexpectedRecord)
+	}
+
+	offset := int64(binary.BigEndian.Uint64(data))
+	if offset < 0 {
+		return 0, nil, fmt.Errorf("%w: negative offset", ErrUnexpectedRecord)
+	}
+
+	chunk, err := g.decompressChunk(flags, data[STREAM_OFFSET_SIZE:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return offset, chunk, nil
+}
+
+// StreamProgress reports the progress of a file striped across streams, it can
+// be used from all of them at once.
+type StreamProgress struct {
+	progress *progress
+}
+
+// NewStreamProgress starts reporting a striped file of total bytes, named like
+// the next Encrypt or Decrypt would be.
+func (g *GcmService) NewStreamProgress(total int64) *StreamProgress {
+	return &StreamProgress{progress: g.newProgress(total)}
+}
+
+// Add counts a chunk of n bytes sent or received.
+func (p *StreamProgress) Add(n int) {
+	p.progress.add(n, RECORD_HEADER_SIZE+STREAM_OFFSET_SIZE+n+MAX_OVERHEAD)
+}
+
+func (p *StreamProgress) Finish() {
+	p.progress.finish()
+}
+
+func (p *StreamProgress) Fail(err error) {
+	p.progress.fail(err)
+}
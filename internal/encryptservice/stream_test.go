@@ -0,0 +1,77 @@
+package encryptservice
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestStreamChunks(t *testing.T) {
+	sender, receiver := newServicePair(t)
+
+	s0, err := sender.Stream(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r0, err := receiver.Stream(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wire := &bytes.Buffer{}
+	err = s0.WriteChunk(wire, 5*CHUNK_SIZE, []byte(TEST_STRING))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s0.EndChunks(wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset, data, err := r0.ReadChunk(wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if offset != 5*CHUNK_SIZE || string(data) != TEST_STRING {
+		t.Errorf("got %q at %d", data, offset)
+	}
+
+	_, _, err = r0.ReadChunk(wire)
+	if err != io.EOF {
+		t.Error("expected io.EOF after EndChunks, got", err)
+	}
+
+	err = s0.WriteChunk(wire, 0, make([]byte, CHUNK_SIZE+1))
+	if !errors.Is(err, ErrRecordTooLarge) {
+		t.Error("expected ErrRecordTooLarge, got", err)
+	}
+}
+
+func TestStreamsHaveOwnKeys(t *testing.T) {
+	sender, receiver := newServicePair(t)
+
+	s0, _ := sender.Stream(0)
+	r1, _ := receiver.Stream(1)
+
+	wire := &bytes.Buffer{}
+	err := s0.WriteChunk(wire, 0, []byte(TEST_STRING))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = r1.ReadChunk(wire)
+	if err == nil {
+		t.Error("chunk of stream 0 opened on stream 1")
+	}
+
+	// neither can the main channel open it
+	s0.WriteChunk(wire, 0, []byte(TEST_STRING))
+	_, err = receiver.ReadMessage(wire)
+	if err == nil {
+		t.Error("chunk of stream 0 opened as a message")
+	}
+}
@@ -0,0 +1,170 @@
+package encryptservice
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"fmt"
+	"runtime"
+	"slices"
+	"strings"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// Ciphers used for the records. All of them take a 32 byte key.
+const CIPHER_AES_256_GCM = "aes-256-gcm"
+const CIPHER_CHACHA20_POLY1305 = "chacha20-poly1305"
+const CIPHER_XCHACHA20_POLY1305 = "xchacha20-poly1305"
+
+// Curves for the key exchange. The share code is always checked with SPAKE2
+// on P-256, CURVE_P256_X25519 adds an X25519 exchange next to it whose secret
+// is mixed into the key. Neither runs SPAKE2 on X25519.
+const CURVE_P256 = "p256"
+const CURVE_P256_X25519 = "p256+x25519"
+
+var ErrUnknownCipher = fmt.Errorf("unknown cipher")
+var ErrUnknownCurve = fmt.Errorf("unknown curve")
+var ErrNoCommonSuite = fmt.Errorf("no cipher suite supported by both peers")
+
+var ciphers = map[string]func(key []byte) (cipher.AEAD, error){
+	CIPHER_AES_256_GCM: func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		return cipher.NewGCM(block)
+	},
+	CIPHER_CHACHA20_POLY1305:  chacha20poly1305.New,
+	CIPHER_XCHACHA20_POLY1305: chacha20poly1305.NewX,
+}
+
+var cipherNames = map[string]string{
+	CIPHER_AES_256_GCM:        "AES-256-GCM",
+	CIPHER_CHACHA20_POLY1305:  "ChaCha20-Poly1305",
+	CIPHER_XCHACHA20_POLY1305: "XChaCha20-Poly1305",
+}
+
+var curveNames = map[string]string{
+	CURVE_P256:        "SPAKE2 P-256",
+	CURVE_P256_X25519: "SPAKE2 P-256 + X25519",
+}
+
+// Suites lists the ciphers and curves a peer supports, the ones it prefers
+// first.
+type Suites struct {
+	Ciphers []string
+	Curves  []string
+}
+
+// Suite is what both peers use for a session.
+type Suite struct {
+	Cipher string
+	Curve  string
+}
+
+// kdfNames are used instead of a curve when the key is derived from the share
+// code, see password.go
+var kdfNames = map[string]string{
+	KDF_ARGON2ID: "Argon2id",
+}
+
+func (s Suite) String() string {
+	name, ok := curveNames[s.Curve]
+	if !ok {
+		name = kdfNames[s.Curve]
+	}
+
+	return name + ", " + cipherNames[s.Cipher]
+}
+
+// hasAESHardware reports whether AES-GCM is fast on this machine. Without it
+// ChaCha20-Poly1305 is a lot faster.
+func hasAESHardware() bool {
+	switch runtime.GOARCH {
+	case "amd64", "386":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasGHASH
+	case "ppc64", "ppc64le":
+		return true
+	}
+
+	return false
+}
+
+// DefaultSuites supports everything, preferring AES-GCM only if the machine
+// has hardware support for it.
+func DefaultSuites() Suites {
+	suites := Suites{
+		Ciphers: []string{CIPHER_CHACHA20_POLY1305, CIPHER_XCHACHA20_POLY1305, CIPHER_AES_256_GCM},
+		Curves:  []string{CURVE_P256, CURVE_P256_X25519},
+	}
+
+	if hasAESHardware() {
+		suites.Ciphers = []string{CIPHER_AES_256_GCM, CIPHER_CHACHA20_POLY1305, CIPHER_XCHACHA20_POLY1305}
+	}
+
+	return suites
+}
+
+// NewSuites restricts the default suites to cipher and curve, if they are set.
+func NewSuites(cipher, curve string) (Suites, error) {
+	suites := DefaultSuites()
+
+	if cipher != "" {
+		if _, ok := ciphers[cipher]; !ok {
+			return suites, fmt.Errorf("%w %q, use one of %s", ErrUnknownCipher, cipher, strings.Join(suites.Ciphers, ", "))
+		}
+
+		suites.Ciphers = []string{cipher}
+	}
+
+	if curve != "" {
+		if _, ok := curveNames[curve]; !ok {
+			return suites, fmt.Errorf("%w %q, use one of %s", ErrUnknownCurve, curve, strings.Join(suites.Curves, ", "))
+		}
+
+		suites.Curves = []string{curve}
+	}
+
+	return suites, nil
+}
+
+// ChooseSuite picks the cipher and curve that both peers support and that are
+// preferred most by both of them together. Ties go to own.
+func ChooseSuite(offer, own Suites) (Suite, error) {
+	cipher := choose(offer.Ciphers, own.Ciphers, ciphers)
+	curve := choose(offer.Curves, own.Curves, curveNames)
+	if cipher == "" || curve == "" {
+		return Suite{}, ErrNoCommonSuite
+	}
+
+	return Suite{Cipher: cipher, Curve: curve}, nil
+}
+
+func choose[V any](offer, own []string, known map[string]V) string {
+	best := ""
+	bestRank := -1
+	for ownRank, name := range own {
+		offerRank := slices.Index(offer, name)
+		if _, ok := known[name]; !ok || offerRank < 0 {
+			continue
+		}
+
+		if bestRank < 0 || ownRank+offerRank < bestRank {
+			best = name
+			bestRank = ownRank + offerRank
+		}
+	}
+
+	return best
+}
+
+// supports checks that the suite chosen by the peer was offered.
+func (s Suites) supports(suite Suite) bool {
+	return slices.Contains(s.Ciphers, suite.Cipher) && slices.Contains(s.Curves, suite.Curve)
+}
@@ -0,0 +1,111 @@
+package relay
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/int32-dev/fastshare/internal/ws"
+)
+
+// The session API lets dashboards and scripts see what the relay is doing.
+// Every request needs the admin token as "Authorization: Bearer <token>".
+//
+//	POST   /api/sessions        creates a session a sender claims with its
+//	                            pair code, see ws.ClaimQuery
+//	GET    /api/sessions        lists the sessions that aren't closed
+//	GET    /api/sessions/{code} returns one session
+//	DELETE /api/sessions/{code} cancels the session, closing its connections
+//
+// Sessions are answered as the json of Session, errors as ws.ErrorMessage.
+
+// sessionsResponse answers GET /api/sessions.
+type sessionsResponse struct {
+	Sessions []*Session
+}
+
+// admin only calls next for requests with the admin token. Wrong tokens are
+// counted by the Limiter like unknown pair codes.
+func (s *Server) admin(next func(w http.ResponseWriter, r *http.Request) error) func(w http.ResponseWriter, r *http.Request) error {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		addr := s.clientAddr(r)
+		err := s.allow(w, addr)
+		if err != nil {
+			return err
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && subtle.ConstantTimeCompare([]byte(token), []byte(s.AdminToken)) == 1 {
+			return next(w, r)
+		}
+
+		if s.Limiter != nil {
+			wait := s.Limiter.Fail(addr)
+			if wait > 0 {
+				tooManyFailures(w, wait)
+				return fmt.Errorf("%s locked out after too many wrong admin tokens", addr)
+			}
+		}
+
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		apiError(w, "missing or wrong admin token", http.StatusUnauthorized)
+		return fmt.Errorf("%s used a wrong admin token", addr)
+	}
+}
+
+func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) error {
+	session, err := s.registry.Create()
+	if err != nil {
+		apiError(w, "error creating session", http.StatusInternalServerError)
+		return err
+	}
+
+	return writeJson(w, http.StatusCreated, session)
+}
+
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) error {
+	sessions, err := s.registry.Active()
+	if err != nil {
+		apiError(w, "error reading sessions", http.StatusInternalServerError)
+		return err
+	}
+
+	return writeJson(w, http.StatusOK, &sessionsResponse{Sessions: sessions})
+}
+
+func (s *Server) handleGetSession(w http.ResponseWriter, r *http.Request) error {
+	session, err := s.registry.Get(r.PathValue("code"))
+	return s.answerSession(w, session, err)
+}
+
+func (s *Server) handleCancelSession(w http.ResponseWriter, r *http.Request) error {
+	session, err := s.registry.Cancel(r.PathValue("code"))
+	return s.answerSession(w, session, err)
+}
+
+func (s *Server) answerSession(w http.ResponseWriter, session *Session, err error) error {
+	if errors.Is(err, ErrSessionNotFound) {
+		apiError(w, err.Error(), http.StatusNotFound)
+		return nil
+	}
+
+	if err != nil {
+		apiError(w, "error reading session", http.StatusInternalServerError)
+		return err
+	}
+
+	return writeJson(w, http.StatusOK, session)
+}
+
+func apiError(w http.ResponseWriter, message string, status int) {
+	writeJson(w, status, &ws.ErrorMessage{Error: message})
+}
+
+func writeJson(w http.ResponseWriter, status int, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	return json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,103 @@
+package relay
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// DEFAULT_MAX_FAILURES is how many unknown pair codes a client may look up
+	// within DEFAULT_FAILURE_WINDOW before it's locked out.
+	DEFAULT_MAX_FAILURES   = 10
+	DEFAULT_FAILURE_WINDOW = time.Minute
+	DEFAULT_LOCKOUT        = time.Minute * 15
+)
+
+// Limiter locks out clients that look up too many pair codes that don't
+// exist, so scanning for live sessions takes longer than they live.
+type Limiter struct {
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+
+	m       sync.Mutex
+	clients map[string]*client
+}
+
+type client struct {
+	// failures are the times of the failed lookups within the window
+	failures    []time.Time
+	lockedUntil time.Time
+}
+
+// NewLimiter locks a client out for lockout once it failed maxFailures times
+// within window.
+func NewLimiter(maxFailures int, window, lockout time.Duration) *Limiter {
+	return &Limiter{
+		maxFailures: maxFailures,
+		window:      window,
+		lockout:     lockout,
+		clients:     make(map[string]*client),
+	}
+}
+
+// Allow returns how long addr is still locked out, 0 if it isn't.
+func (l *Limiter) Allow(addr string) time.Duration {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	c, ok := l.clients[addr]
+	if !ok {
+		return 0
+	}
+
+	return max(time.Until(c.lockedUntil), 0)
+}
+
+// Fail records a failed lookup of addr, and returns how long it is locked out
+// because of it.
+func (l *Limiter) Fail(addr string) time.Duration {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	c, ok := l.clients[addr]
+	if !ok {
+		c = &client{}
+		l.clients[addr] = c
+	}
+
+	now := time.Now()
+	c.failures = append(recent(c.failures, now.Add(-l.window)), now)
+
+	if len(c.failures) >= l.maxFailures {
+		c.lockedUntil = now.Add(l.lockout)
+		c.failures = nil
+	}
+
+	return max(c.lockedUntil.Sub(now), 0)
+}
+
+// Forget drops the clients that are neither locked out nor failed within the
+// window.
+func (l *Limiter) Forget() {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := time.Now()
+	for addr, c := range l.clients {
+		c.failures = recent(c.failures, now.Add(-l.window))
+		if len(c.failures) == 0 && !now.Before(c.lockedUntil) {
+			delete(l.clients, addr)
+		}
+	}
+}
+
+// recent drops the times before since, they are in order.
+func recent(times []time.Time, since time.Time) []time.Time {
+	i := 0
+	for i < len(times) && times[i].Before(since) {
+		i++
+	}
+
+	return times[i:]
+}
@@ -0,0 +1,58 @@
+package relay
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	const LOCKOUT = time.Millisecond * 100
+	limiter := NewLimiter(3, time.Minute, LOCKOUT)
+
+	for i := 0; i < 2; i++ {
+		if wait := limiter.Fail("10.0.0.1"); wait != 0 {
+			t.Fatalf("locked out after %d failures", i+1)
+		}
+	}
+
+	if wait := limiter.Fail("10.0.0.2"); wait != 0 {
+		t.Fatal("failures of another address counted")
+	}
+
+	if wait := limiter.Fail("10.0.0.1"); wait <= 0 || wait > LOCKOUT {
+		t.Fatalf("expected lockout after 3 failures, got %s", wait)
+	}
+
+	if wait := limiter.Allow("10.0.0.1"); wait <= 0 {
+		t.Fatal("locked out address allowed")
+	}
+
+	if wait := limiter.Allow("10.0.0.2"); wait != 0 {
+		t.Fatalf("other address locked out for %s", wait)
+	}
+
+	time.Sleep(LOCKOUT)
+
+	if wait := limiter.Allow("10.0.0.1"); wait != 0 {
+		t.Fatalf("still locked out for %s after the lockout", wait)
+	}
+
+	// the failures were reset by the lockout
+	if wait := limiter.Fail("10.0.0.1"); wait != 0 {
+		t.Fatal("locked out again after one failure")
+	}
+
+	limiter.Forget()
+	if len(limiter.clients) != 2 {
+		t.Fatalf("expected clients with recent failures to be kept, got %d", len(limiter.clients))
+	}
+
+	expiring := NewLimiter(3, time.Millisecond, time.Millisecond)
+	expiring.Fail("10.0.0.1")
+	time.Sleep(time.Millisecond * 5)
+	expiring.Forget()
+
+	if len(expiring.clients) != 0 {
+		t.Fatalf("expected old failures to be forgotten, got %d clients", len(expiring.clients))
+	}
+}
@@ -0,0 +1,117 @@
+package relay
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// DEFAULT_PAIR_CODE_ALPHABET leaves out characters that are easy to mix up,
+// like 0 and o or 1 and l.
+const DEFAULT_PAIR_CODE_ALPHABET = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// DEFAULT_PAIR_CODE_LENGTH gives about 10^12 codes with the default alphabet.
+const DEFAULT_PAIR_CODE_LENGTH = 8
+
+const (
+	MIN_PAIR_CODE_LENGTH = 4
+	MAX_PAIR_CODE_LENGTH = 32
+)
+
+var ErrInvalidPairCode = fmt.Errorf("invalid pair code")
+
+// PairCodes makes the pair codes the relay hands out to senders.
+type PairCodes struct {
+	length   int
+	alphabet []rune
+	max      *big.Int
+}
+
+// NewPairCodes makes codes of length characters from alphabet. The alphabet
+// can only have letters and digits, so it never contains the separator the
+// clients put between share code and pair code.
+func NewPairCodes(length int, alphabet string) (*PairCodes, error) {
+	if length < MIN_PAIR_CODE_LENGTH || length > MAX_PAIR_CODE_LENGTH {
+		return nil, fmt.Errorf("pair code length must be between %d and %d", MIN_PAIR_CODE_LENGTH, MAX_PAIR_CODE_LENGTH)
+	}
+
+	seen := make(map[rune]bool)
+	for _, c := range alphabet {
+		if !isAlphanumeric(c) {
+			return nil, fmt.Errorf("pair code alphabet can only have letters and digits, got %q", c)
+		}
+
+		if seen[c] {
+			return nil, fmt.Errorf("pair code alphabet has %q twice", c)
+		}
+
+		seen[c] = true
+	}
+
+	if len(seen) < 2 {
+		return nil, fmt.Errorf("pair code alphabet needs at least 2 characters")
+	}
+
+	runes := []rune(alphabet)
+	return &PairCodes{
+		length:   length,
+		alphabet: runes,
+		max:      big.NewInt(int64(len(runes))),
+	}, nil
+}
+
+// DefaultPairCodes are DEFAULT_PAIR_CODE_LENGTH characters from
+// DEFAULT_PAIR_CODE_ALPHABET.
+func DefaultPairCodes() *PairCodes {
+	codes, err := NewPairCodes(DEFAULT_PAIR_CODE_LENGTH, DEFAULT_PAIR_CODE_ALPHABET)
+	if err != nil {
+		panic(err)
+	}
+
+	return codes
+}
+
+// New returns a code from crypto/rand, every character is picked uniformly.
+func (p *PairCodes) New() (string, error) {
+	builder := &strings.Builder{}
+	for range p.length {
+		n, err := rand.Int(rand.Reader, p.max)
+		if err != nil {
+			return "", err
+		}
+
+		builder.WriteRune(p.alphabet[n.Int64()])
+	}
+
+	return builder.String(), nil
+}
+
+// Valid reports whether code could have been made by p, so lookups of codes
+// that can't exist don't need the store.
+func (p *PairCodes) Valid(code string) bool {
+	n := 0
+	for _, c := range code {
+		if !p.contains(c) {
+			return false
+		}
+
+		n++
+	}
+
+	return n == p.length
+}
+
+func (p *PairCodes) contains(c rune) bool {
+	for _, a := range p.alphabet {
+		if a == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isAlphanumeric(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
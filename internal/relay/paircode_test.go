@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPairCodes(t *testing.T) {
+	codes, err := NewPairCodes(6, "ab12")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		code, err := codes.New()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(code) != 6 || strings.Trim(code, "ab12") != "" {
+			t.Fatalf("code %q doesn't match length and alphabet", code)
+		}
+
+		if !codes.Valid(code) {
+			t.Fatalf("code %q isn't valid", code)
+		}
+
+		seen[code] = true
+	}
+
+	if len(seen) < 50 {
+		t.Fatalf("only %d different codes out of 100", len(seen))
+	}
+
+	for _, code := range []string{"", "ab12a", "ab12ab1", "ab12aC", "ab-12a"} {
+		if codes.Valid(code) {
+			t.Errorf("expected %q to be invalid", code)
+		}
+	}
+}
+
+func TestNewPairCodesValidates(t *testing.T) {
+	for _, c := range []struct {
+		length   int
+		alphabet string
+	}{
+		{MIN_PAIR_CODE_LENGTH - 1, DEFAULT_PAIR_CODE_ALPHABET},
+		{MAX_PAIR_CODE_LENGTH + 1, DEFAULT_PAIR_CODE_ALPHABET},
+		{8, "a"},
+		{8, "abca"},
+		{8, "ab-c"},
+		{8, "ab c"},
+	} {
+		_, err := NewPairCodes(c.length, c.alphabet)
+		if err == nil {
+			t.Errorf("expected length %d and alphabet %q to be rejected", c.length, c.alphabet)
+		}
+	}
+}
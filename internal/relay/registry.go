@@ -0,0 +1,500 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/int32-dev/fastshare/internal/ws"
+)
+
+// EXPIRE_TIME is how long a sender waits for a receiver, and a session
+// created with the API for its sender.
+const EXPIRE_TIME = time.Minute * 2
+
+// CLOSED_RETENTION is how long a closed session can still be looked up.
+const CLOSED_RETENTION = time.Minute * 10
+
+// MAX_PAIR_CODE_TRIES is how many taken pair codes Register skips before it
+// gives up, which only happens if the codes are too short for the load.
+const MAX_PAIR_CODE_TRIES = 100
+
+var ErrAlreadyPaired = fmt.Errorf("session already has a receiver")
+var ErrAlreadyClaimed = fmt.Errorf("session already has a sender")
+var ErrNoFreePairCode = fmt.Errorf("no free pair code found")
+
+// Registry pairs senders with receivers. The sessions are kept in a
+// SessionStore, the connections of open sessions are kept here since they
+// can't be stored.
+type Registry struct {
+	store SessionStore
+	codes *PairCodes
+
+	m     sync.Mutex
+	conns map[string]*sessionConns
+
+	created  atomic.Int64
+	paired   atomic.Int64
+	expired  atomic.Int64
+	canceled atomic.Int64
+}
+
+// sessionConns are the connections of an open session, and what was relayed
+// between them.
+type sessionConns struct {
+	sender   *websocket.Conn
+	receiver *websocket.Conn
+
+	relayed atomic.Int64
+	// last is when the last message was relayed, in unix nanoseconds
+	last atomic.Int64
+}
+
+// relay counts a message of n bytes passed between sender and receiver.
+func (c *sessionConns) relay(n int) {
+	c.relayed.Add(int64(n))
+	c.last.Store(time.Now().UnixNano())
+}
+
+// activity copies the counters to s.
+func (c *sessionConns) activity(s *Session) {
+	s.Relayed = c.relayed.Load()
+	if last := c.last.Load(); last != 0 {
+		t := time.Unix(0, last)
+		s.LastActivity = &t
+	}
+}
+
+// NewRegistry hands out pair codes made by codes, DefaultPairCodes if nil.
+func NewRegistry(store SessionStore, codes *PairCodes) *Registry {
+	if codes == nil {
+		codes = DefaultPairCodes()
+	}
+
+	return &Registry{
+		store: store,
+		codes: codes,
+		conns: make(map[string]*sessionConns),
+	}
+}
+
+// Register adds a waiting sender and returns its pair code.
+func (r *Registry) Register(info *ws.ClientInfo, conn *websocket.Conn) (string, error) {
+	// held until the connection is in conns, so Pair never sees a waiting
+	// session without one
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	s, err := r.add(STATE_WAITING, info)
+	if err != nil {
+		return "", err
+	}
+
+	r.conns[s.PairCode] = &sessionConns{sender: conn}
+
+	return s.PairCode, nil
+}
+
+// Create adds a session without a sender, which claims its pair code later.
+func (r *Registry) Create() (*Session, error) {
+	return r.add(STATE_CREATED, nil)
+}
+
+// add stores a new session under a free pair code.
+func (r *Registry) add(state State, info *ws.ClientInfo) (*Session, error) {
+	for range MAX_PAIR_CODE_TRIES {
+		pairCode, err := r.codes.New()
+		if err != nil {
+			return nil, err
+		}
+
+		s := newSession(pairCode, state, info)
+		err = r.store.Add(s)
+		if errors.Is(err, ErrSessionExists) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		r.created.Add(1)
+
+		return s, nil
+	}
+
+	return nil, ErrNoFreePairCode
+}
+
+// Claim makes the sender wait for a receiver in a session made with Create.
+// Only the first sender gets it, later ones get ErrAlreadyClaimed.
+func (r *Registry) Claim(pairCode string, info *ws.ClientInfo, conn *websocket.Conn) error {
+	if !r.codes.Valid(pairCode) {
+		return ErrSessionNotFound
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	err := r.store.Update(pairCode, func(s *Session) error {
+		switch s.State {
+		case STATE_CREATED:
+		case STATE_CLOSED:
+			return ErrSessionNotFound
+		default:
+			return ErrAlreadyClaimed
+		}
+
+		s.Sender = info
+		setState(s, STATE_WAITING)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	r.conns[pairCode] = &sessionConns{sender: conn}
+
+	return nil
+}
+
+// Pair hands the waiting sender of pairCode to a receiver. Only the first
+// receiver gets it, later ones get ErrAlreadyPaired.
+func (r *Registry) Pair(pairCode string) (*Session, *websocket.Conn, error) {
+	if !r.codes.Valid(pairCode) {
+		return nil, nil, ErrSessionNotFound
+	}
+
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	var session *Session
+	err := r.store.Update(pairCode, func(s *Session) error {
+		switch s.State {
+		case STATE_WAITING:
+		case STATE_CREATED, STATE_CLOSED:
+			return ErrSessionNotFound
+		default:
+			return ErrAlreadyPaired
+		}
+
+		setState(s, STATE_PAIRED)
+		session = s.copy()
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// closed while its state was read
+	c := r.conns[pairCode]
+	if c == nil {
+		return nil, nil, ErrSessionNotFound
+	}
+
+	r.paired.Add(1)
+
+	return session, c.sender, nil
+}
+
+// connectReceiver keeps the receiver's connection of a paired session, so it
+// can be canceled. Messages relayed between the two are counted in the
+// returned sessionConns. ErrSessionNotFound if the session was closed since
+// it was paired.
+func (r *Registry) connectReceiver(pairCode string, conn *websocket.Conn) (*sessionConns, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	c := r.conns[pairCode]
+	if c == nil {
+		return nil, ErrSessionNotFound
+	}
+
+	c.receiver = conn
+	return c, nil
+}
+
+// Transferring records that encrypted records started flowing.
+func (r *Registry) Transferring(pairCode string) error {
+	return r.store.Update(pairCode, func(s *Session) error {
+		if s.State == STATE_PAIRED {
+			setState(s, STATE_TRANSFERRING)
+		}
+
+		return nil
+	})
+}
+
+// Close ends the session and closes its connections if they are still open.
+func (r *Registry) Close(pairCode string, code websocket.StatusCode, reason string) error {
+	// closed before its connections are dropped, like expire does, so Pair
+	// never sees a waiting session without them
+	err := r.store.Update(pairCode, func(s *Session) error {
+		if s.State != STATE_CLOSED {
+			setState(s, STATE_CLOSED)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	c := r.closeConns(pairCode, code, reason)
+	if c == nil {
+		return nil
+	}
+
+	return r.store.Update(pairCode, func(s *Session) error {
+		c.activity(s)
+		return nil
+	})
+}
+
+// Cancel closes the session for both sender and receiver, telling them with
+// ws.StatusCanceledByRelay, and returns it. A closed session is returned as
+// it is.
+func (r *Registry) Cancel(pairCode string) (*Session, error) {
+	s, err := r.store.Get(pairCode)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.State == STATE_CLOSED {
+		return s, nil
+	}
+
+	err = r.Close(pairCode, ws.StatusCanceledByRelay, "canceled by the relay")
+	if err != nil {
+		return nil, err
+	}
+
+	r.canceled.Add(1)
+	fmt.Println("session canceled:", pairCode)
+
+	return r.store.Get(pairCode)
+}
+
+func (r *Registry) closeConns(pairCode string, code websocket.StatusCode, reason string) *sessionConns {
+	r.m.Lock()
+	c := r.conns[pairCode]
+	delete(r.conns, pairCode)
+	r.m.Unlock()
+
+	if c == nil {
+		return nil
+	}
+
+	// Close waits for the peer to answer. Both are told at once, otherwise
+	// the pumps see the first one close and end the other one normally.
+	var wg sync.WaitGroup
+	for _, conn := range []*websocket.Conn{c.sender, c.receiver} {
+		if conn == nil {
+			continue
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.Close(code, reason)
+		}()
+	}
+
+	wg.Wait()
+
+	return c
+}
+
+// Get returns the session with the pair code, with what was relayed so far
+// if it is open.
+func (r *Registry) Get(pairCode string) (*Session, error) {
+	s, err := r.store.Get(pairCode)
+	if err != nil {
+		return nil, err
+	}
+
+	r.activity(s)
+	return s, nil
+}
+
+// Active returns the sessions that aren't closed, oldest first.
+func (r *Registry) Active() ([]*Session, error) {
+	sessions, err := r.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	active := make([]*Session, 0, len(sessions))
+	for _, s := range sessions {
+		if s.State != STATE_CLOSED {
+			r.activity(s)
+			active = append(active, s)
+		}
+	}
+
+	return active, nil
+}
+
+func (r *Registry) activity(s *Session) {
+	r.m.Lock()
+	c := r.conns[s.PairCode]
+	r.m.Unlock()
+
+	if c != nil {
+		c.activity(s)
+	}
+}
+
+// Expire closes senders that waited longer than expireTime, as well as
+// sessions created with the API that no sender claimed, and forgets sessions
+// that were closed for longer than CLOSED_RETENTION.
+func (r *Registry) Expire(expireTime time.Duration) error {
+	sessions, err := r.store.List()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range sessions {
+		switch s.State {
+		case STATE_CREATED, STATE_WAITING:
+			err = r.expire(s.PairCode, expireTime)
+		case STATE_CLOSED:
+			if time.Since(s.Updated) > CLOSED_RETENTION {
+				err = r.store.Delete(s.PairCode)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expire closes the session if it is still waiting after expireTime. A
+// sender may have claimed it or a receiver paired since it was listed.
+func (r *Registry) expire(pairCode string, expireTime time.Duration) error {
+	expired := false
+	err := r.store.Update(pairCode, func(s *Session) error {
+		// Updated is when a claimed session started waiting for its receiver
+		if (s.State == STATE_CREATED || s.State == STATE_WAITING) && time.Since(s.Updated) > expireTime {
+			setState(s, STATE_CLOSED)
+			expired = true
+		}
+
+		return nil
+	})
+	if err != nil || !expired {
+		return err
+	}
+
+	r.closeConns(pairCode, ws.StatusTimeoutError, "timed out waiting for receiver")
+	r.expired.Add(1)
+	fmt.Println("session expired:", pairCode)
+
+	return nil
+}
+
+// Metrics are counts of the sessions of a Registry.
+type Metrics struct {
+	// Sessions are the sessions in the store by state
+	Sessions map[State]int
+	// Created, Paired, Expired and Canceled count since the registry was made
+	Created  int64
+	Paired   int64
+	Expired  int64
+	Canceled int64
+	// StoredShares and StoredBytes are the shares kept for later, see
+	// StoredShares
+	StoredShares int
+	StoredBytes  int64
+}
+
+func (r *Registry) Metrics() (*Metrics, error) {
+	sessions, err := r.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Metrics{
+		Sessions: make(map[State]int),
+		Created:  r.created.Load(),
+		Paired:   r.paired.Load(),
+		Expired:  r.expired.Load(),
+		Canceled: r.canceled.Load(),
+	}
+
+	for _, state := range States() {
+		m.Sessions[state] = 0
+	}
+
+	for _, s := range sessions {
+		m.Sessions[s.State]++
+	}
+
+	return m, nil
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countWriter{w: w}
+
+	fmt.Fprintln(cw, "# HELP fastshare_sessions Sessions known to the relay by state.")
+	fmt.Fprintln(cw, "# TYPE fastshare_sessions gauge")
+	for _, state := range States() {
+		fmt.Fprintf(cw, "fastshare_sessions{state=%q} %d\n", state, m.Sessions[state])
+	}
+
+	for _, c := range []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"fastshare_sessions_created_total", "Sessions that got a pair code.", m.Created},
+		{"fastshare_sessions_paired_total", "Senders a receiver connected to.", m.Paired},
+		{"fastshare_sessions_expired_total", "Sessions that timed out waiting for a sender or receiver.", m.Expired},
+		{"fastshare_sessions_canceled_total", "Sessions canceled through the API.", m.Canceled},
+	} {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s counter\n%s %d\n", c.name, c.help, c.name, c.name, c.value)
+	}
+
+	for _, g := range []struct {
+		name  string
+		help  string
+		value int64
+	}{
+		{"fastshare_stored_shares", "Shares kept for receivers that download them later.", int64(m.StoredShares)},
+		{"fastshare_stored_bytes", "Bytes of stored shares, including uploads in progress.", m.StoredBytes},
+	} {
+		fmt.Fprintf(cw, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value)
+	}
+
+	return cw.n, cw.err
+}
+
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
+
+func setState(s *Session, state State) {
+	s.State = state
+	s.Updated = time.Now()
+}
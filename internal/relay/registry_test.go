@@ -0,0 +1,311 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegistryConcurrentPairing(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+
+			registry := NewRegistry(store, nil)
+
+			const SENDERS = 50
+			const RECEIVERS = 3
+
+			var wg sync.WaitGroup
+			var paired, conflicts atomic.Int64
+			codes := make(chan string, SENDERS)
+
+			for i := 0; i < SENDERS; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+
+					code, err := registry.Register(nil, nil)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					codes <- code
+
+					var receivers sync.WaitGroup
+					for j := 0; j < RECEIVERS; j++ {
+						receivers.Add(1)
+						go func() {
+							defer receivers.Done()
+
+							_, _, err := registry.Pair(code)
+							switch {
+							case err == nil:
+								paired.Add(1)
+							case errors.Is(err, ErrAlreadyPaired):
+								conflicts.Add(1)
+							default:
+								t.Error(err)
+							}
+						}()
+					}
+
+					// expiring and reading metrics at the same time must not race
+					registry.Expire(time.Hour)
+					registry.Metrics()
+					receivers.Wait()
+				}()
+			}
+
+			wg.Wait()
+			close(codes)
+
+			if paired.Load() != SENDERS || conflicts.Load() != SENDERS*(RECEIVERS-1) {
+				t.Fatalf("expected every sender paired once, got %d paired and %d conflicts", paired.Load(), conflicts.Load())
+			}
+
+			seen := make(map[string]bool)
+			for code := range codes {
+				if seen[code] {
+					t.Fatal("pair code handed out twice:", code)
+				}
+
+				seen[code] = true
+			}
+
+			m, err := registry.Metrics()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if m.Sessions[STATE_PAIRED] != SENDERS || m.Created != SENDERS || m.Paired != SENDERS {
+				t.Fatalf("unexpected metrics %+v", m)
+			}
+		})
+	}
+}
+
+// slowClosingStore waits before it closes a session, so a receiver can try to
+// pair in between.
+type slowClosingStore struct {
+	SessionStore
+}
+
+func (s slowClosingStore) Update(pairCode string, fn func(s *Session) error) error {
+	session, err := s.Get(pairCode)
+	if err == nil && session.State != STATE_CLOSED && fn(session) == nil && session.State == STATE_CLOSED {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	return s.SessionStore.Update(pairCode, fn)
+}
+
+func TestRegistryCloseWhilePairing(t *testing.T) {
+	registry := NewRegistry(slowClosingStore{NewMemoryStore()}, nil)
+
+	const SESSIONS = 50
+
+	var wg sync.WaitGroup
+	for i := 0; i < SESSIONS; i++ {
+		code, err := registry.Register(nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+
+			// once closing started
+			time.Sleep(time.Millisecond)
+			_, _, err := registry.Pair(code)
+			if err != nil && !errors.Is(err, ErrSessionNotFound) {
+				t.Error(err)
+			}
+		}()
+
+		go func() {
+			defer wg.Done()
+
+			var err error
+			if i%2 == 0 {
+				_, err = registry.Cancel(code)
+			} else {
+				err = registry.Close(code, 1000, "")
+			}
+
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	m, err := registry.Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Sessions[STATE_CLOSED] != SESSIONS {
+		t.Fatalf("expected every session closed, got %+v", m.Sessions)
+	}
+}
+
+func TestRegistryLifecycle(t *testing.T) {
+	registry := NewRegistry(NewMemoryStore(), nil)
+
+	waiting, err := registry.Register(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := registry.Register(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = registry.Pair(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = registry.Transferring(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// paired sessions never expire, waiting ones do
+	err = registry.Expire(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = registry.Pair(waiting)
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected expired sender to be gone, got %v", err)
+	}
+
+	s, err := registry.store.Get(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.State != STATE_TRANSFERRING {
+		t.Fatalf("expected transferring session, got %s", s.State)
+	}
+
+	err = registry.Close(code, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := registry.Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Sessions[STATE_CLOSED] != 2 || m.Expired != 1 {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+
+	buf := &bytes.Buffer{}
+	_, err = m.WriteTo(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{
+		`fastshare_sessions{state="closed"} 2`,
+		`fastshare_sessions{state="waiting"} 0`,
+		"fastshare_sessions_created_total 2",
+		"fastshare_sessions_paired_total 1",
+		"fastshare_sessions_expired_total 1",
+	} {
+		if !strings.Contains(buf.String(), line+"\n") {
+			t.Errorf("metrics are missing %q:\n%s", line, buf)
+		}
+	}
+}
+
+func TestRegistryClaim(t *testing.T) {
+	registry := NewRegistry(NewMemoryStore(), nil)
+
+	created, err := registry.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// receivers can't pair before a sender claimed the session
+	_, _, err = registry.Pair(created.PairCode)
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	err = registry.Claim(created.PairCode, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = registry.Claim(created.PairCode, nil, nil)
+	if !errors.Is(err, ErrAlreadyClaimed) {
+		t.Fatalf("expected ErrAlreadyClaimed, got %v", err)
+	}
+
+	err = registry.Claim("22223333", nil, nil)
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	unclaimed, err := registry.Create()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := registry.Active()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(active) != 2 || active[0].State != STATE_WAITING || active[1].State != STATE_CREATED {
+		t.Fatalf("unexpected active sessions %+v", active)
+	}
+
+	s, err := registry.Cancel(created.PairCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.State != STATE_CLOSED {
+		t.Fatalf("expected canceled session to be closed, got %s", s.State)
+	}
+
+	// sessions nobody claimed expire like waiting senders
+	err = registry.Expire(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = registry.Get(unclaimed.PairCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.State != STATE_CLOSED {
+		t.Fatalf("expected unclaimed session to expire, got %s", s.State)
+	}
+
+	m, err := registry.Metrics()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m.Created != 2 || m.Canceled != 1 || m.Expired != 1 {
+		t.Fatalf("unexpected metrics %+v", m)
+	}
+}
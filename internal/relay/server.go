@@ -0,0 +1,457 @@
+package relay
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/int32-dev/fastshare/internal/ws"
+)
+
+// MONITOR_INTERVAL is how often waiting senders are checked for expiry.
+const MONITOR_INTERVAL = time.Second * 5
+
+// Server relays the websocket connections of senders and receivers.
+type Server struct {
+	registry *Registry
+	// ExpireTime is how long a sender waits for a receiver, EXPIRE_TIME if 0
+	ExpireTime time.Duration
+	// Limiter locks out receivers that try too many pair codes, nil doesn't
+	// limit them
+	Limiter *Limiter
+	// TrustProxy takes the client address from X-Forwarded-For, for a relay
+	// behind a reverse proxy. Without a proxy clients could pick any address.
+	TrustProxy bool
+	// Stored keeps shares for receivers that aren't online yet, nil turns
+	// that off
+	Stored *StoredShares
+	// AdminToken guards the session API, which is turned off if it is empty
+	AdminToken string
+}
+
+// NewServer limits receivers with the default Limiter.
+func NewServer(registry *Registry) *Server {
+	return &Server{
+		registry: registry,
+		Limiter:  NewLimiter(DEFAULT_MAX_FAILURES, DEFAULT_FAILURE_WINDOW, DEFAULT_LOCKOUT),
+	}
+}
+
+// Handler serves the websocket endpoint on /ws and the metrics on /metrics.
+// With Stored shares are uploaded with PUT /store, and downloaded with
+// GET /store/{id}. With AdminToken the session API is served under
+// /api/sessions, see api.go.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ws", errorMiddleware(s.handleWsConnect))
+	mux.HandleFunc("/metrics", errorMiddleware(s.handleMetrics))
+
+	if s.Stored != nil {
+		mux.HandleFunc("PUT /store", errorMiddleware(s.handleStore))
+		mux.HandleFunc("GET /store/{id}", errorMiddleware(s.handleDownload))
+	}
+
+	if s.AdminToken != "" {
+		mux.HandleFunc("POST /api/sessions", errorMiddleware(s.admin(s.handleCreateSession)))
+		mux.HandleFunc("GET /api/sessions", errorMiddleware(s.admin(s.handleListSessions)))
+		mux.HandleFunc("GET /api/sessions/{code}", errorMiddleware(s.admin(s.handleGetSession)))
+		mux.HandleFunc("DELETE /api/sessions/{code}", errorMiddleware(s.admin(s.handleCancelSession)))
+	}
+
+	return mux
+}
+
+// Monitor expires waiting senders until ctx is done.
+func (s *Server) Monitor(ctx context.Context) {
+	expireTime := s.ExpireTime
+	if expireTime == 0 {
+		expireTime = EXPIRE_TIME
+	}
+
+	ticker := time.NewTicker(MONITOR_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := s.registry.Expire(expireTime)
+			if err != nil {
+				fmt.Println("error expiring sessions:", err)
+			}
+
+			if s.Limiter != nil {
+				s.Limiter.Forget()
+			}
+
+			if s.Stored != nil {
+				s.Stored.Expire()
+			}
+		}
+	}
+}
+
+func errorMiddleware(next func(w http.ResponseWriter, r *http.Request) error) func(w http.ResponseWriter, r *http.Request) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := next(w, r)
+		if err != nil {
+			fmt.Println("error:", err)
+		}
+	})
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	metrics, err := s.registry.Metrics()
+	if err != nil {
+		http.Error(w, "error reading sessions", http.StatusInternalServerError)
+		return err
+	}
+
+	if s.Stored != nil {
+		metrics.StoredShares, metrics.StoredBytes = s.Stored.Usage()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, err = metrics.WriteTo(w)
+	return err
+}
+
+func (s *Server) handleWsConnect(w http.ResponseWriter, r *http.Request) error {
+	clientInfo, err := ws.NewClientInfoFromQueryString(r.URL.Query())
+	if err != nil {
+		http.Error(w, "error parsing headers", http.StatusBadRequest)
+		return err
+	}
+
+	paircode := r.URL.Query().Get(ws.PaircodeQuery)
+	if paircode == "" {
+		return s.handleSender(w, r, clientInfo, r.URL.Query().Get(ws.ClaimQuery))
+	}
+
+	return s.handleReceiver(w, r, paircode)
+}
+
+// handleSender registers the sender, or lets it claim the session created
+// with the API, and it then waits for its receiver.
+func (s *Server) handleSender(w http.ResponseWriter, r *http.Request, clientInfo *ws.ClientInfo, claim string) error {
+	if claim != "" {
+		err := s.checkClaim(w, r, claim)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn, err := websocket.Accept(w, r, nil)
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadLimit(ws.MAX_MESSAGE_SIZE)
+
+	paircode := claim
+	if claim == "" {
+		paircode, err = s.registry.Register(clientInfo, conn)
+	} else {
+		err = s.registry.Claim(claim, clientInfo, conn)
+	}
+
+	if err != nil {
+		// a claim can still fail if another sender was faster
+		conn.Close(websocket.StatusInternalError, "failed to register sender")
+		return err
+	}
+
+	msg, err := ws.GetJsonMessageBytes("pairCode", paircode)
+	if err != nil {
+		s.registry.Close(paircode, websocket.StatusInternalError, "")
+		return err
+	}
+
+	err = conn.Write(context.Background(), websocket.MessageText, msg)
+	if err != nil {
+		s.registry.Close(paircode, websocket.StatusAbnormalClosure, "")
+		return err
+	}
+
+	return nil
+}
+
+// checkClaim answers 404 or 409 if the sender can't claim the pair code, so
+// it learns why before the connection is upgraded.
+func (s *Server) checkClaim(w http.ResponseWriter, r *http.Request, claim string) error {
+	addr := s.clientAddr(r)
+	err := s.allow(w, addr)
+	if err != nil {
+		return err
+	}
+
+	session, err := s.registry.Get(claim)
+	if err == nil && session.State == STATE_CLOSED {
+		err = ErrSessionNotFound
+	}
+
+	if errors.Is(err, ErrSessionNotFound) {
+		return s.notFound(w, addr, "no session found", err)
+	}
+
+	if err != nil {
+		http.Error(w, "error looking up session", http.StatusInternalServerError)
+		return err
+	}
+
+	if session.State != STATE_CREATED {
+		http.Error(w, "session already has a sender", http.StatusConflict)
+		return ErrAlreadyClaimed
+	}
+
+	return nil
+}
+
+// handleReceiver pairs the receiver with its sender and relays between them
+// until one of them is gone.
+func (s *Server) handleReceiver(w http.ResponseWriter, r *http.Request, paircode string) error {
+	addr := s.clientAddr(r)
+	err := s.allow(w, addr)
+	if err != nil {
+		return err
+	}
+
+	session, senderConn, err := s.registry.Pair(paircode)
+	if errors.Is(err, ErrSessionNotFound) {
+		return s.notFound(w, addr, "no sender found", err)
+	}
+
+	if errors.Is(err, ErrAlreadyPaired) {
+		http.Error(w, "sender already has a receiver", http.StatusConflict)
+		return err
+	}
+
+	if err != nil {
+		http.Error(w, "error looking up sender", http.StatusInternalServerError)
+		return err
+	}
+
+	defer s.registry.Close(paircode, websocket.StatusAbnormalClosure, "")
+
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{})
+	if err != nil {
+		return err
+	}
+
+	conn.SetReadLimit(ws.MAX_MESSAGE_SIZE)
+
+	conns, err := s.registry.connectReceiver(paircode, conn)
+	if err != nil {
+		// canceled since it was paired
+		conn.Close(ws.StatusCanceledByRelay, "canceled by the relay")
+		return err
+	}
+
+	msg, err := ws.GetJsonMessageBytes("senderInfo", session.Sender)
+	if err != nil {
+		return err
+	}
+
+	err = conn.Write(context.Background(), websocket.MessageText, msg)
+	if err != nil {
+		return err
+	}
+
+	// the handshake is text, encrypted records are the first binary message
+	var once sync.Once
+	relayed := func(msgType websocket.MessageType, n int) {
+		conns.relay(n)
+
+		if msgType == websocket.MessageBinary {
+			once.Do(func() {
+				err := s.registry.Transferring(paircode)
+				if err != nil {
+					fmt.Println("error updating session:", err)
+				}
+			})
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		pump(ctx, senderConn, conn, relayed)
+		cancel()
+	}()
+	pump(ctx, conn, senderConn, relayed)
+	cancel()
+
+	return nil
+}
+
+// allow answers 429 if addr is locked out.
+func (s *Server) allow(w http.ResponseWriter, addr string) error {
+	if s.Limiter == nil {
+		return nil
+	}
+
+	wait := s.Limiter.Allow(addr)
+	if wait > 0 {
+		tooManyFailures(w, wait)
+		return fmt.Errorf("%s is locked out for %s", addr, wait.Round(time.Second))
+	}
+
+	return nil
+}
+
+// notFound answers 404 for a lookup that failed, or 429 if addr failed too
+// often now.
+func (s *Server) notFound(w http.ResponseWriter, addr string, message string, err error) error {
+	if s.Limiter != nil {
+		wait := s.Limiter.Fail(addr)
+		if wait > 0 {
+			tooManyFailures(w, wait)
+			return fmt.Errorf("%s locked out after too many unknown pair codes", addr)
+		}
+	}
+
+	http.Error(w, message, http.StatusNotFound)
+	return err
+}
+
+// clientAddr is the address failed lookups are counted for.
+func (s *Server) clientAddr(r *http.Request) string {
+	if s.TrustProxy {
+		// the proxy appends the address it saw, the ones before it come from
+		// the client
+		forwarded := r.Header.Values("X-Forwarded-For")
+		if len(forwarded) > 0 {
+			addrs := strings.Split(forwarded[len(forwarded)-1], ",")
+			addr := strings.TrimSpace(addrs[len(addrs)-1])
+			if addr != "" {
+				return addr
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// tooManyFailures answers 429, Retry-After tells the client when to try again.
+func tooManyFailures(w http.ResponseWriter, wait time.Duration) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	http.Error(w, "too many failed attempts, try again later", http.StatusTooManyRequests)
+}
+
+// pump passes the messages of s on to r, relayed is called for each of them.
+func pump(ctx context.Context, r *websocket.Conn, s *websocket.Conn, relayed func(msgType websocket.MessageType, n int)) {
+	for {
+		msgType, message, err := s.Read(ctx)
+		if err != nil {
+			// passes on why the peer closed, like StatusGoingAway when it
+			// canceled the transfer
+			var closeErr websocket.CloseError
+			if errors.As(err, &closeErr) {
+				err = r.Close(closeErr.Code, closeErr.Reason)
+				if err != nil {
+					fmt.Printf("error closing connection: %v\n", err)
+				}
+
+				return
+			}
+
+			if errors.Is(err, context.Canceled) {
+				fmt.Println("context canceled")
+				r.Close(websocket.StatusNormalClosure, "")
+			}
+
+			fmt.Println("pump:", err)
+			return
+		}
+
+		if msgType == websocket.MessageText || msgType == websocket.MessageBinary {
+			err := r.Write(ctx, msgType, message)
+			if err != nil {
+				fmt.Println("error writing:", err)
+				return
+			}
+
+			relayed(msgType, len(message))
+		}
+	}
+}
+
+// storeResponse answers an upload.
+type storeResponse struct {
+	ID      string
+	Expires time.Time
+}
+
+func (s *Server) handleStore(w http.ResponseWriter, r *http.Request) error {
+	addr := s.clientAddr(r)
+	err := s.allow(w, addr)
+	if err != nil {
+		return err
+	}
+
+	share, err := s.Stored.Store(addr, r.Body)
+	if errors.Is(err, ErrTooLarge) {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return err
+	}
+
+	if errors.Is(err, ErrQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return err
+	}
+
+	if errors.Is(err, ErrAddressQuotaExceeded) {
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return err
+	}
+
+	if err != nil {
+		http.Error(w, "error storing share", http.StatusInternalServerError)
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	return json.NewEncoder(w).Encode(&storeResponse{ID: share.ID, Expires: share.Expires})
+}
+
+func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) error {
+	addr := s.clientAddr(r)
+	err := s.allow(w, addr)
+	if err != nil {
+		return err
+	}
+
+	f, share, err := s.Stored.Open(r.PathValue("id"))
+	if errors.Is(err, ErrSessionNotFound) {
+		return s.notFound(w, addr, "no stored share found", err)
+	}
+
+	if err != nil {
+		http.Error(w, "error opening stored share", http.StatusInternalServerError)
+		return err
+	}
+
+	defer f.Close()
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(share.Size, 10))
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,453 @@
+package relay
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+	"github.com/int32-dev/fastshare/internal/transfer"
+	"github.com/int32-dev/fastshare/internal/ws"
+)
+
+type memorySink struct {
+	buf *bytes.Buffer
+}
+
+func (s *memorySink) Prepare(manifest *transfer.Manifest) error {
+	return nil
+}
+
+func (s *memorySink) Open(info *transfer.FileInfo, offset int64) (transfer.EntryWriter, error) {
+	return nopEntryWriter{s.buf}, nil
+}
+
+type nopEntryWriter struct {
+	io.Writer
+}
+
+func (nopEntryWriter) Close() error {
+	return nil
+}
+
+func (nopEntryWriter) Abort(err error) error {
+	return nil
+}
+
+func TestRelay(t *testing.T) {
+	registry := NewRegistry(NewMemoryStore(), nil)
+	server := httptest.NewServer(NewServer(registry).Handler())
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	message := "hello through the relay"
+	codes := make(chan string, 1)
+	sendErr := make(chan error, 1)
+
+	go func() {
+		share := &transfer.Share{Sources: []*transfer.Source{{
+			FileInfo: transfer.FileInfo{Size: int64(len(message)), MimeType: transfer.MESSAGE_MIME_TYPE},
+			Reader:   strings.NewReader(message),
+		}}}
+
+		sendErr <- ws.Send(ctx, "blue-penguin23", url, share, &ws.Options{
+			Suites:    encryptservice.DefaultSuites(),
+			ShareCode: func(code string) { codes <- code },
+		})
+	}()
+
+	var code string
+	select {
+	case code = <-codes:
+	case err := <-sendErr:
+		t.Fatal(err)
+	}
+
+	shareCode, pairCode, err := ws.SplitCode(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if shareCode != "blue-penguin23" || !registry.codes.Valid(pairCode) {
+		t.Fatalf("unexpected share code %q", code)
+	}
+
+	sink := &memorySink{buf: &bytes.Buffer{}}
+	err = ws.Receive(ctx, code, url, sink, &ws.Options{Suites: encryptservice.DefaultSuites()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-sendErr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sink.buf.String() != message {
+		t.Fatalf("expected %q, got %q", message, sink.buf)
+	}
+
+	// the receiver handler closes the session once both pumps are done
+	var s *Session
+	for i := 0; i < 100; i++ {
+		s, err = registry.store.Get(pairCode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.State == STATE_CLOSED {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if s.State != STATE_CLOSED {
+		t.Fatalf("expected closed session, got %s", s.State)
+	}
+
+	// a closed session can't be paired again
+	_, _, err = registry.Pair(pairCode)
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(body), "fastshare_sessions_paired_total 1\n") {
+		t.Fatalf("expected one paired session in metrics:\n%s", body)
+	}
+}
+
+func TestRelayLocksOutUnknownPairCodes(t *testing.T) {
+	relay := NewServer(NewRegistry(NewMemoryStore(), nil))
+	relay.Limiter = NewLimiter(3, time.Minute, time.Minute)
+	server := httptest.NewServer(relay.Handler())
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	opts := &ws.Options{Suites: encryptservice.DefaultSuites()}
+
+	// codes the relay can't have made count as well
+	for i, code := range []string{"bluepenguin23-22223333", "bluepenguin23-nope!"} {
+		_, err := ws.NewWsReceiveHandler(context.Background(), code, url, opts)
+		if !errors.Is(err, ws.ErrNoSender) {
+			t.Fatalf("lookup %d: expected ErrNoSender, got %v", i, err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		_, err := ws.NewWsReceiveHandler(context.Background(), "bluepenguin23-22223333", url, opts)
+		if !errors.Is(err, ws.ErrLockedOut) {
+			t.Fatalf("expected ErrLockedOut, got %v", err)
+		}
+
+		if !strings.Contains(err.Error(), "try again in 1m0s") {
+			t.Fatalf("expected the lockout time in %q", err)
+		}
+	}
+}
+
+func TestRelayStoresShares(t *testing.T) {
+	stored, err := OpenStoredShares(t.TempDir(), nil, 1<<20, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := NewServer(NewRegistry(NewMemoryStore(), nil))
+	relay.Stored = stored
+	server := httptest.NewServer(relay.Handler())
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+	opts := &ws.Options{Suites: encryptservice.DefaultSuites()}
+
+	message := "read this tomorrow"
+	var code string
+	opts.ShareCode = func(c string) { code = c }
+
+	share := &transfer.Share{Sources: []*transfer.Source{{
+		FileInfo: transfer.FileInfo{Size: int64(len(message)), MimeType: transfer.MESSAGE_MIME_TYPE},
+		Reader:   strings.NewReader(message),
+	}}}
+
+	err = ws.Store(context.Background(), "BlueOrangeHorseBatteryStaple", url, share, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shareCode, id, err := ws.SplitCode(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, _, err := stored.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(data, []byte(message)) || bytes.Contains(data, []byte(shareCode)) {
+		t.Fatal("the relay can read the stored share")
+	}
+
+	// it can be downloaded as often as needed until it expires
+	for i := 0; i < 2; i++ {
+		sink := &memorySink{buf: &bytes.Buffer{}}
+		err = ws.Download(context.Background(), code, url, sink, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sink.buf.String() != message {
+			t.Fatalf("expected %q, got %q", message, sink.buf)
+		}
+	}
+
+	err = ws.Download(context.Background(), "BlueOrangeHorseBatteryStapler-"+id, url, &memorySink{buf: &bytes.Buffer{}}, opts)
+	if !errors.Is(err, encryptservice.ErrWrongShareCode) {
+		t.Fatalf("expected ErrWrongShareCode, got %v", err)
+	}
+
+	err = ws.Download(context.Background(), shareCode+"-22223333", url, &memorySink{buf: &bytes.Buffer{}}, opts)
+	if !errors.Is(err, ws.ErrNotStored) {
+		t.Fatalf("expected ErrNotStored, got %v", err)
+	}
+}
+
+func TestRelayLimitsUploadsPerAddress(t *testing.T) {
+	stored, err := OpenStoredShares(t.TempDir(), nil, 1<<20, 1<<20, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored.AddressQuota = 100
+	relay := NewServer(NewRegistry(NewMemoryStore(), nil))
+	relay.Stored = stored
+	relay.Limiter = NewLimiter(3, time.Minute, time.Minute)
+	server := httptest.NewServer(relay.Handler())
+	defer server.Close()
+
+	upload := func() int {
+		req, err := http.NewRequest(http.MethodPut, server.URL+"/store", bytes.NewReader(make([]byte, 60)))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+		return res.StatusCode
+	}
+
+	if status := upload(); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+
+	if status := upload(); status != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 past the address quota, got %d", status)
+	}
+
+	count, used := stored.Usage()
+	if count != 1 || used != 60 {
+		t.Fatalf("expected only the first upload to be kept, got %d shares with %d bytes", count, used)
+	}
+
+	// an address locked out for guessing can't upload either
+	stored.AddressQuota = 0
+	for i := 0; i < 3; i++ {
+		res, err := http.Get(server.URL + "/store/22223333")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.Body.Close()
+	}
+
+	if status := upload(); status != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 while locked out, got %d", status)
+	}
+}
+
+func TestRelaySessionAPI(t *testing.T) {
+	relay := NewServer(NewRegistry(NewMemoryStore(), nil))
+	relay.AdminToken = "s3cret"
+	server := httptest.NewServer(relay.Handler())
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	api := func(method string, path string, token string, v any) int {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defer resp.Body.Close()
+
+		if v != nil && resp.StatusCode < 300 {
+			err = json.NewDecoder(resp.Body).Decode(v)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		return resp.StatusCode
+	}
+
+	if status := api("GET", "/api/sessions", "wrong", nil); status != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for a wrong token, got %d", status)
+	}
+
+	// a sender claims a created session, and the receiver uses it as usual
+	created := &Session{}
+	if status := api("POST", "/api/sessions", "s3cret", created); status != http.StatusCreated {
+		t.Fatalf("expected 201, got %d", status)
+	}
+
+	if created.State != STATE_CREATED {
+		t.Fatalf("expected created session, got %s", created.State)
+	}
+
+	message := "hello through a created session"
+	codes := make(chan string, 1)
+	sendErr := make(chan error, 1)
+	send := func(pairCode string) {
+		share := &transfer.Share{Sources: []*transfer.Source{{
+			FileInfo: transfer.FileInfo{Size: int64(len(message)), MimeType: transfer.MESSAGE_MIME_TYPE},
+			Reader:   strings.NewReader(message),
+		}}}
+
+		sendErr <- ws.Send(ctx, "blue-penguin23", url, share, &ws.Options{
+			Suites:    encryptservice.DefaultSuites(),
+			ShareCode: func(code string) { codes <- code },
+			PairCode:  pairCode,
+		})
+	}
+
+	go send(created.PairCode)
+
+	var code string
+	select {
+	case code = <-codes:
+	case err := <-sendErr:
+		t.Fatal(err)
+	}
+
+	if code != "blue-penguin23-"+created.PairCode {
+		t.Fatalf("expected the created pair code in %q", code)
+	}
+
+	err := ws.Send(ctx, "blue-penguin23", url, &transfer.Share{}, &ws.Options{
+		Suites:   encryptservice.DefaultSuites(),
+		PairCode: created.PairCode,
+	})
+	if !errors.Is(err, ws.ErrPairCodeClaimed) {
+		t.Fatalf("expected ErrPairCodeClaimed, got %v", err)
+	}
+
+	list := &sessionsResponse{}
+	api("GET", "/api/sessions", "s3cret", list)
+	if len(list.Sessions) != 1 || list.Sessions[0].State != STATE_WAITING {
+		t.Fatalf("expected one waiting session, got %+v", list.Sessions)
+	}
+
+	sink := &memorySink{buf: &bytes.Buffer{}}
+	err = ws.Receive(ctx, code, url, sink, &ws.Options{Suites: encryptservice.DefaultSuites()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-sendErr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the receiver handler closes the session once both pumps are done
+	s := &Session{}
+	for i := 0; i < 100; i++ {
+		api("GET", "/api/sessions/"+created.PairCode, "s3cret", s)
+		if s.State == STATE_CLOSED {
+			break
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if s.State != STATE_CLOSED || s.Relayed < int64(len(message)) || s.LastActivity == nil {
+		t.Fatalf("expected a closed session that relayed the message, got %+v", s)
+	}
+
+	// canceling a waiting sender tells it why
+	go send("")
+
+	select {
+	case code = <-codes:
+	case err := <-sendErr:
+		t.Fatal(err)
+	}
+
+	_, pairCode, err := ws.SplitCode(code)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status := api("DELETE", "/api/sessions/"+pairCode, "s3cret", s); status != http.StatusOK || s.State != STATE_CLOSED {
+		t.Fatalf("expected the canceled session, got %d %+v", status, s)
+	}
+
+	err = <-sendErr
+	if !errors.Is(err, ws.ErrCanceledByRelay) {
+		t.Fatalf("expected ErrCanceledByRelay, got %v", err)
+	}
+
+	if status := api("GET", "/api/sessions/22223333", "s3cret", nil); status != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown session, got %d", status)
+	}
+
+	err = ws.Send(ctx, "blue-penguin23", url, &transfer.Share{}, &ws.Options{
+		Suites:   encryptservice.DefaultSuites(),
+		PairCode: pairCode,
+	})
+	if !errors.Is(err, ws.ErrUnknownPairCode) {
+		t.Fatalf("expected ErrUnknownPairCode for a closed session, got %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package relay
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/ws"
+)
+
+// State is where a session is in its lifecycle. It only ever moves forward.
+type State int
+
+const (
+	// STATE_CREATED means the session was created with the API, and waits
+	// for a sender to claim its pair code
+	STATE_CREATED State = iota
+	// STATE_WAITING means the sender is connected and waits for a receiver
+	STATE_WAITING
+	// STATE_PAIRED means a receiver connected and the handshake is passed on
+	STATE_PAIRED
+	// STATE_TRANSFERRING means encrypted records are being relayed
+	STATE_TRANSFERRING
+	// STATE_CLOSED means the connections are gone, the session is kept for
+	// a while so it can still be looked up
+	STATE_CLOSED
+)
+
+var stateNames = []string{"created", "waiting", "paired", "transferring", "closed"}
+
+// States are all states, in order.
+func States() []State {
+	return []State{STATE_CREATED, STATE_WAITING, STATE_PAIRED, STATE_TRANSFERRING, STATE_CLOSED}
+}
+
+func (s State) String() string {
+	if s < 0 || int(s) >= len(stateNames) {
+		return fmt.Sprintf("State(%d)", int(s))
+	}
+
+	return stateNames[s]
+}
+
+func (s State) MarshalText() ([]byte, error) {
+	if s < 0 || int(s) >= len(stateNames) {
+		return nil, fmt.Errorf("unknown session state %d", int(s))
+	}
+
+	return []byte(stateNames[s]), nil
+}
+
+func (s *State) UnmarshalText(text []byte) error {
+	for i, name := range stateNames {
+		if name == string(text) {
+			*s = State(i)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown session state %q", text)
+}
+
+// Session is what the relay keeps about one share. The connections themselves
+// are held by the Registry.
+type Session struct {
+	PairCode string
+	State    State
+	Created  time.Time
+	// Updated is when the state last changed
+	Updated time.Time
+	// Sender is the handshake offer passed on to the receiver
+	Sender *ws.ClientInfo `json:",omitempty"`
+	// Relayed are the bytes passed between sender and receiver, and
+	// LastActivity when the last message was. They are kept in the Registry
+	// while the session is open and saved once it is closed.
+	Relayed      int64
+	LastActivity *time.Time `json:",omitempty"`
+}
+
+func newSession(pairCode string, state State, sender *ws.ClientInfo) *Session {
+	now := time.Now()
+	return &Session{
+		PairCode: pairCode,
+		State:    state,
+		Created:  now,
+		Updated:  now,
+		Sender:   sender,
+	}
+}
+
+// copy is a copy that can be handed out without holding a lock. Sender and
+// LastActivity are replaced rather than changed, so they are shared.
+func (s *Session) copy() *Session {
+	c := *s
+	return &c
+}
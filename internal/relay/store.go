@@ -0,0 +1,244 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var ErrSessionNotFound = fmt.Errorf("session not found")
+var ErrSessionExists = fmt.Errorf("pair code already in use")
+
+// SessionStore keeps the sessions of the relay. Implementations are safe for
+// concurrent use, and hand out copies so callers never share a Session.
+type SessionStore interface {
+	// Add stores a new session, ErrSessionExists if its pair code is taken.
+	Add(s *Session) error
+	// Get returns the session with the pair code, or ErrSessionNotFound.
+	Get(pairCode string) (*Session, error)
+	// Update calls fn with the session while nobody else can change it. If
+	// fn returns an error the session is left as it was.
+	Update(pairCode string, fn func(s *Session) error) error
+	// Delete removes the session, it is not an error if it doesn't exist.
+	Delete(pairCode string) error
+	// List returns all sessions, oldest first.
+	List() ([]*Session, error)
+	Close() error
+}
+
+// MemoryStore keeps the sessions in memory, they are gone after a restart.
+type MemoryStore struct {
+	m        sync.Mutex
+	sessions map[string]*Session
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{sessions: make(map[string]*Session)}
+}
+
+func (ms *MemoryStore) Add(s *Session) error {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	if _, ok := ms.sessions[s.PairCode]; ok {
+		return ErrSessionExists
+	}
+
+	ms.sessions[s.PairCode] = s.copy()
+	return nil
+}
+
+func (ms *MemoryStore) Get(pairCode string) (*Session, error) {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	s, ok := ms.sessions[pairCode]
+	if !ok {
+		return nil, ErrSessionNotFound
+	}
+
+	return s.copy(), nil
+}
+
+func (ms *MemoryStore) Update(pairCode string, fn func(s *Session) error) error {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	s, ok := ms.sessions[pairCode]
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	// changed on a copy, so an error leaves the stored one alone
+	c := s.copy()
+	err := fn(c)
+	if err != nil {
+		return err
+	}
+
+	ms.sessions[pairCode] = c
+	return nil
+}
+
+func (ms *MemoryStore) Delete(pairCode string) error {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	delete(ms.sessions, pairCode)
+	return nil
+}
+
+func (ms *MemoryStore) List() ([]*Session, error) {
+	ms.m.Lock()
+	defer ms.m.Unlock()
+
+	list := make([]*Session, 0, len(ms.sessions))
+	for _, s := range ms.sessions {
+		list = append(list, s.copy())
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+
+	return list, nil
+}
+
+func (ms *MemoryStore) Close() error {
+	return nil
+}
+
+// FileStore keeps the sessions in a json file as well, so what the relay was
+// doing can still be looked up after a restart. Connections don't survive a
+// restart, sessions that were still open are loaded as closed.
+type FileStore struct {
+	// m is held around every change and the write of the file that follows
+	m    sync.Mutex
+	mem  *MemoryStore
+	path string
+}
+
+// OpenFileStore loads the sessions from path, which doesn't have to exist yet.
+func OpenFileStore(path string) (*FileStore, error) {
+	store := &FileStore{mem: NewMemoryStore(), path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return store, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*Session
+	err = json.Unmarshal(data, &sessions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	now := time.Now()
+	for _, s := range sessions {
+		if s.State != STATE_CLOSED {
+			s.State = STATE_CLOSED
+			s.Updated = now
+		}
+
+		store.mem.sessions[s.PairCode] = s
+	}
+
+	return store, nil
+}
+
+func (f *FileStore) Add(s *Session) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	err := f.mem.Add(s)
+	if err != nil {
+		return err
+	}
+
+	return f.save()
+}
+
+func (f *FileStore) Get(pairCode string) (*Session, error) {
+	return f.mem.Get(pairCode)
+}
+
+func (f *FileStore) Update(pairCode string, fn func(s *Session) error) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	err := f.mem.Update(pairCode, fn)
+	if err != nil {
+		return err
+	}
+
+	return f.save()
+}
+
+func (f *FileStore) Delete(pairCode string) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	err := f.mem.Delete(pairCode)
+	if err != nil {
+		return err
+	}
+
+	return f.save()
+}
+
+func (f *FileStore) List() ([]*Session, error) {
+	return f.mem.List()
+}
+
+func (f *FileStore) Close() error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	return f.save()
+}
+
+// save writes the sessions to a temporary file and renames it over the old
+// one, so a crash never leaves a half written file.
+func (f *FileStore) save() error {
+	sessions, err := f.mem.List()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(sessions, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(f.path), filepath.Base(f.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), f.path)
+}
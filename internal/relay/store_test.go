@@ -0,0 +1,162 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStores(t *testing.T) map[string]SessionStore {
+	fileStore, err := OpenFileStore(filepath.Join(t.TempDir(), "sessions.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]SessionStore{
+		"memory": NewMemoryStore(),
+		"file":   fileStore,
+	}
+}
+
+func TestSessionStore(t *testing.T) {
+	for name, store := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			defer store.Close()
+
+			first := newSession("0001", STATE_WAITING, nil)
+			second := newSession("0002", STATE_WAITING, nil)
+			second.Created = first.Created.Add(time.Second)
+
+			for _, s := range []*Session{second, first} {
+				err := store.Add(s)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := store.Add(newSession("0001", STATE_WAITING, nil))
+			if !errors.Is(err, ErrSessionExists) {
+				t.Fatalf("expected ErrSessionExists, got %v", err)
+			}
+
+			// a failed update leaves the session alone
+			err = store.Update("0001", func(s *Session) error {
+				s.State = STATE_PAIRED
+				return ErrAlreadyPaired
+			})
+			if !errors.Is(err, ErrAlreadyPaired) {
+				t.Fatalf("expected the error of fn, got %v", err)
+			}
+
+			s, err := store.Get("0001")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if s.State != STATE_WAITING {
+				t.Fatalf("expected failed update to be dropped, state is %s", s.State)
+			}
+
+			// changing the copy doesn't change the store
+			s.State = STATE_CLOSED
+
+			err = store.Update("0001", func(s *Session) error {
+				if s.State != STATE_WAITING {
+					return fmt.Errorf("got state %s", s.State)
+				}
+
+				s.State = STATE_PAIRED
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			list, err := store.List()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(list) != 2 || list[0].PairCode != "0001" || list[1].PairCode != "0002" {
+				t.Fatalf("expected sessions oldest first, got %v", list)
+			}
+
+			if list[0].State != STATE_PAIRED {
+				t.Fatalf("expected updated state, got %s", list[0].State)
+			}
+
+			err = store.Delete("0001")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = store.Delete("0001")
+			if err != nil {
+				t.Fatal("deleting a missing session failed:", err)
+			}
+
+			_, err = store.Get("0001")
+			if !errors.Is(err, ErrSessionNotFound) {
+				t.Fatalf("expected ErrSessionNotFound, got %v", err)
+			}
+
+			err = store.Update("0001", func(s *Session) error { return nil })
+			if !errors.Is(err, ErrSessionNotFound) {
+				t.Fatalf("expected ErrSessionNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestFileStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+
+	store, err := OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, code := range []string{"1234", "5678"} {
+		err = store.Add(newSession(code, STATE_WAITING, nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = store.Update("5678", func(s *Session) error {
+		setState(s, STATE_TRANSFERRING)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer store.Close()
+
+	list, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list) != 2 {
+		t.Fatalf("expected 2 sessions after reopening, got %d", len(list))
+	}
+
+	for _, s := range list {
+		if s.State != STATE_CLOSED {
+			t.Fatalf("expected %s to be closed after a restart, got %s", s.PairCode, s.State)
+		}
+	}
+}
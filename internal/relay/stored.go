@@ -0,0 +1,341 @@
+package relay
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DEFAULT_STORED_TTL is how long a stored share can be downloaded.
+const DEFAULT_STORED_TTL = time.Hour * 24
+
+const (
+	STORED_DATA_SUFFIX   = ".share"
+	STORED_INFO_SUFFIX   = ".json"
+	STORED_UPLOAD_SUFFIX = ".upload"
+)
+
+var ErrTooLarge = fmt.Errorf("share too large")
+var ErrQuotaExceeded = fmt.Errorf("relay is out of space for stored shares")
+var ErrAddressQuotaExceeded = fmt.Errorf("too many stored shares from this address")
+
+// StoredShare is a share uploaded for a receiver that isn't online yet. The
+// relay only has the encrypted records, the key comes from the share code.
+type StoredShare struct {
+	ID      string
+	Size    int64
+	Created time.Time
+	Expires time.Time
+	// Addr is the address the share was uploaded from
+	Addr string
+}
+
+// StoredShares keeps uploaded shares in a directory until they expire. Every
+// share is a data file and a json file describing it.
+type StoredShares struct {
+	dir     string
+	codes   *PairCodes
+	maxSize int64
+	quota   int64
+	ttl     time.Duration
+
+	// AddressQuota is how many bytes the shares uploaded from one address
+	// may take up together, 0 for no limit besides quota
+	AddressQuota int64
+
+	m      sync.Mutex
+	shares map[string]*StoredShare
+	// used counts the stored shares and the uploads in progress, in total and
+	// per address
+	used       int64
+	usedByAddr map[string]int64
+}
+
+// OpenStoredShares keeps shares of up to maxSize bytes in dir, and no more
+// than quota bytes in total, for ttl or DEFAULT_STORED_TTL if it is 0. IDs are
+// made by codes, DefaultPairCodes if nil. Shares stored before a restart are
+// picked up again.
+func OpenStoredShares(dir string, codes *PairCodes, maxSize, quota int64, ttl time.Duration) (*StoredShares, error) {
+	if ttl == 0 {
+		ttl = DEFAULT_STORED_TTL
+	}
+
+	if codes == nil {
+		codes = DefaultPairCodes()
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &StoredShares{
+		dir:     dir,
+		codes:   codes,
+		maxSize: maxSize,
+		quota:   quota,
+		ttl:     ttl,
+		shares:  make(map[string]*StoredShare),
+
+		usedByAddr: make(map[string]int64),
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		switch {
+		case strings.HasSuffix(name, STORED_UPLOAD_SUFFIX):
+			// an upload the relay was stopped in the middle of
+			os.Remove(filepath.Join(dir, name))
+		case strings.HasSuffix(name, STORED_INFO_SUFFIX):
+			err = s.load(strings.TrimSuffix(name, STORED_INFO_SUFFIX))
+			if err != nil {
+				fmt.Println("error loading stored share:", err)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+func (s *StoredShares) load(id string) error {
+	data, err := os.ReadFile(s.infoPath(id))
+	if err != nil {
+		return err
+	}
+
+	share := &StoredShare{}
+	err = json.Unmarshal(data, share)
+	if err != nil || share.ID != id {
+		s.remove(id)
+		return fmt.Errorf("invalid info for %s", id)
+	}
+
+	info, err := os.Stat(s.dataPath(id))
+	if err != nil || info.Size() != share.Size {
+		s.remove(id)
+		return fmt.Errorf("missing data for %s", id)
+	}
+
+	s.shares[id] = share
+	s.used += share.Size
+	s.usedByAddr[share.Addr] += share.Size
+
+	return nil
+}
+
+// Store saves what r, uploaded from addr, returns until EOF. It fails with
+// ErrTooLarge, ErrQuotaExceeded or ErrAddressQuotaExceeded once there's too
+// much, and nothing is kept then.
+func (s *StoredShares) Store(addr string, r io.Reader) (*StoredShare, error) {
+	tmp, err := os.CreateTemp(s.dir, "*"+STORED_UPLOAD_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := s.copy(addr, tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	closeErr := tmp.Close()
+	if err == nil {
+		err = closeErr
+	}
+
+	share := &StoredShare{Size: size, Created: time.Now(), Addr: addr}
+	share.Expires = share.Created.Add(s.ttl)
+	if err == nil {
+		err = s.add(tmp.Name(), share)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		s.release(addr, size)
+		return nil, err
+	}
+
+	return share, nil
+}
+
+// copy writes r to w, reserving the space for it as it goes.
+func (s *StoredShares) copy(addr string, w io.Writer, r io.Reader) (int64, error) {
+	buf := make([]byte, 64*1024)
+	var size int64
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			reserveErr := s.reserve(addr, size, int64(n))
+			if reserveErr != nil {
+				return size, reserveErr
+			}
+
+			size += int64(n)
+			_, writeErr := w.Write(buf[:n])
+			if writeErr != nil {
+				return size, writeErr
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return size, nil
+		}
+
+		if err != nil {
+			return size, err
+		}
+	}
+}
+
+func (s *StoredShares) reserve(addr string, size, n int64) error {
+	if size+n > s.maxSize {
+		return fmt.Errorf("%w, at most %d bytes are kept", ErrTooLarge, s.maxSize)
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.used+n > s.quota {
+		return ErrQuotaExceeded
+	}
+
+	if s.AddressQuota > 0 && s.usedByAddr[addr]+n > s.AddressQuota {
+		return fmt.Errorf("%w, at most %d bytes are kept", ErrAddressQuotaExceeded, s.AddressQuota)
+	}
+
+	s.used += n
+	s.usedByAddr[addr] += n
+	return nil
+}
+
+func (s *StoredShares) release(addr string, n int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	s.releaseLocked(addr, n)
+}
+
+func (s *StoredShares) releaseLocked(addr string, n int64) {
+	s.used -= n
+	s.usedByAddr[addr] -= n
+	if s.usedByAddr[addr] <= 0 {
+		delete(s.usedByAddr, addr)
+	}
+}
+
+// add moves the upload at path in place under a new ID.
+func (s *StoredShares) add(path string, share *StoredShare) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for range MAX_PAIR_CODE_TRIES {
+		id, err := s.codes.New()
+		if err != nil {
+			return err
+		}
+
+		if _, ok := s.shares[id]; ok {
+			continue
+		}
+
+		share.ID = id
+		data, err := json.Marshal(share)
+		if err != nil {
+			return err
+		}
+
+		err = os.Rename(path, s.dataPath(id))
+		if err != nil {
+			return err
+		}
+
+		err = os.WriteFile(s.infoPath(id), data, 0600)
+		if err != nil {
+			os.Remove(s.dataPath(id))
+			return err
+		}
+
+		s.shares[id] = share
+		return nil
+	}
+
+	return ErrNoFreePairCode
+}
+
+// Open returns the data of the share with id, ErrSessionNotFound if there is
+// none or it expired.
+func (s *StoredShares) Open(id string) (*os.File, *StoredShare, error) {
+	if !s.codes.Valid(id) {
+		return nil, nil, ErrSessionNotFound
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	share, ok := s.shares[id]
+	if !ok || time.Now().After(share.Expires) {
+		return nil, nil, ErrSessionNotFound
+	}
+
+	f, err := os.Open(s.dataPath(id))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c := *share
+	return f, &c, nil
+}
+
+// Expire removes the shares that expired. Downloads that already started go
+// on, the file stays readable while it's open.
+func (s *StoredShares) Expire() {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	now := time.Now()
+	for id, share := range s.shares {
+		if now.After(share.Expires) {
+			s.remove(id)
+			delete(s.shares, id)
+			s.releaseLocked(share.Addr, share.Size)
+			fmt.Println("stored share expired:", id)
+		}
+	}
+}
+
+// Usage is how many shares are stored and their bytes, including uploads in
+// progress.
+func (s *StoredShares) Usage() (int, int64) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	return len(s.shares), s.used
+}
+
+func (s *StoredShares) remove(id string) {
+	for _, path := range []string{s.dataPath(id), s.infoPath(id)} {
+		err := os.Remove(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			fmt.Println("error removing stored share:", err)
+		}
+	}
+}
+
+func (s *StoredShares) dataPath(id string) string {
+	return filepath.Join(s.dir, id+STORED_DATA_SUFFIX)
+}
+
+func (s *StoredShares) infoPath(id string) string {
+	return filepath.Join(s.dir, id+STORED_INFO_SUFFIX)
+}
@@ -0,0 +1,145 @@
+package relay
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStoredShares(t *testing.T) {
+	dir := t.TempDir()
+	stored, err := OpenStoredShares(dir, nil, 100, 150, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte{42}, 80)
+	share, err := stored.Store("192.0.2.1", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = stored.Store("192.0.2.1", bytes.NewReader(bytes.Repeat([]byte{1}, 101)))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+
+	_, err = stored.Store("192.0.2.1", bytes.NewReader(data))
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected ErrQuotaExceeded, got %v", err)
+	}
+
+	count, used := stored.Usage()
+	if count != 1 || used != 80 {
+		t.Fatalf("expected failed uploads to be released, got %d shares with %d bytes", count, used)
+	}
+
+	f, info, err := stored.Open(share.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := io.ReadAll(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, data) || info.Size != 80 {
+		t.Fatal("stored data doesn't match")
+	}
+
+	_, _, err = stored.Open("22223333")
+	if !errors.Is(err, ErrSessionNotFound) {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+
+	// a restart picks up stored shares and drops unfinished uploads
+	err = os.WriteFile(filepath.Join(dir, "x"+STORED_UPLOAD_SUFFIX), data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenStoredShares(dir, nil, 100, 150, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, used = reopened.Usage()
+	if count != 1 || used != 80 {
+		t.Fatalf("expected the stored share after reopening, got %d shares with %d bytes", count, used)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "x"+STORED_UPLOAD_SUFFIX))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatal("unfinished upload was kept")
+	}
+
+	reopened.shares[share.ID].Expires = time.Now().Add(-time.Second)
+	reopened.Expire()
+
+	count, used = reopened.Usage()
+	if count != 0 || used != 0 {
+		t.Fatalf("expected expired share to be removed, got %d shares with %d bytes", count, used)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Fatalf("expected expired files to be removed, found %d", len(entries))
+	}
+}
+
+func TestStoredSharesAddressQuota(t *testing.T) {
+	dir := t.TempDir()
+	stored, err := OpenStoredShares(dir, nil, 100, 300, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored.AddressQuota = 100
+	data := bytes.Repeat([]byte{42}, 60)
+	share, err := stored.Store("192.0.2.1", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = stored.Store("192.0.2.1", bytes.NewReader(data))
+	if !errors.Is(err, ErrAddressQuotaExceeded) {
+		t.Fatalf("expected ErrAddressQuotaExceeded, got %v", err)
+	}
+
+	// other addresses still have room
+	_, err = stored.Store("192.0.2.2", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the uploader is kept across a restart
+	reopened, err := OpenStoredShares(dir, nil, 100, 300, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reopened.AddressQuota = 100
+	_, err = reopened.Store("192.0.2.1", bytes.NewReader(data))
+	if !errors.Is(err, ErrAddressQuotaExceeded) {
+		t.Fatalf("expected ErrAddressQuotaExceeded after reopening, got %v", err)
+	}
+
+	// and gets its room back once its share expired
+	reopened.shares[share.ID].Expires = time.Now().Add(-time.Second)
+	reopened.Expire()
+
+	_, err = reopened.Store("192.0.2.1", bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
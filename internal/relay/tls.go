@@ -0,0 +1,69 @@
+package relay
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Certificate is a certificate loaded from files, which can be loaded again
+// while the server keeps running, when it was renewed.
+type Certificate struct {
+	certFile string
+	keyFile  string
+	cert     atomic.Pointer[tls.Certificate]
+}
+
+// LoadCertificate loads the PEM encoded certificate chain and its key.
+func LoadCertificate(certFile string, keyFile string) (*Certificate, error) {
+	c := &Certificate{certFile: certFile, keyFile: keyFile}
+	err := c.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload loads the files again. If they can't be loaded the old certificate
+// is kept, connections are never refused over a half written file.
+func (c *Certificate) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	c.cert.Store(&cert)
+	return nil
+}
+
+// GetCertificate is used as tls.Config.GetCertificate, so new connections
+// get the certificate loaded last.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// RedirectHandler sends plain http requests to https on httpsPort, keeping
+// host, path and query. Methods and bodies are kept as well, so uploads can
+// follow it.
+func RedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			// no port, ipv6 addresses are still in brackets
+			host = strings.Trim(r.Host, "[]")
+		}
+
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,132 @@
+package relay
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertificate writes a self signed certificate for name.
+func writeCertificate(t *testing.T, certFile string, keyFile string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	_, err := LoadCertificate(certFile, keyFile)
+	if err == nil {
+		t.Fatal("expected an error for missing files")
+	}
+
+	writeCertificate(t, certFile, keyFile, "old.example.com")
+
+	cert, err := LoadCertificate(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := func() string {
+		c, err := cert.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parsed, err := x509.ParseCertificate(c.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return parsed.Subject.CommonName
+	}
+
+	// a half written renewal keeps the old certificate
+	err = os.WriteFile(certFile, []byte("-----BEGIN CERTIFICATE-----\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = cert.Reload()
+	if err == nil {
+		t.Fatal("expected an error for a broken certificate")
+	}
+
+	if name() != "old.example.com" {
+		t.Fatalf("expected the old certificate, got %s", name())
+	}
+
+	writeCertificate(t, certFile, keyFile, "new.example.com")
+
+	err = cert.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if name() != "new.example.com" {
+		t.Fatalf("expected the new certificate, got %s", name())
+	}
+}
+
+func TestRedirectHandler(t *testing.T) {
+	for _, c := range []struct {
+		port     int
+		url      string
+		expected string
+	}{
+		{443, "http://share.example.com/ws?paircode=abc", "https://share.example.com/ws?paircode=abc"},
+		{443, "http://share.example.com:80/metrics", "https://share.example.com/metrics"},
+		{8443, "http://share.example.com/store", "https://share.example.com:8443/store"},
+		{8443, "http://[::1]:8080/ws", "https://[::1]:8443/ws"},
+		{443, "http://[::1]/ws", "https://[::1]/ws"},
+	} {
+		w := httptest.NewRecorder()
+		RedirectHandler(c.port).ServeHTTP(w, httptest.NewRequest("PUT", c.url, nil))
+
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != c.expected {
+			t.Errorf("%s: expected %s, got %d %s", c.url, c.expected, w.Code, w.Header().Get("Location"))
+		}
+	}
+}
@@ -2,8 +2,10 @@ package sharephrase
 
 import (
 	"bufio"
+	"crypto/rand"
 	"embed"
-	"math/rand"
+	"encoding/binary"
+	"math/big"
 	"strconv"
 	"strings"
 )
@@ -13,6 +15,8 @@ var fs embed.FS
 
 const NUM_WORDS = 7776
 
+// GetRandomPhrase picks the words, and the number if includeNums is set, from
+// crypto/rand. Every word adds about 12.9 bits.
 func GetRandomPhrase(numWords int, includeNums bool) (string, error) {
 	allWords, err := getAllWords()
 	if err != nil {
@@ -21,25 +25,51 @@ func GetRandomPhrase(numWords int, includeNums bool) (string, error) {
 
 	builder := &strings.Builder{}
 	for range numWords {
-		_, err = builder.WriteString(getRandomWord(allWords))
+		n, err := randomInt(len(allWords))
 		if err != nil {
 			return "", err
 		}
+
+		builder.WriteString(strings.Title(strings.TrimSpace(allWords[n])))
 	}
 
 	if includeNums {
-		_, err = builder.WriteString(strconv.Itoa(rand.Intn(1000)))
+		n, err := randomInt(1000)
 		if err != nil {
 			return "", err
 		}
+
+		builder.WriteString(strconv.Itoa(n))
 	}
 
 	return builder.String(), nil
 }
 
-func getRandomWord(words []string) string {
-	word := words[rand.Int31n(int32(len(words)))]
-	return strings.Title(strings.TrimSpace(word))
+// PhraseFromBytes turns every 4 bytes of b into a word, so that both peers can
+// read out a value they derived.
+func PhraseFromBytes(b []byte) (string, error) {
+	allWords, err := getAllWords()
+	if err != nil {
+		return "", err
+	}
+
+	words := make([]string, 0, len(b)/4)
+	for i := 0; i+4 <= len(b); i += 4 {
+		word := allWords[binary.BigEndian.Uint32(b[i:])%uint32(len(allWords))]
+		words = append(words, strings.Title(strings.TrimSpace(word)))
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+// randomInt returns a uniform number in [0, max).
+func randomInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(n.Int64()), nil
 }
 
 func getAllWords() ([]string, error) {
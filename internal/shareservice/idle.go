@@ -0,0 +1,46 @@
+package shareservice
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/transfer"
+)
+
+// idleConn fails reads and writes that make no progress for timeout, so a
+// peer that vanished without closing the connection doesn't block forever.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func withIdleTimeout(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout == 0 {
+		return conn
+	}
+
+	return &idleConn{Conn: conn, timeout: timeout}
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Read(p)
+	return n, c.idleError(err)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Write(p)
+	return n, c.idleError(err)
+}
+
+func (c *idleConn) idleError(err error) error {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return fmt.Errorf("%w: nothing sent or received for %s", transfer.ErrIdleTimeout, c.timeout)
+	}
+
+	return err
+}
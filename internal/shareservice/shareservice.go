@@ -1,38 +1,54 @@
 package shareservice
 
 import (
-	"bytes"
-	"crypto/ecdh"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/int32-dev/fastshare/internal/discoverservice"
 	"github.com/int32-dev/fastshare/internal/encryptservice"
+	"github.com/int32-dev/fastshare/internal/transfer"
 )
 
-const CHUNK_SIZE = 4096
+// how long the sender waits for the receiver's extra streams
+const STREAM_TIMEOUT = 10 * time.Second
+
+// how long telling the peer about a cancel may take, before the connection is
+// closed anyway
+const CANCEL_TIMEOUT = time.Second
 
 type LocalShareService struct {
 	port      int
 	shareCode string
-	key       *ecdh.PrivateKey
+	opts      *Options
 }
 
-func NewLocalShareService(port int, shareCode string) (*LocalShareService, error) {
-	key, err := encryptservice.GenerateEcdhKeypair()
-	if err != nil {
-		return nil, err
-	}
+// Options configure one side of a share over the local network.
+type Options struct {
+	Suites encryptservice.Suites
+	// Progress is where the progress of file data is reported, can be nil
+	Progress encryptservice.ProgressReporter
+	// Status is told what the share is doing besides progress
+	Status encryptservice.Status
+	// DiscoveryTimeout limits how long the peer is looked for, 0 looks until
+	// the context is done
+	DiscoveryTimeout time.Duration
+	// IdleTimeout fails the transfer once nothing could be sent or received
+	// for that long, 0 waits forever
+	IdleTimeout time.Duration
+}
 
+// NewLocalShareService shares over the local network.
+func NewLocalShareService(port int, shareCode string, opts *Options) (*LocalShareService, error) {
 	return &LocalShareService{
 		port:      port,
 		shareCode: shareCode,
-		key:       key,
+		opts:      opts,
 	}, nil
 }
 
@@ -41,112 +57,284 @@ func getIP(addr net.Addr) string {
 	return vals[0]
 }
 
-func (s *LocalShareService) Send(r io.Reader, totalSize int64) error {
-	ds, err := discoverservice.NewDiscoveryService(s.key.PublicKey(), s.shareCode, s.port)
+// Send waits for the receiver and sends share to it. Once ctx is done the
+// share is stopped and ctx.Err() returned.
+func (s *LocalShareService) Send(ctx context.Context, share *transfer.Share) error {
+	return canceled(ctx, s.send(ctx, share))
+}
+
+func (s *LocalShareService) send(ctx context.Context, share *transfer.Share) error {
+	ds, err := discoverservice.NewDiscoveryService(s.shareCode, s.port, encryptservice.PAKE_SENDER, s.opts.Suites)
 	if err != nil {
 		return err
 	}
 
 	defer ds.Close()
+	ds.Log = s.opts.Status.Log
 
-	response, err := ds.ListenForReceiver()
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(s.port))
 	if err != nil {
 		return err
 	}
 
-	fmt.Println("Receiver found at", response.Addr)
+	defer l.Close()
+	defer context.AfterFunc(ctx, func() { l.Close() })()
+
+	discoverCtx, cancel := withTimeout(ctx, s.opts.DiscoveryTimeout)
+	defer cancel()
+
+	// the listener stays open for the receiver's streams once it was found
+	stopDiscovery := context.AfterFunc(discoverCtx, func() { l.Close() })
+	found := make(chan struct{})
+	answerErr := make(chan error, 1)
+	go func() {
+		answerErr <- ds.AnswerReceivers(discoverCtx)
+		select {
+		case <-found:
+		default:
+			l.Close()
+		}
+	}()
 
-	es, err := encryptservice.NewGcmService(s.key, response.PublicKey, s.shareCode)
+	conn, response, err := s.acceptReceiver(discoverCtx, ds, l, answerErr)
 	if err != nil {
-		return err
+		return s.discoveryError(discoverCtx, "receiver", err)
 	}
 
-	l, err := net.Listen("tcp", ":"+strconv.Itoa(s.port))
+	close(found)
+	stopDiscovery()
+	ds.Close()
+
+	defer conn.Close()
+	defer context.AfterFunc(ctx, func() { sendCancel(conn) })()
+
+	s.peerFound(response.Addr)
+
+	es, err := response.Handshake.NewService(s.shareCode)
 	if err != nil {
 		return err
 	}
 
-	defer l.Close()
+	es.SetProgressReporter(s.opts.Progress)
+	es.SetStatus(s.opts.Status)
 
-	var conn net.Conn
+	open := s.idle(closeOnDone(ctx, s.acceptStreams(l, getIP(conn.RemoteAddr()))))
+	return transfer.SendStreams(es, withIdleTimeout(conn, s.opts.IdleTimeout), open, share)
+}
 
+// acceptReceiver accepts connections until one comes from a receiver with the
+// same share code.
+func (s *LocalShareService) acceptReceiver(ctx context.Context, ds *discoverservice.DiscoverService, l net.Listener, answerErr chan error) (net.Conn, *discoverservice.DiscoverResponse, error) {
 	for {
-		conn, err = l.Accept()
+		conn, err := l.Accept()
 		if err != nil {
-			return err
+			select {
+			case answerErr := <-answerErr:
+				return nil, nil, answerErr
+			default:
+				return nil, nil, err
+			}
 		}
 
-		if getIP(response.Addr) != getIP(conn.RemoteAddr()) {
+		response, err := ds.ConfirmReceiver(ctx, conn)
+		if err != nil {
+			s.opts.Status.Logf("rejected receiver at %s: %v", conn.RemoteAddr(), err)
 			conn.Close()
 			continue
 		}
 
-		break
+		return conn, response, nil
 	}
+}
 
-	ds.Close()
+// peerFound tells the status about the peer at addr.
+func (s *LocalShareService) peerFound(addr net.Addr) {
+	if s.opts.Status.PeerFound != nil {
+		s.opts.Status.PeerFound(addr.String())
+	}
+}
 
-	defer conn.Close()
+// withTimeout is context.WithTimeout, without a timeout if it is 0.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
 
-	sizeBytes := make([]byte, 8)
-	binary.PutVarint(sizeBytes, totalSize)
+	return context.WithTimeout(ctx, timeout)
+}
 
-	_, err = conn.Write(sizeBytes)
-	if err != nil {
-		return err
+// discoveryError tells whether looking for the peer failed because it took
+// longer than the discovery timeout.
+func (s *LocalShareService) discoveryError(discoverCtx context.Context, peer string, err error) error {
+	if errors.Is(discoverCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: no %s found within %s", transfer.ErrDiscoveryTimeout, peer, s.opts.DiscoveryTimeout)
 	}
 
-	err = es.Encrypt(r, conn, totalSize)
-	if err != nil && !errors.Is(err, io.EOF) {
-		return err
+	return err
+}
+
+// idle applies the idle timeout to the streams opened by open.
+func (s *LocalShareService) idle(open transfer.StreamOpener) transfer.StreamOpener {
+	return func(n int) ([]io.ReadWriteCloser, error) {
+		conns, err := open(n)
+		if err != nil {
+			return nil, err
+		}
+
+		for i, c := range conns {
+			conns[i] = withIdleTimeout(c.(net.Conn), s.opts.IdleTimeout)
+		}
+
+		return conns, nil
+	}
+}
+
+// canceled returns the error of ctx if it ended the share, err otherwise.
+func canceled(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
 	}
 
-	return nil
+	return err
 }
 
-func (s *LocalShareService) Receive(w io.Writer) error {
-	ds, err := discoverservice.NewDiscoveryService(s.key.PublicKey(), s.shareCode, s.port)
-	if err != nil {
-		return err
+// sendCancel tells the peer that the share was canceled and closes conn. A
+// write stuck on a full connection is given up on after CANCEL_TIMEOUT, the
+// peer then just sees the connection close.
+func sendCancel(conn io.ReadWriteCloser) {
+	if c, ok := conn.(net.Conn); ok {
+		c.SetWriteDeadline(time.Now().Add(CANCEL_TIMEOUT))
 	}
 
-	defer ds.Close()
+	// every record is a single Write, which a net.Conn doesn't interleave
+	// with this one
+	conn.Write(encryptservice.CancelRecord())
+	conn.Close()
+}
 
-	response, err := ds.DiscoverSender()
-	if err != nil {
-		return err
+// closeOnDone cancels the streams opened by open once ctx is done.
+func closeOnDone(ctx context.Context, open transfer.StreamOpener) transfer.StreamOpener {
+	return func(n int) ([]io.ReadWriteCloser, error) {
+		conns, err := open(n)
+		if err != nil {
+			return nil, err
+		}
+
+		context.AfterFunc(ctx, func() {
+			for _, c := range conns {
+				sendCancel(c)
+			}
+		})
+
+		return conns, nil
 	}
+}
 
-	fmt.Println("Sender found at", response.Addr)
-	ds.Close()
+// acceptStreams returns an opener that accepts the streams of the receiver at
+// ip, connections from anywhere else are dropped.
+func (s *LocalShareService) acceptStreams(l net.Listener, ip string) transfer.StreamOpener {
+	return func(n int) ([]io.ReadWriteCloser, error) {
+		tcp, ok := l.(*net.TCPListener)
+		if ok {
+			tcp.SetDeadline(time.Now().Add(STREAM_TIMEOUT))
+		}
+
+		conns := make([]io.ReadWriteCloser, 0, n)
+		for len(conns) < n {
+			conn, err := l.Accept()
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+
+				return nil, err
+			}
+
+			if getIP(conn.RemoteAddr()) != ip {
+				s.opts.Status.Logf("rejected stream from %s", conn.RemoteAddr())
+				conn.Close()
+				continue
+			}
+
+			conns = append(conns, conn)
+		}
 
-	es, err := encryptservice.NewGcmService(s.key, response.PublicKey, s.shareCode)
+		return conns, nil
+	}
+}
+
+// dialStreams returns an opener that connects the streams to the sender.
+func dialStreams(ctx context.Context, addr string) transfer.StreamOpener {
+	return func(n int) ([]io.ReadWriteCloser, error) {
+		dialer := &net.Dialer{}
+		conns := make([]io.ReadWriteCloser, 0, n)
+		for range n {
+			conn, err := dialer.DialContext(ctx, "tcp", addr)
+			if err != nil {
+				for _, c := range conns {
+					c.Close()
+				}
+
+				return nil, err
+			}
+
+			conns = append(conns, conn)
+		}
+
+		return conns, nil
+	}
+}
+
+// Receive looks for the sender and writes what it sends to sink. Once ctx is
+// done the share is stopped and ctx.Err() returned.
+func (s *LocalShareService) Receive(ctx context.Context, sink transfer.Sink) error {
+	return canceled(ctx, s.receive(ctx, sink))
+}
+
+func (s *LocalShareService) receive(ctx context.Context, sink transfer.Sink) error {
+	ds, err := discoverservice.NewDiscoveryService(s.shareCode, s.port, encryptservice.PAKE_RECEIVER, s.opts.Suites)
 	if err != nil {
 		return err
 	}
 
-	conn, err := net.Dial("tcp", getIP(response.Addr)+":"+strconv.Itoa(s.port))
+	defer ds.Close()
+	ds.Log = s.opts.Status.Log
+
+	discoverCtx, cancel := withTimeout(ctx, s.opts.DiscoveryTimeout)
+	defer cancel()
+
+	response, err := ds.DiscoverSender(discoverCtx)
 	if err != nil {
-		return err
+		return s.discoveryError(discoverCtx, "sender", err)
 	}
 
-	defer conn.Close()
+	s.peerFound(response.Addr)
+	ds.Close()
 
-	sizeBytes := make([]byte, 8)
-	_, err = io.ReadFull(conn, sizeBytes)
+	es, err := response.Handshake.NewService(s.shareCode)
 	if err != nil {
 		return err
 	}
 
-	totalSize, err := binary.ReadVarint(bytes.NewReader(sizeBytes))
+	es.SetProgressReporter(s.opts.Progress)
+	es.SetStatus(s.opts.Status)
+
+	addr := getIP(response.Addr) + ":" + strconv.Itoa(s.port)
+	dialer := &net.Dialer{}
+	tcp, err := dialer.DialContext(discoverCtx, "tcp", addr)
 	if err != nil {
-		return err
+		return s.discoveryError(discoverCtx, "sender", err)
 	}
 
-	err = es.Decrypt(conn, w, totalSize)
+	defer tcp.Close()
+	defer context.AfterFunc(ctx, func() { sendCancel(tcp) })()
+
+	conn := withIdleTimeout(tcp, s.opts.IdleTimeout)
+	_, err = conn.Write(response.Handshake.Confirmation())
 	if err != nil {
 		return err
 	}
 
-	return nil
+	open := s.idle(closeOnDone(ctx, dialStreams(ctx, addr)))
+	return transfer.ReceiveStreams(es, conn, open, sink)
 }
@@ -0,0 +1,80 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Overwrite decides what happens to an entry whose target already exists.
+type Overwrite int
+
+const (
+	// OVERWRITE_REFUSE fails the transfer before anything is received
+	OVERWRITE_REFUSE Overwrite = iota
+	// OVERWRITE_REPLACE replaces the existing file or directory once the new
+	// one was received and verified
+	OVERWRITE_REPLACE
+	// OVERWRITE_RENAME numbers the new one, like "report (1).pdf"
+	OVERWRITE_RENAME
+)
+
+var ErrFileExists = fmt.Errorf("file already exists")
+
+// tried before giving up on finding a free name
+const MAX_RENAMES = 1000
+
+// TargetPath returns the path an entry meant for path is written to. taken are
+// paths already handed out to other entries of the share, they count as
+// existing.
+func TargetPath(path string, overwrite Overwrite, taken map[string]bool) (string, error) {
+	exists, err := pathExists(path, taken)
+	if err != nil || !exists {
+		return path, err
+	}
+
+	switch overwrite {
+	case OVERWRITE_REPLACE:
+		return path, nil
+	case OVERWRITE_RENAME:
+		for i := 1; i <= MAX_RENAMES; i++ {
+			renamed := numberedPath(path, i)
+			exists, err = pathExists(renamed, taken)
+			if err != nil || !exists {
+				return renamed, err
+			}
+		}
+
+		return "", fmt.Errorf("%w: no free name for %s", ErrFileExists, path)
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrFileExists, path)
+}
+
+// pathExists doesn't follow symlinks, a dangling one is still in the way.
+func pathExists(path string, taken map[string]bool) (bool, error) {
+	if taken[path] {
+		return true, nil
+	}
+
+	_, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// numberedPath puts i in front of the extension, dot files keep their name.
+func numberedPath(path string, i int) string {
+	dir, name := filepath.Split(path)
+	ext := filepath.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+
+	return filepath.Join(dir, fmt.Sprintf("%s (%d)%s", strings.TrimSuffix(name, ext), i, ext))
+}
@@ -0,0 +1,99 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTargetPath(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"report.pdf", "report (1).pdf", ".bashrc"} {
+		err := os.WriteFile(filepath.Join(dir, name), nil, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	taken := map[string]bool{filepath.Join(dir, "report (2).pdf"): true}
+
+	for _, tt := range []struct {
+		name      string
+		overwrite Overwrite
+		want      string
+	}{
+		{"new.txt", OVERWRITE_REFUSE, "new.txt"},
+		{"report.pdf", OVERWRITE_REPLACE, "report.pdf"},
+		{"report.pdf", OVERWRITE_RENAME, "report (3).pdf"},
+		{".bashrc", OVERWRITE_RENAME, ".bashrc (1)"},
+	} {
+		got, err := TargetPath(filepath.Join(dir, tt.name), tt.overwrite, taken)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != filepath.Join(dir, tt.want) {
+			t.Errorf("%s: got %s, expected %s", tt.name, got, tt.want)
+		}
+	}
+
+	_, err := TargetPath(filepath.Join(dir, "report.pdf"), OVERWRITE_REFUSE, nil)
+	if !errors.Is(err, ErrFileExists) {
+		t.Error("existing file not refused:", err)
+	}
+}
+
+func TestCloseReplacesExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	err := os.WriteFile(path, []byte("a much longer old file"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("new")
+	info := &FileInfo{Name: "file.txt", Size: int64(len(content)), Mode: 0600}
+
+	w, err := OpenPartial(path, info, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(content)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, []byte("a much longer old file")) {
+		t.Error("old file changed before the new one was complete")
+	}
+
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %q, expected %q", got, content)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stat.Mode().Perm() != 0600 {
+		t.Errorf("mode %v, expected 0600", stat.Mode().Perm())
+	}
+}
@@ -0,0 +1,336 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+)
+
+// PartialState is stored next to a file that is being received, so that an
+// interrupted transfer can be resumed by running it again with the same share
+// code.
+type PartialState struct {
+	ID    string
+	Chunk int64  // number of complete chunks written to the file
+	Hash  []byte // sha256 of the first Chunk chunks
+}
+
+// A file is received into path + PARTIAL_SUFFIX and only renamed to path once
+// it was verified, its PartialState is kept in path + STATE_SUFFIX.
+const PARTIAL_SUFFIX = ".fastshare-partial"
+const STATE_SUFFIX = ".fastshare-state"
+
+// bytes written between saving the partial state
+const CHECKPOINT_SIZE = encryptservice.CHUNK_SIZE * 4096
+
+// FileID identifies a file across runs of the sender, it changes whenever the
+// file is modified.
+func FileID(name string, size int64, modTime time.Time) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%d", name, size, modTime.UnixNano())
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func loadPartialState(path string) (*PartialState, error) {
+	data, err := os.ReadFile(path + STATE_SUFFIX)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &PartialState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+func savePartialState(path string, state *PartialState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path+STATE_SUFFIX, data, 0644)
+}
+
+// ResumePoint checks whether the partial file of path holds the verified
+// beginning of info from an earlier, interrupted transfer. It returns the number of bytes that can be
+// kept and a hash of them that the new transfer continues from.
+func ResumePoint(path string, info *FileInfo) (int64, hash.Hash, error) {
+	h := sha256.New()
+	if info.ID == "" {
+		return 0, h, nil
+	}
+
+	state, err := loadPartialState(path)
+	if err != nil {
+		// nothing to resume, or the state is unreadable and we start over
+		return 0, h, nil
+	}
+
+	offset := state.Chunk * encryptservice.CHUNK_SIZE
+	if state.ID != info.ID || offset <= 0 || offset > info.Size {
+		return 0, h, nil
+	}
+
+	file, err := os.Open(path + PARTIAL_SUFFIX)
+	if err != nil {
+		return 0, sha256.New(), nil
+	}
+
+	defer file.Close()
+
+	_, err = io.CopyN(h, file, offset)
+	if err != nil || !bytes.Equal(h.Sum(nil), state.Hash) {
+		// file was changed or truncated since, start over
+		return 0, sha256.New(), nil
+	}
+
+	return offset, h, nil
+}
+
+type partialFile struct {
+	m        sync.Mutex
+	path     string
+	id       string
+	mode     fs.FileMode
+	modTime  time.Time
+	file     *os.File
+	hash     hash.Hash
+	written  int64
+	lastSave int64
+	// chunks written with WriteAt past written, by offset
+	pending map[int64]int64
+}
+
+// OpenPartial opens the partial file of path for writing info from offset on.
+// h must hold the hash of the first offset bytes, as returned by ResumePoint.
+// Progress is saved regularly so the transfer can be resumed if it is
+// interrupted. Once the file has been received and verified it is synced, the
+// sender's mode and modification time are applied, and it is renamed to path,
+// replacing whatever was there. Until then path is left alone.
+//
+// The file can also be written out of order with WriteAt, for files striped
+// across several streams.
+func OpenPartial(path string, info *FileInfo, offset int64, h hash.Hash) (StripeWriter, error) {
+	if offset == 0 {
+		h = sha256.New()
+	}
+
+	perm := info.Mode.Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+
+	// only gets its permissions once it is complete, a read only file
+	// couldn't be resumed
+	file, err := os.OpenFile(path+PARTIAL_SUFFIX, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	err = file.Truncate(offset)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return &partialFile{
+		path:     path,
+		id:       info.ID,
+		mode:     perm,
+		modTime:  info.ModTime,
+		file:     file,
+		hash:     h,
+		written:  offset,
+		lastSave: offset,
+	}, nil
+}
+
+func (p *partialFile) Write(b []byte) (int, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	n, err := p.file.Write(b)
+	p.hash.Write(b[:n])
+	p.written += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if p.written-p.lastSave >= CHECKPOINT_SIZE {
+		err = p.checkpoint()
+	}
+
+	return n, err
+}
+
+// WriteAt writes a chunk that may arrive before the ones in front of it. The
+// hash and the saved progress only cover the file up to the first gap, so
+// chunks are read back for hashing once everything before them is there.
+// They are usually still in the page cache by then.
+func (p *partialFile) WriteAt(b []byte, off int64) (int, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	if off < p.written || p.pending[off] != 0 {
+		return 0, fmt.Errorf("chunk at %d written twice", off)
+	}
+
+	n, err := p.file.WriteAt(b, off)
+	if err != nil {
+		return n, err
+	}
+
+	if p.pending == nil {
+		p.pending = make(map[int64]int64)
+	}
+
+	p.pending[off] = int64(n)
+
+	for {
+		size, ok := p.pending[p.written]
+		if !ok {
+			return n, nil
+		}
+
+		_, err = io.Copy(p.hash, io.NewSectionReader(p.file, p.written, size))
+		if err != nil {
+			return n, err
+		}
+
+		delete(p.pending, p.written)
+		p.written += size
+
+		if p.written-p.lastSave >= CHECKPOINT_SIZE {
+			err = p.checkpoint()
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+}
+
+// Sha256 returns the hash of the file up to the first chunk that is missing.
+func (p *partialFile) Sha256() []byte {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	return p.hash.Sum(nil)
+}
+
+func (p *partialFile) checkpoint() error {
+	if p.id == "" || p.written%encryptservice.CHUNK_SIZE != 0 {
+		return nil
+	}
+
+	// the data has to be on disk before the state claims it is
+	err := p.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	p.lastSave = p.written
+
+	return savePartialState(p.path, &PartialState{
+		ID:    p.id,
+		Chunk: p.written / encryptservice.CHUNK_SIZE,
+		Hash:  p.hash.Sum(nil),
+	})
+}
+
+// Close is called once the whole file was received and verified.
+func (p *partialFile) Close() error {
+	// the data has to be on disk before it replaces the old file
+	err := p.file.Sync()
+	if err != nil {
+		p.file.Close()
+		return err
+	}
+
+	err = p.file.Close()
+	if err != nil {
+		return err
+	}
+
+	tmp := p.path + PARTIAL_SUFFIX
+	err = os.Chmod(tmp, p.mode)
+	if err != nil {
+		return err
+	}
+
+	if !p.modTime.IsZero() {
+		err = os.Chtimes(tmp, p.modTime, p.modTime)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Rename(tmp, p.path)
+	if err != nil {
+		return err
+	}
+
+	return removeIfExists(p.path + STATE_SUFFIX)
+}
+
+// Abort keeps what was written so far for resuming. The partial file is
+// removed if the data turned out to be corrupt, or if nothing of it can be
+// resumed. Either way path itself is never touched, so an interrupted transfer
+// doesn't leave a truncated file behind or destroy the one it would replace.
+func (p *partialFile) Abort(err error) error {
+	if errors.Is(err, ErrDigestMismatch) {
+		return p.remove()
+	}
+
+	err = p.checkpoint()
+	if err != nil {
+		p.file.Close()
+		return err
+	}
+
+	if p.id == "" || p.lastSave == 0 {
+		return p.remove()
+	}
+
+	return p.file.Close()
+}
+
+func (p *partialFile) remove() error {
+	p.file.Close()
+
+	err := removeIfExists(p.path + STATE_SUFFIX)
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(p.path + PARTIAL_SUFFIX)
+}
+
+func removeIfExists(path string) error {
+	err := os.Remove(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
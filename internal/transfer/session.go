@@ -0,0 +1,193 @@
+package transfer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+)
+
+// SessionPeer drives one side of a session. Once the first share was sent,
+// the channel stays open and the two sides take turns: whoever has the turn
+// sends a share or passes the turn on, and after a share the turn goes to the
+// side that received it. Both directions share the nonce of the channel, so
+// only one side can send at a time.
+type SessionPeer interface {
+	// Next is called whenever it's this side's turn. It returns the share to
+	// send next, nil to let the other side go next, or ErrSessionEnded to
+	// close the session. Shares are sent over a single connection and
+	// without asking for the verification code again.
+	Next() (*Share, error)
+	// Incoming returns the sink a share of the other side is written to.
+	Incoming() Sink
+}
+
+// SessionSink is implemented by sinks that want to go on with a session if
+// the sender offers one. Session returns nil to decline.
+type SessionSink interface {
+	Sink
+	Session() SessionPeer
+}
+
+// ErrSessionEnded is returned by SessionPeer.Next to close the session.
+var ErrSessionEnded = fmt.Errorf("session ended")
+
+// KEEPALIVE_INTERVAL is how often the side that has the turn tells the other
+// one it's still there, so waiting doesn't run into the idle timeout.
+const KEEPALIVE_INTERVAL = 30 * time.Second
+
+const (
+	SESSION_KEEPALIVE = "keepalive"
+	SESSION_SEND      = "send"
+	SESSION_PASS      = "pass"
+	SESSION_END       = "end"
+)
+
+// sessionMessage is sent by the side that has the turn.
+type sessionMessage struct {
+	Action string
+}
+
+// rejection is returned by receiveShare once the sender was told the share
+// was rejected. Both sides are still in step, so a session goes on.
+type rejection struct {
+	err error
+}
+
+func (r *rejection) Error() string {
+	return r.err.Error()
+}
+
+func (r *rejection) Unwrap() error {
+	return r.err
+}
+
+// runSession takes turns with the other side until one of them ends the
+// session.
+func runSession(gs *encryptservice.GcmService, rw io.ReadWriter, peer SessionPeer, ourTurn bool) error {
+	gs.Logf("session started")
+
+	for {
+		var err error
+		if ourTurn {
+			ourTurn, err = sessionTurn(gs, rw, peer)
+		} else {
+			ourTurn, err = awaitTurn(gs, rw, peer)
+		}
+
+		if errors.Is(err, ErrSessionEnded) {
+			gs.Logf("session ended")
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sessionTurn asks peer what to do and does it. It returns whether the turn
+// stays with us.
+func sessionTurn(gs *encryptservice.GcmService, rw io.ReadWriter, peer SessionPeer) (bool, error) {
+	share, err := nextShare(gs, rw, peer)
+	if errors.Is(err, ErrSessionEnded) {
+		return false, errors.Join(writeJson(gs, rw, &sessionMessage{Action: SESSION_END}), err)
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	if share == nil {
+		return false, writeJson(gs, rw, &sessionMessage{Action: SESSION_PASS})
+	}
+
+	err = writeJson(gs, rw, &sessionMessage{Action: SESSION_SEND})
+	if err != nil {
+		return false, err
+	}
+
+	_, err = sendShare(gs, rw, nil, share)
+	if errors.Is(err, ErrRejected) {
+		gs.Logf("%v", err)
+		return false, nil
+	}
+
+	return false, err
+}
+
+// nextShare calls peer.Next, and sends keepalives while it waits for the
+// user.
+func nextShare(gs *encryptservice.GcmService, rw io.ReadWriter, peer SessionPeer) (*Share, error) {
+	done := make(chan struct{})
+	var keepaliveErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		ticker := time.NewTicker(KEEPALIVE_INTERVAL)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				keepaliveErr = writeJson(gs, rw, &sessionMessage{Action: SESSION_KEEPALIVE})
+				if keepaliveErr != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	share, err := peer.Next()
+	close(done)
+	wg.Wait()
+
+	if keepaliveErr != nil {
+		return nil, keepaliveErr
+	}
+
+	return share, err
+}
+
+// awaitTurn waits for the other side, and receives what it sends. It returns
+// whether we have the turn now.
+func awaitTurn(gs *encryptservice.GcmService, rw io.ReadWriter, peer SessionPeer) (bool, error) {
+	gs.Logf("waiting for the other side...")
+
+	for {
+		msg := &sessionMessage{}
+		err := readJson(gs, rw, msg)
+		if err != nil {
+			return false, err
+		}
+
+		switch msg.Action {
+		case SESSION_KEEPALIVE:
+			continue
+		case SESSION_PASS:
+			return true, nil
+		case SESSION_END:
+			return false, ErrSessionEnded
+		case SESSION_SEND:
+			_, err = receiveShare(gs, rw, nil, peer.Incoming(), false)
+
+			var r *rejection
+			if errors.As(err, &r) {
+				gs.Logf("share rejected: %v", r)
+				return true, nil
+			}
+
+			return true, err
+		}
+
+		return false, fmt.Errorf("unknown session action %q", msg.Action)
+	}
+}
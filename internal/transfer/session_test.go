@@ -0,0 +1,119 @@
+package transfer
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// scriptedPeer sends its shares in order, passing the turn after each one,
+// and ends the session once it has nothing left.
+type scriptedPeer struct {
+	shares []*Share
+	// passes is how often it lets the other side go first
+	passes int
+	sink   *memorySink
+}
+
+func (p *scriptedPeer) Next() (*Share, error) {
+	if p.passes > 0 {
+		p.passes--
+		return nil, nil
+	}
+
+	if len(p.shares) == 0 {
+		return nil, ErrSessionEnded
+	}
+
+	share := p.shares[0]
+	p.shares = p.shares[1:]
+	return share, nil
+}
+
+func (p *scriptedPeer) Incoming() Sink {
+	return p.sink
+}
+
+type sessionSink struct {
+	*memorySink
+	peer SessionPeer
+}
+
+func (s *sessionSink) Session() SessionPeer {
+	return s.peer
+}
+
+func textShare(name, content string) *Share {
+	return &Share{Sources: []*Source{{
+		FileInfo: FileInfo{Name: name, Size: int64(len(content))},
+		Reader:   bytes.NewBufferString(content),
+	}}}
+}
+
+func TestSession(t *testing.T) {
+	sender, receiver := newServicePair(t)
+
+	senderPeer := &scriptedPeer{
+		shares: []*Share{textShare("second.txt", "from the sender again")},
+		sink:   &memorySink{files: make(map[string]*bytes.Buffer)},
+	}
+
+	// the receiver replies, lets the sender go, and ends the session once
+	// the sender is done
+	receiverPeer := &scriptedPeer{
+		shares: []*Share{textShare("reply.txt", "from the receiver")},
+		sink:   &memorySink{files: make(map[string]*bytes.Buffer)},
+	}
+
+	share := textShare("first.txt", "from the sender")
+	share.Session = senderPeer
+
+	sink := &sessionSink{memorySink: &memorySink{files: make(map[string]*bytes.Buffer)}, peer: receiverPeer}
+
+	c1, c2 := net.Pipe()
+	sendErr := make(chan error, 1)
+	go func() {
+		err := Send(sender, c1, share)
+		c1.Close()
+		sendErr <- err
+	}()
+
+	err := Receive(receiver, c2, sink)
+	c2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = <-sendErr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		sink *memorySink
+		name string
+		want string
+	}{
+		{sink.memorySink, "first.txt", "from the sender"},
+		{senderPeer.sink, "reply.txt", "from the receiver"},
+		{receiverPeer.sink, "second.txt", "from the sender again"},
+	} {
+		got := tt.sink.files[tt.name]
+		if got == nil || got.String() != tt.want {
+			t.Errorf("%s is %q, expected %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSessionDeclined(t *testing.T) {
+	sender, receiver := newServicePair(t)
+
+	share := textShare("first.txt", "hi")
+	share.Session = &scriptedPeer{sink: &memorySink{files: make(map[string]*bytes.Buffer)}}
+
+	// a sink that isn't a SessionSink closes the channel after the share
+	sendErr, receiveErr := run(sender, receiver, share, &memorySink{files: make(map[string]*bytes.Buffer)}, -1)
+	if sendErr != nil || receiveErr != nil {
+		t.Fatal(sendErr, receiveErr)
+	}
+}
@@ -0,0 +1,122 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+)
+
+// SendStored writes share to w for a relay that keeps it until the receiver
+// downloads it. Nobody answers, so nothing is resumed, striped or verified,
+// and the sender picks the compression.
+func SendStored(gs *encryptservice.GcmService, w io.Writer, share *Share) error {
+	if share.ChunkSize != 0 {
+		err := gs.SetChunkSize(share.ChunkSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	compressions := share.Compressions
+	if compressions == nil {
+		compressions = encryptservice.DefaultCompressions()
+	}
+
+	compression := encryptservice.ChooseCompression(compressions, encryptservice.DefaultCompressions())
+	manifest := &Manifest{
+		Version:      MANIFEST_VERSION,
+		Note:         share.Note,
+		ChunkSize:    gs.ChunkSize(),
+		Compressions: []string{compression},
+	}
+
+	var err error
+	manifest.Files, err = manifestFiles(share.Sources)
+	if err != nil {
+		return err
+	}
+
+	err = writeJson(gs, w, manifest)
+	if err != nil {
+		return err
+	}
+
+	err = useCompression(gs, compression)
+	if err != nil {
+		return err
+	}
+
+	for i, src := range share.Sources {
+		printEntry(gs, "storing", i, len(share.Sources), &src.FileInfo)
+
+		h := sha256.New()
+		gs.SetProgressName(entryName(&src.FileInfo))
+		err = gs.Encrypt(io.TeeReader(src.Reader, h), w, src.Size)
+		if err != nil {
+			return err
+		}
+
+		digest := h.Sum(nil)
+		err = writeJson(gs, w, &trailer{Sha256: digest})
+		if err != nil {
+			return err
+		}
+
+		gs.Logf("sha256: %x", digest)
+	}
+
+	return nil
+}
+
+// ReceiveStored reads a share written by SendStored and writes every entry to
+// sink. An AcceptSink can still reject it, before any data is read.
+func ReceiveStored(gs *encryptservice.GcmService, r io.Reader, sink Sink) error {
+	manifest := &Manifest{}
+	err := readJson(gs, r, manifest)
+	if errors.Is(err, encryptservice.ErrDecrypt) {
+		// the key comes from the share code alone
+		return encryptservice.ErrWrongShareCode
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	err = checkManifest(gs, manifest)
+	if err != nil {
+		return err
+	}
+
+	if manifest.Streams != 0 || manifest.Session || len(manifest.Compressions) > 1 {
+		return fmt.Errorf("stored share asks for answers nobody can give")
+	}
+
+	err = accept(sink, manifest)
+	if err != nil {
+		return err
+	}
+
+	compression := encryptservice.COMPRESSION_NONE
+	if len(manifest.Compressions) == 1 {
+		compression = manifest.Compressions[0]
+	}
+
+	err = useCompression(gs, compression)
+	if err != nil {
+		return err
+	}
+
+	for i, info := range manifest.Files {
+		printEntry(gs, "receiving", i, len(manifest.Files), info)
+
+		err = receiveEntry(gs, r, nil, info, 0, sha256.New(), sink)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
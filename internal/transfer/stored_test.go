@@ -0,0 +1,95 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+)
+
+func newStoredServices(t *testing.T, senderCode, receiverCode string) (*encryptservice.GcmService, *encryptservice.GcmService) {
+	suites := encryptservice.DefaultSuites()
+	key, err := encryptservice.NewPasswordKey(suites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := key.NewService(senderCode, suites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := key.NewService(receiverCode, suites)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sender, receiver
+}
+
+func TestSendReceiveStored(t *testing.T) {
+	sender, receiver := newStoredServices(t, TEST_DISCOVER_PHRASE, TEST_DISCOVER_PHRASE)
+
+	data := bytes.Repeat([]byte("compressible line\n"), encryptservice.CHUNK_SIZE)
+	sources := []*Source{
+		{FileInfo: FileInfo{Size: 5, MimeType: MESSAGE_MIME_TYPE}, Reader: bytes.NewReader([]byte("hello"))},
+		{FileInfo: FileInfo{Name: "a.log", Size: int64(len(data))}, Reader: bytes.NewReader(data)},
+		{FileInfo: FileInfo{Name: "stdin", Size: encryptservice.UNKNOWN_SIZE}, Reader: bytes.NewReader([]byte("piped"))},
+	}
+
+	stored := &bytes.Buffer{}
+	err := SendStored(sender, stored, &Share{Sources: sources, Note: "for later"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stored.Len() >= len(data) {
+		t.Errorf("expected the stored share to be compressed, it has %d bytes", stored.Len())
+	}
+
+	sink := &memorySink{files: make(map[string]*bytes.Buffer)}
+	err = ReceiveStored(receiver, stored, sink)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sink.manifest.Note != "for later" {
+		t.Errorf("note %q not received", sink.manifest.Note)
+	}
+
+	if sink.files[""].String() != "hello" || !bytes.Equal(sink.files["a.log"].Bytes(), data) || sink.files["stdin"].String() != "piped" {
+		t.Error("content mismatch")
+	}
+}
+
+func TestReceiveStoredErrors(t *testing.T) {
+	share := func() *Share {
+		return &Share{Sources: []*Source{{FileInfo: FileInfo{Name: "a.txt", Size: 1}, Reader: bytes.NewReader([]byte{1})}}}
+	}
+
+	sender, receiver := newStoredServices(t, TEST_DISCOVER_PHRASE, TEST_DISCOVER_PHRASE+"x")
+	stored := &bytes.Buffer{}
+	err := SendStored(sender, stored, share())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ReceiveStored(receiver, stored, &memorySink{files: make(map[string]*bytes.Buffer)})
+	if !errors.Is(err, encryptservice.ErrWrongShareCode) {
+		t.Fatalf("expected ErrWrongShareCode, got %v", err)
+	}
+
+	sender, receiver = newStoredServices(t, TEST_DISCOVER_PHRASE, TEST_DISCOVER_PHRASE)
+	stored.Reset()
+	err = SendStored(sender, stored, share())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &acceptingSink{memorySink: &memorySink{files: make(map[string]*bytes.Buffer)}}
+	err = ReceiveStored(receiver, stored, sink)
+	if !errors.Is(err, ErrRejected) || len(sink.files) != 0 {
+		t.Fatalf("expected the share to be rejected before any entry was opened, got %v", err)
+	}
+}
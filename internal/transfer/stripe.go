@@ -0,0 +1,443 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+)
+
+// Over links with a high round trip time a single TCP connection rarely fills
+// the pipe. When the transport supports it, the receiver opens extra
+// connections, called streams, and regular files of at least STRIPE_MIN_SIZE
+// are striped across them chunk by chunk. Every chunk carries its offset in
+// the file, and the receiver writes it there with WriteAt. Everything else,
+// and the trailers of striped files, still go over the first connection.
+const STRIPE_MIN_SIZE = 4 * 1024 * 1024
+
+// MAX_STREAMS is the most streams a receiver opens, AUTO_STREAMS how many are
+// opened when the sender tunes the number itself.
+const MAX_STREAMS = 64
+const AUTO_STREAMS = 8
+
+// With automatic tuning the sender starts sending on one stream and adds
+// another one every STRIPE_TUNE_INTERVAL, as long as that made the throughput
+// grow by at least STRIPE_TUNE_GAIN.
+const STRIPE_TUNE_INTERVAL = time.Second
+const STRIPE_TUNE_GAIN = 1.1
+
+// sent by the receiver on every stream after its index, to prove it has the key
+const STREAM_HELLO = "fastshare stream"
+
+var ErrInvalidStream = fmt.Errorf("invalid stream")
+
+// StreamOpener opens n extra connections to the peer. The receiver dials them,
+// the sender accepts them.
+type StreamOpener func(n int) ([]io.ReadWriteCloser, error)
+
+// StripeWriter receives a file whose chunks arrive out of order.
+type StripeWriter interface {
+	EntryWriter
+	io.WriterAt
+	// Sha256 is the hash of the whole file once every chunk was written.
+	Sha256() []byte
+}
+
+// StripeSink is implemented by sinks that can receive files striped across
+// several streams. Without one the receiver doesn't open any.
+type StripeSink interface {
+	Sink
+	// OpenStripe is called instead of Open for the files that are striped.
+	OpenStripe(info *FileInfo, offset int64) (StripeWriter, error)
+}
+
+type stream struct {
+	conn io.ReadWriteCloser
+	gs   *encryptservice.GcmService
+}
+
+// striped decides, on both ends, which entries go over the streams.
+func striped(streams []*stream, info *FileInfo, offset int64) bool {
+	return len(streams) > 0 && !info.IsMessage() && !info.Mode.IsDir() && info.Size-offset >= STRIPE_MIN_SIZE
+}
+
+func closeStreams(streams []*stream) {
+	for _, s := range streams {
+		if s != nil {
+			s.conn.Close()
+		}
+	}
+}
+
+func closeConns(conns []io.ReadWriteCloser) {
+	for _, conn := range conns {
+		conn.Close()
+	}
+}
+
+// dialStreams opens n streams and authenticates them to the sender.
+func dialStreams(gs *encryptservice.GcmService, open StreamOpener, n int) ([]*stream, error) {
+	conns, err := open(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(conns) != n {
+		closeConns(conns)
+		return nil, fmt.Errorf("expected %d streams, got %d", n, len(conns))
+	}
+
+	streams := make([]*stream, n)
+	for i, conn := range conns {
+		streams[i] = &stream{conn: conn}
+		streams[i].gs, err = gs.Stream(i)
+		if err != nil {
+			closeConns(conns)
+			return nil, err
+		}
+
+		_, err = conn.Write([]byte{byte(i)})
+		if err == nil {
+			err = streams[i].gs.WriteMessage(conn, []byte(STREAM_HELLO))
+		}
+
+		if err != nil {
+			closeConns(conns)
+			return nil, err
+		}
+	}
+
+	return streams, nil
+}
+
+// acceptStreams accepts the n streams of the receiver, in whatever order they
+// connect, and checks that they were opened with the session key.
+func acceptStreams(gs *encryptservice.GcmService, open StreamOpener, n int) ([]*stream, error) {
+	conns, err := open(n)
+	if err != nil {
+		return nil, err
+	}
+
+	streams := make([]*stream, n)
+	for _, conn := range conns {
+		err = acceptStream(gs, conn, streams)
+		if err != nil {
+			closeConns(conns)
+			return nil, err
+		}
+	}
+
+	for _, s := range streams {
+		if s == nil {
+			closeConns(conns)
+			return nil, fmt.Errorf("%w: expected %d streams", ErrInvalidStream, n)
+		}
+	}
+
+	return streams, nil
+}
+
+func acceptStream(gs *encryptservice.GcmService, conn io.ReadWriteCloser, streams []*stream) error {
+	index := make([]byte, 1)
+	_, err := io.ReadFull(conn, index)
+	if err != nil {
+		return err
+	}
+
+	i := int(index[0])
+	if i >= len(streams) || streams[i] != nil {
+		return fmt.Errorf("%w: unexpected index %d", ErrInvalidStream, i)
+	}
+
+	s, err := gs.Stream(i)
+	if err != nil {
+		return err
+	}
+
+	hello, err := s.ReadMessage(conn)
+	if err != nil || string(hello) != STREAM_HELLO {
+		return fmt.Errorf("%w: stream %d not authenticated", ErrInvalidStream, i)
+	}
+
+	streams[i] = &stream{conn: conn, gs: s}
+	return nil
+}
+
+type stripeChunk struct {
+	offset int64
+	data   []byte
+}
+
+// stripeSender sends files over the streams. Streams are started in order and
+// stay started for the rest of the session.
+type stripeSender struct {
+	streams   []*stream
+	chunkSize int
+	started   []chan struct{}
+	active    int
+	// auto is cleared once adding streams stopped helping
+	auto bool
+	rate float64
+}
+
+func newStripeSender(streams []*stream, chunkSize int, auto bool) *stripeSender {
+	s := &stripeSender{
+		streams:   streams,
+		chunkSize: chunkSize,
+		started:   make([]chan struct{}, len(streams)),
+		auto:      auto,
+	}
+
+	for i := range s.started {
+		s.started[i] = make(chan struct{})
+	}
+
+	if auto {
+		s.start(1)
+	} else {
+		s.start(len(streams))
+	}
+
+	return s
+}
+
+func (s *stripeSender) start(n int) {
+	for ; s.active < n; s.active++ {
+		close(s.started[s.active])
+	}
+}
+
+// send reads size bytes of a file from r and stripes them over the streams,
+// the first one at offset. Every stream ends the file with EndChunks, also the
+// ones that weren't started yet.
+func (s *stripeSender) send(r io.Reader, offset, size int64, progress *encryptservice.StreamProgress) error {
+	chunks := make(chan stripeChunk)
+	free := make(chan []byte, 2*len(s.streams))
+	for range cap(free) {
+		free <- make([]byte, s.chunkSize)
+	}
+
+	// readDone is closed once the reader is done, stop once a stream failed
+	readDone := make(chan struct{})
+	stop := make(chan struct{})
+	var once sync.Once
+	var streamErr error
+
+	fail := func(err error) {
+		once.Do(func() {
+			streamErr = err
+			close(stop)
+			// unblocks the other streams
+			closeStreams(s.streams)
+		})
+	}
+
+	sent := &atomic.Int64{}
+
+	var wg sync.WaitGroup
+	for i, st := range s.streams {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			err := s.sendStream(i, st, chunks, free, readDone, sent, progress)
+			if err != nil {
+				fail(err)
+			}
+		}()
+	}
+
+	tuneDone := make(chan struct{})
+	var tuneWg sync.WaitGroup
+	tuneWg.Add(1)
+	go func() {
+		defer tuneWg.Done()
+		s.tune(sent, tuneDone)
+	}()
+
+	readErr := readChunks(r, offset, size, chunks, free, stop)
+	close(chunks)
+	close(readDone)
+	wg.Wait()
+	close(tuneDone)
+	tuneWg.Wait()
+
+	if streamErr != nil {
+		progress.Fail(streamErr)
+		return streamErr
+	}
+
+	if readErr != nil {
+		closeStreams(s.streams)
+		progress.Fail(readErr)
+		return readErr
+	}
+
+	progress.Finish()
+
+	return nil
+}
+
+func readChunks(r io.Reader, offset, size int64, chunks chan stripeChunk, free chan []byte, stop chan struct{}) error {
+	for read := int64(0); read < size; {
+		var buf []byte
+		select {
+		case buf = <-free:
+		case <-stop:
+			return nil
+		}
+
+		n := int(min(size-read, int64(len(buf))))
+		_, err := io.ReadFull(r, buf[:n])
+		if err != nil {
+			return fmt.Errorf("failed to read data: %w", err)
+		}
+
+		select {
+		case chunks <- stripeChunk{offset: offset + read, data: buf[:n]}:
+		case <-stop:
+			return nil
+		}
+
+		read += int64(n)
+	}
+
+	return nil
+}
+
+func (s *stripeSender) sendStream(i int, st *stream, chunks chan stripeChunk, free chan []byte, readDone chan struct{}, sent *atomic.Int64, progress *encryptservice.StreamProgress) error {
+	select {
+	case <-s.started[i]:
+		for chunk := range chunks {
+			err := st.gs.WriteChunk(st.conn, chunk.offset, chunk.data)
+			if err != nil {
+				return fmt.Errorf("failed to write data: %w", err)
+			}
+
+			sent.Add(int64(len(chunk.data)))
+			progress.Add(len(chunk.data))
+			free <- chunk.data[:cap(chunk.data)]
+		}
+	case <-readDone:
+	}
+
+	err := st.gs.EndChunks(st.conn)
+	if err != nil {
+		return fmt.Errorf("failed to write data: %w", err)
+	}
+
+	return nil
+}
+
+// tune starts another stream every interval while that keeps paying off.
+func (s *stripeSender) tune(sent *atomic.Int64, done chan struct{}) {
+	ticker := time.NewTicker(STRIPE_TUNE_INTERVAL)
+	defer ticker.Stop()
+
+	last := int64(0)
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		n := sent.Load()
+		if !s.grow(float64(n - last)) {
+			return
+		}
+
+		last = n
+	}
+}
+
+// grow is called with the bytes sent in the last interval, and returns false
+// once tuning is over.
+func (s *stripeSender) grow(rate float64) bool {
+	if !s.auto || s.active == len(s.streams) {
+		return false
+	}
+
+	if s.rate > 0 && rate < s.rate*STRIPE_TUNE_GAIN {
+		s.auto = false
+		return false
+	}
+
+	s.rate = rate
+	s.start(s.active + 1)
+
+	return true
+}
+
+// receiveStriped receives size bytes of a file from offset on over all
+// streams. Every chunk has to be where the sender would have put it, so with
+// no duplicates the count tells whether all of the file arrived.
+func receiveStriped(streams []*stream, w StripeWriter, offset, size int64, chunkSize int, progress *encryptservice.StreamProgress) error {
+	received := &atomic.Int64{}
+	seen := &sync.Map{}
+	errs := make(chan error, len(streams))
+
+	for _, st := range streams {
+		go func() {
+			errs <- receiveStream(st, w, offset, size, chunkSize, seen, received, progress)
+		}()
+	}
+
+	var err error
+	for range streams {
+		streamErr := <-errs
+		if streamErr != nil && err == nil {
+			err = streamErr
+			// unblocks the other streams
+			closeStreams(streams)
+		}
+	}
+
+	if err == nil && received.Load() != size {
+		err = fmt.Errorf("failed to read data: expected %d bytes, got %d", size, received.Load())
+	}
+
+	if err != nil {
+		progress.Fail(err)
+		return err
+	}
+
+	progress.Finish()
+
+	return nil
+}
+
+func receiveStream(st *stream, w StripeWriter, offset, size int64, chunkSize int, seen *sync.Map, received *atomic.Int64, progress *encryptservice.StreamProgress) error {
+	end := offset + size
+
+	for {
+		off, data, err := st.gs.ReadChunk(st.conn)
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read data: %w", err)
+		}
+
+		if off < offset || off >= end || (off-offset)%int64(chunkSize) != 0 || int64(len(data)) != min(end-off, int64(chunkSize)) {
+			return fmt.Errorf("failed to read data: %w: chunk of %d bytes at %d", encryptservice.ErrUnexpectedRecord, len(data), off)
+		}
+
+		_, duplicate := seen.LoadOrStore(off, true)
+		if duplicate {
+			return fmt.Errorf("failed to read data: %w: chunk at %d sent twice", encryptservice.ErrUnexpectedRecord, off)
+		}
+
+		_, err = w.WriteAt(data, off)
+		if err != nil {
+			return fmt.Errorf("failed to write data: %w", err)
+		}
+
+		received.Add(int64(len(data)))
+		progress.Add(len(data))
+	}
+}
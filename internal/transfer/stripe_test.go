@@ -0,0 +1,181 @@
+package transfer
+
+import (
+	"bytes"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+)
+
+// stripeSink writes files to dir and can take striped ones.
+type stripeSink struct {
+	fileSink
+}
+
+func (s *stripeSink) OpenStripe(info *FileInfo, offset int64) (StripeWriter, error) {
+	return OpenPartial(filepath.Join(s.dir, info.Name), info, offset, s.hashes[info.Name])
+}
+
+// runStreams is run with streams over loopback TCP, they need the buffering of
+// a real connection.
+func runStreams(t *testing.T, sender, receiver *encryptservice.GcmService, share *Share, sink Sink) (error, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	accept := func(n int) ([]io.ReadWriteCloser, error) {
+		conns := make([]io.ReadWriteCloser, n)
+		for i := range conns {
+			conn, err := l.Accept()
+			if err != nil {
+				return nil, err
+			}
+
+			conns[i] = conn
+		}
+
+		return conns, nil
+	}
+
+	dial := func(n int) ([]io.ReadWriteCloser, error) {
+		conns := make([]io.ReadWriteCloser, n)
+		for i := range conns {
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				return nil, err
+			}
+
+			conns[i] = conn
+		}
+
+		return conns, nil
+	}
+
+	c1, c2 := net.Pipe()
+	sendErr := make(chan error, 1)
+
+	go func() {
+		err := SendStreams(sender, c1, accept, share)
+		c1.Close()
+		sendErr <- err
+	}()
+
+	receiveErr := ReceiveStreams(receiver, c2, dial, sink)
+	c2.Close()
+
+	return <-sendErr, receiveErr
+}
+
+func TestStripedTransfer(t *testing.T) {
+	big := make([]byte, 2*STRIPE_MIN_SIZE+17)
+	for i := range big {
+		big[i] = byte(i * 13)
+	}
+
+	small := []byte("below the stripe size")
+
+	for _, streams := range []int{0, 3} {
+		dir := t.TempDir()
+		sender, receiver := newServicePair(t)
+
+		sources := []*Source{
+			{FileInfo: FileInfo{Name: "big.bin", Size: int64(len(big)), Mode: 0644}, Reader: bytes.NewReader(big)},
+			{FileInfo: FileInfo{Name: "small.txt", Size: int64(len(small)), Mode: 0644}, Reader: bytes.NewReader(small)},
+		}
+
+		sink := &stripeSink{fileSink{dir: dir, hashes: make(map[string]hash.Hash)}}
+		sendErr, receiveErr := runStreams(t, sender, receiver, &Share{Sources: sources, Streams: streams}, sink)
+		if sendErr != nil {
+			t.Fatal(streams, sendErr)
+		}
+
+		if receiveErr != nil {
+			t.Fatal(streams, receiveErr)
+		}
+
+		for name, content := range map[string][]byte{"big.bin": big, "small.txt": small} {
+			got, err := os.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, content) {
+				t.Errorf("%d streams: %s differs", streams, name)
+			}
+		}
+	}
+}
+
+func TestStripedTransferWithoutStripeSink(t *testing.T) {
+	big := make([]byte, STRIPE_MIN_SIZE)
+	sender, receiver := newServicePair(t)
+
+	sources := []*Source{{FileInfo: FileInfo{Name: "big.bin", Size: int64(len(big))}, Reader: bytes.NewReader(big)}}
+	sink := &memorySink{files: make(map[string]*bytes.Buffer)}
+
+	// the receiver opens no streams and everything goes over one connection
+	sendErr, receiveErr := runStreams(t, sender, receiver, &Share{Sources: sources, Streams: 4}, sink)
+	if sendErr != nil || receiveErr != nil {
+		t.Fatal(sendErr, receiveErr)
+	}
+
+	if !bytes.Equal(sink.files["big.bin"].Bytes(), big) {
+		t.Error("content mismatch")
+	}
+}
+
+func TestStreamsNeedSessionKey(t *testing.T) {
+	sender, _ := newServicePair(t)
+	_, other := newServicePair(t)
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+
+	go func() {
+		dialStreams(other, func(n int) ([]io.ReadWriteCloser, error) {
+			return []io.ReadWriteCloser{c2}, nil
+		}, 1)
+	}()
+
+	_, err := acceptStreams(sender, func(n int) ([]io.ReadWriteCloser, error) {
+		return []io.ReadWriteCloser{c1}, nil
+	}, 1)
+	if !errors.Is(err, ErrInvalidStream) {
+		t.Error("expected ErrInvalidStream, got", err)
+	}
+}
+
+func TestStripeTuning(t *testing.T) {
+	streams := make([]*stream, 4)
+	s := newStripeSender(streams, encryptservice.CHUNK_SIZE, true)
+
+	for _, rate := range []float64{100, 180, 250} {
+		if !s.grow(rate) {
+			t.Fatal("stopped growing at", rate)
+		}
+	}
+
+	if s.active != 4 {
+		t.Errorf("expected 4 streams, got %d", s.active)
+	}
+
+	s = newStripeSender(streams, encryptservice.CHUNK_SIZE, true)
+	s.grow(100)
+	if s.grow(105) || s.active != 2 {
+		t.Errorf("kept adding streams that don't help, %d active", s.active)
+	}
+
+	s = newStripeSender(streams, encryptservice.CHUNK_SIZE, false)
+	if s.grow(100) || s.active != 4 {
+		t.Error("a fixed number of streams is not tuned")
+	}
+}
@@ -0,0 +1,769 @@
+package transfer
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+	"github.com/int32-dev/fastshare/internal/sharephrase"
+)
+
+// FileInfo describes one entry of a share. An empty Name is a plain text
+// message, a Mode with fs.ModeDir set is a directory streamed as a tar
+// archive.
+type FileInfo struct {
+	Name string
+	// Size is encryptservice.UNKNOWN_SIZE for a stream, like a pipe, that is
+	// sent until it ends
+	Size     int64
+	Mode     fs.FileMode
+	ModTime  time.Time
+	MimeType string `json:",omitempty"`
+	// ID is set for regular files that can be resumed, see FileID
+	ID string `json:",omitempty"`
+}
+
+func (f *FileInfo) IsMessage() bool {
+	return f.Name == ""
+}
+
+// MANIFEST_VERSION is increased whenever the manifest changes in a way older
+// receivers can't handle.
+const MANIFEST_VERSION = 1
+
+// Manifest is the first message sent over the encrypted channel. It tells the
+// receiver what is coming before any file data is sent.
+type Manifest struct {
+	Version int
+	Files   []*FileInfo
+	Note    string `json:",omitempty"`
+	// ChunkSize is the size of the data records, the receiver rejects
+	// larger ones
+	ChunkSize int `json:",omitempty"`
+	// Streams is how many extra streams the receiver should open, see
+	// STRIPE_MIN_SIZE
+	Streams int `json:",omitempty"`
+	// Compressions are offered for the file data, the receiver picks one
+	Compressions []string `json:",omitempty"`
+	// Session offers to keep the channel open afterwards, see Session
+	Session bool `json:",omitempty"`
+}
+
+type Source struct {
+	FileInfo
+	Reader io.Reader
+}
+
+// Share is everything the sender offers the receiver in one session.
+type Share struct {
+	Sources []*Source
+	Note    string
+	// ChunkSize is the amount of data sent per record, 0 for the default
+	ChunkSize int
+	// Streams is how many connections large files are striped across if the
+	// transport supports it. 0 tunes it from the measured throughput, 1 keeps
+	// everything on one connection.
+	Streams int
+	// Compressions are offered to the receiver, nil for the defaults
+	Compressions []string
+	// Verify is called with the verification code before anything is sent
+	Verify Verifier
+	// Session offers the receiver to go on with a session once the share was
+	// sent, nil closes the channel
+	Session SessionPeer
+}
+
+// Verifier lets the user compare the verification code with the one shown on
+// the other device. An error, like ErrNotVerified, stops the transfer.
+type Verifier func(code string) error
+
+// Sink decides where received entries are written to.
+type Sink interface {
+	// Prepare is called with the manifest before any data is received.
+	Prepare(manifest *Manifest) error
+	// Open is called for every entry in the manifest, in order. The returned
+	// writer receives the entry from offset on.
+	Open(info *FileInfo, offset int64) (EntryWriter, error)
+}
+
+// EntryWriter receives the data of one entry.
+type EntryWriter interface {
+	io.Writer
+	// Close is called once the whole entry was received and its digest
+	// verified.
+	Close() error
+	// Abort is called instead of Close if the entry could not be received.
+	// If err is ErrDigestMismatch the data written so far must be discarded.
+	Abort(err error) error
+}
+
+// ResumeSink is implemented by sinks that can keep data from an earlier,
+// interrupted transfer.
+type ResumeSink interface {
+	Sink
+	// Resume is called for every entry after Prepare. It returns how many bytes
+	// of info are already there, and a sha256 hash of them.
+	Resume(info *FileInfo) (int64, hash.Hash, error)
+}
+
+// AcceptSink is implemented by sinks that let the user decide whether to
+// receive a share. Accept is called after Prepare with the manifest, an error
+// like ErrRejected stops the share before any data is sent, and the sender is
+// told it was rejected.
+type AcceptSink interface {
+	Sink
+	Accept(manifest *Manifest) error
+}
+
+// VerifySink is implemented by sinks that want to check the verification code
+// before anything is received.
+type VerifySink interface {
+	Sink
+	Verify(code string) error
+}
+
+// trailer is sent after the data of every entry.
+type trailer struct {
+	Sha256 []byte
+}
+
+type resumePoint struct {
+	Offset int64
+	Hash   []byte
+}
+
+type resumeRequest struct {
+	// Rejected is set if the receiver doesn't want the share, nothing else
+	// is set then
+	Rejected bool `json:",omitempty"`
+	Files    []resumePoint
+	// Streams is how many streams the receiver opened
+	Streams int `json:",omitempty"`
+	// Compression is the one the receiver picked, none if empty
+	Compression string `json:",omitempty"`
+	// Session joins the session the sender offered
+	Session bool `json:",omitempty"`
+}
+
+type resumeResponse struct {
+	Offsets []int64
+}
+
+var ErrInvalidName = fmt.Errorf("invalid file name")
+var ErrDuplicateName = fmt.Errorf("duplicate file name")
+var ErrUnsupportedVersion = fmt.Errorf("unsupported manifest version")
+var ErrDigestMismatch = fmt.Errorf("sha256 mismatch")
+var ErrNotVerified = fmt.Errorf("verification code not confirmed")
+var ErrRejected = fmt.Errorf("rejected by receiver")
+
+// returned by the transports, which know how to wait for the peer
+var ErrDiscoveryTimeout = fmt.Errorf("no peer found in time")
+var ErrIdleTimeout = fmt.Errorf("peer stopped responding")
+var ErrPeerCanceled = encryptservice.ErrPeerCanceled
+
+// Send announces the share to the receiver over the encrypted channel, then
+// sends them one after another, skipping the part of each file the receiver
+// already has from an interrupted transfer.
+func Send(gs *encryptservice.GcmService, rw io.ReadWriter, share *Share) error {
+	return SendStreams(gs, rw, nil, share)
+}
+
+// SendStreams is Send over a transport that can open extra streams, large
+// files are striped across them. open accepts the receiver's connections.
+func SendStreams(gs *encryptservice.GcmService, rw io.ReadWriter, open StreamOpener, share *Share) error {
+	err := verify(gs, share.Verify)
+	if err != nil {
+		return err
+	}
+
+	joined, err := sendShare(gs, rw, open, share)
+	if err != nil || !joined {
+		return err
+	}
+
+	// the receiver goes first, so it can reply
+	return runSession(gs, rw, share.Session, false)
+}
+
+// sendShare sends one share, and tells whether the receiver joined the
+// session it offered.
+func sendShare(gs *encryptservice.GcmService, rw io.ReadWriter, open StreamOpener, share *Share) (bool, error) {
+	var err error
+	sources := share.Sources
+	if share.ChunkSize != 0 {
+		err = gs.SetChunkSize(share.ChunkSize)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	manifest := &Manifest{
+		Version:      MANIFEST_VERSION,
+		Note:         share.Note,
+		ChunkSize:    gs.ChunkSize(),
+		Compressions: share.Compressions,
+		Session:      share.Session != nil,
+	}
+
+	if manifest.Compressions == nil {
+		manifest.Compressions = encryptservice.DefaultCompressions()
+	}
+
+	if open != nil && share.Streams != 1 {
+		manifest.Streams = min(share.Streams, MAX_STREAMS)
+		if share.Streams == 0 {
+			manifest.Streams = AUTO_STREAMS
+		}
+	}
+
+	manifest.Files, err = manifestFiles(sources)
+	if err != nil {
+		return false, err
+	}
+
+	err = writeJson(gs, rw, manifest)
+	if err != nil {
+		return false, err
+	}
+
+	gs.Logf("waiting for the receiver to accept...")
+
+	request := &resumeRequest{}
+	err = readJson(gs, rw, request)
+	if err != nil {
+		return false, fmt.Errorf("failed to read resume request: %w", err)
+	}
+
+	if request.Rejected {
+		return false, ErrRejected
+	}
+
+	if len(request.Files) != len(sources) || request.Streams < 0 || request.Streams > manifest.Streams {
+		return false, fmt.Errorf("invalid resume request")
+	}
+
+	if request.Compression != "" && !slices.Contains(manifest.Compressions, request.Compression) {
+		return false, fmt.Errorf("receiver picked compression %q, which wasn't offered", request.Compression)
+	}
+
+	err = useCompression(gs, request.Compression)
+	if err != nil {
+		return false, err
+	}
+
+	response := &resumeResponse{
+		Offsets: make([]int64, len(sources)),
+	}
+
+	hashes := make([]hash.Hash, len(sources))
+	for i, src := range sources {
+		response.Offsets[i], hashes[i], err = skipVerifiedPrefix(src, request.Files[i])
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = writeJson(gs, rw, response)
+	if err != nil {
+		return false, err
+	}
+
+	var stripes *stripeSender
+	var streams []*stream
+	if request.Streams > 0 {
+		streams, err = acceptStreams(gs, open, request.Streams)
+		if err != nil {
+			return false, fmt.Errorf("failed to accept streams: %w", err)
+		}
+
+		defer closeStreams(streams)
+		stripes = newStripeSender(streams, gs.ChunkSize(), share.Streams == 0)
+	}
+
+	for i, src := range sources {
+		printEntry(gs, "sending", i, len(sources), &src.FileInfo)
+
+		offset := response.Offsets[i]
+		if offset > 0 {
+			gs.Logf("resuming from %.2f MB", float64(offset)/1024.0/1024.0)
+		}
+
+		r := io.TeeReader(src.Reader, hashes[i])
+		gs.SetProgressName(entryName(&src.FileInfo))
+		if striped(streams, &src.FileInfo, offset) {
+			err = stripes.send(r, offset, src.Size-offset, gs.NewStreamProgress(src.Size-offset))
+			if err == nil {
+				gs.Logf("sent over %d streams", stripes.active)
+			}
+		} else {
+			err = gs.Encrypt(r, rw, src.Size-offset)
+		}
+
+		if err != nil {
+			return false, err
+		}
+
+		digest := hashes[i].Sum(nil)
+		err = writeJson(gs, rw, &trailer{Sha256: digest})
+		if err != nil {
+			return false, err
+		}
+
+		gs.Logf("sha256: %x", digest)
+	}
+
+	return manifest.Session && request.Session, nil
+}
+
+// manifestFiles lists the sources for the manifest, their names have to be
+// unique.
+func manifestFiles(sources []*Source) ([]*FileInfo, error) {
+	files := make([]*FileInfo, 0, len(sources))
+	names := make(map[string]bool)
+	for _, src := range sources {
+		if !src.IsMessage() && names[src.Name] {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateName, src.Name)
+		}
+
+		names[src.Name] = true
+		files = append(files, &src.FileInfo)
+	}
+
+	return files, nil
+}
+
+// verify tells the verification code, and asks verifier to confirm it if set.
+func verify(gs *encryptservice.GcmService, verifier Verifier) error {
+	code, err := sharephrase.PhraseFromBytes(gs.VerificationCode())
+	if err != nil {
+		return err
+	}
+
+	status := gs.Status()
+	if status.Verification != nil {
+		status.Verification(gs.Suite().String(), code)
+	}
+
+	if verifier == nil {
+		return nil
+	}
+
+	return verifier(code)
+}
+
+// useCompression switches gs to the compression the receiver picked.
+func useCompression(gs *encryptservice.GcmService, compression string) error {
+	err := gs.SetCompression(compression)
+	if err != nil {
+		return err
+	}
+
+	if gs.Compression() != encryptservice.COMPRESSION_NONE {
+		gs.Logf("compression: %s", gs.Compression())
+	}
+
+	return nil
+}
+
+// skipVerifiedPrefix reads the part of src the receiver claims to have. If it
+// matches the receiver's hash src is left positioned after it, otherwise src
+// is rewound and sent from the start. The returned hash holds whatever part of
+// src was skipped.
+func skipVerifiedPrefix(src *Source, point resumePoint) (int64, hash.Hash, error) {
+	if point.Offset <= 0 || src.ID == "" || point.Offset > src.Size || point.Offset%encryptservice.CHUNK_SIZE != 0 {
+		return 0, sha256.New(), nil
+	}
+
+	h := sha256.New()
+	_, err := io.CopyN(h, src.Reader, point.Offset)
+	if err == nil && bytes.Equal(h.Sum(nil), point.Hash) {
+		return point.Offset, h, nil
+	}
+
+	seeker, ok := src.Reader.(io.Seeker)
+	if !ok {
+		return 0, nil, fmt.Errorf("can't restart %s from the beginning", src.Name)
+	}
+
+	_, err = seeker.Seek(0, io.SeekStart)
+	return 0, sha256.New(), err
+}
+
+// Receive reads the manifest sent by Send and writes every entry to sink.
+// If sink is a ResumeSink, entries it already has are continued instead of
+// being received again.
+func Receive(gs *encryptservice.GcmService, rw io.ReadWriter, sink Sink) error {
+	return ReceiveStreams(gs, rw, nil, sink)
+}
+
+// ReceiveStreams is Receive over a transport that can open extra streams. If
+// the sender asks for them and sink is a StripeSink, open dials them.
+func ReceiveStreams(gs *encryptservice.GcmService, rw io.ReadWriter, open StreamOpener, sink Sink) error {
+	var verifier Verifier
+	if v, ok := sink.(VerifySink); ok {
+		verifier = v.Verify
+	}
+
+	err := verify(gs, verifier)
+	if err != nil {
+		return err
+	}
+
+	var peer SessionPeer
+	if s, ok := sink.(SessionSink); ok {
+		peer = s.Session()
+	}
+
+	joined, err := receiveShare(gs, rw, open, sink, peer != nil)
+	if err != nil || !joined {
+		return err
+	}
+
+	return runSession(gs, rw, peer, true)
+}
+
+// receiveShare receives one share, and tells whether the session the sender
+// offered was joined. It is only joined if session is set.
+func receiveShare(gs *encryptservice.GcmService, rw io.ReadWriter, open StreamOpener, sink Sink, session bool) (bool, error) {
+	manifest := &Manifest{}
+	err := readJson(gs, rw, manifest)
+	if err != nil {
+		return false, fmt.Errorf("failed to read manifest: %w", err)
+	}
+
+	err = checkManifest(gs, manifest)
+	if err != nil {
+		return false, err
+	}
+
+	err = accept(sink, manifest)
+	if err != nil {
+		// so the sender doesn't just see the connection drop
+		rejectErr := writeJson(gs, rw, &resumeRequest{Rejected: true})
+		if rejectErr != nil {
+			gs.Logf("failed to tell the sender: %v", rejectErr)
+		}
+
+		return false, &rejection{err}
+	}
+
+	request := &resumeRequest{
+		Files:       make([]resumePoint, len(manifest.Files)),
+		Compression: encryptservice.ChooseCompression(manifest.Compressions, encryptservice.DefaultCompressions()),
+		Session:     session && manifest.Session,
+	}
+
+	// before the streams are opened, they compress like the session does
+	err = useCompression(gs, request.Compression)
+	if err != nil {
+		return false, err
+	}
+
+	hashes := make([]hash.Hash, len(manifest.Files))
+	for i := range hashes {
+		hashes[i] = sha256.New()
+	}
+
+	if resumer, ok := sink.(ResumeSink); ok {
+		for i, info := range manifest.Files {
+			offset, h, err := resumer.Resume(info)
+			if err != nil {
+				return false, err
+			}
+
+			if offset == 0 {
+				continue
+			}
+
+			hashes[i], err = cloneHash(h)
+			if err != nil {
+				return false, err
+			}
+
+			request.Files[i] = resumePoint{Offset: offset, Hash: h.Sum(nil)}
+		}
+	}
+
+	var streams []*stream
+	if _, ok := sink.(StripeSink); ok && open != nil && manifest.Streams > 0 {
+		streams, err = dialStreams(gs, open, manifest.Streams)
+		if err != nil {
+			gs.Logf("failed to open streams, using one connection: %v", err)
+		}
+
+		defer closeStreams(streams)
+		request.Streams = len(streams)
+	}
+
+	err = writeJson(gs, rw, request)
+	if err != nil {
+		return false, err
+	}
+
+	response := &resumeResponse{}
+	err = readJson(gs, rw, response)
+	if err != nil {
+		return false, fmt.Errorf("failed to read resume response: %w", err)
+	}
+
+	if len(response.Offsets) != len(manifest.Files) {
+		return false, fmt.Errorf("invalid resume response")
+	}
+
+	for i, info := range manifest.Files {
+		printEntry(gs, "receiving", i, len(manifest.Files), info)
+
+		offset := response.Offsets[i]
+		if offset != 0 && offset != request.Files[i].Offset {
+			return false, fmt.Errorf("invalid resume offset for %s", info.Name)
+		}
+
+		if offset > 0 {
+			gs.Logf("resuming from %.2f MB", float64(offset)/1024.0/1024.0)
+		} else {
+			hashes[i] = sha256.New()
+		}
+
+		err = receiveEntry(gs, rw, streams, info, offset, hashes[i], sink)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return request.Session, nil
+}
+
+// checkManifest validates what the sender announced and sets gs up for it.
+func checkManifest(gs *encryptservice.GcmService, manifest *Manifest) error {
+	if manifest.Version != MANIFEST_VERSION {
+		return fmt.Errorf("%w: sender uses version %d, expected %d", ErrUnsupportedVersion, manifest.Version, MANIFEST_VERSION)
+	}
+
+	if manifest.ChunkSize != 0 {
+		err := gs.SetChunkSize(manifest.ChunkSize)
+		if err != nil {
+			return fmt.Errorf("sender requested an invalid chunk size: %w", err)
+		}
+	}
+
+	if manifest.Streams < 0 || manifest.Streams > MAX_STREAMS {
+		return fmt.Errorf("sender requested %d streams", manifest.Streams)
+	}
+
+	for _, info := range manifest.Files {
+		err := validate(info)
+		if err != nil {
+			return err
+		}
+	}
+
+	if manifest.Note != "" {
+		gs.Logf("note from sender: %s", manifest.Note)
+	}
+
+	return nil
+}
+
+// accept prepares sink for the share and asks it whether to receive it.
+func accept(sink Sink, manifest *Manifest) error {
+	err := sink.Prepare(manifest)
+	if err != nil {
+		return err
+	}
+
+	if a, ok := sink.(AcceptSink); ok {
+		return a.Accept(manifest)
+	}
+
+	return nil
+}
+
+// receiveEntry receives one entry and checks it against the sender's digest.
+// h must already contain the first offset bytes of the entry.
+func receiveEntry(gs *encryptservice.GcmService, r io.Reader, streams []*stream, info *FileInfo, offset int64, h hash.Hash, sink Sink) error {
+	w, sum, err := receiveData(gs, r, streams, info, offset, h, sink)
+	if err != nil {
+		if w != nil {
+			w.Abort(err)
+		}
+
+		return err
+	}
+
+	t := &trailer{}
+	err = readJson(gs, r, t)
+	if err != nil {
+		err = fmt.Errorf("failed to read trailer: %w", err)
+		w.Abort(err)
+		return err
+	}
+
+	digest := sum()
+	if !bytes.Equal(digest, t.Sha256) {
+		err = fmt.Errorf("%w for %s: sender has %x, received %x", ErrDigestMismatch, info.Name, t.Sha256, digest)
+		w.Abort(err)
+		return err
+	}
+
+	gs.Logf("sha256: %x (verified)", digest)
+
+	return w.Close()
+}
+
+// receiveData writes the data of an entry to the writer sink opens for it,
+// over the streams if it is striped. sum returns the hash of what was written.
+func receiveData(gs *encryptservice.GcmService, r io.Reader, streams []*stream, info *FileInfo, offset int64, h hash.Hash, sink Sink) (EntryWriter, func() []byte, error) {
+	gs.SetProgressName(entryName(info))
+	if striped(streams, info, offset) {
+		w, err := sink.(StripeSink).OpenStripe(info, offset)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		progress := gs.NewStreamProgress(info.Size - offset)
+		return w, w.Sha256, receiveStriped(streams, w, offset, info.Size-offset, gs.ChunkSize(), progress)
+	}
+
+	w, err := sink.Open(info, offset)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	sum := func() []byte {
+		return h.Sum(nil)
+	}
+
+	return w, sum, gs.Decrypt(r, io.MultiWriter(h, w), info.Size-offset)
+}
+
+func cloneHash(h hash.Hash) (hash.Hash, error) {
+	marshaler, ok := h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil, fmt.Errorf("resume hash can't be copied")
+	}
+
+	state, err := marshaler.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+
+	clone := sha256.New()
+	err = clone.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	if err != nil {
+		return nil, err
+	}
+
+	return clone, nil
+}
+
+func writeJson(gs *encryptservice.GcmService, w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return gs.WriteMessage(w, data)
+}
+
+func readJson(gs *encryptservice.GcmService, r io.Reader, v any) error {
+	data, err := gs.ReadMessage(r)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(data, v)
+}
+
+func validate(info *FileInfo) error {
+	if info.Size < 0 && info.Size != encryptservice.UNKNOWN_SIZE {
+		return fmt.Errorf("invalid size for %s", info.Name)
+	}
+
+	if info.IsMessage() {
+		return nil
+	}
+
+	// names are a single path element, the receiver decides where they go
+	if !filepath.IsLocal(info.Name) || filepath.Base(info.Name) != info.Name || info.Name == "." {
+		return fmt.Errorf("%w: %q", ErrInvalidName, info.Name)
+	}
+
+	return nil
+}
+
+func printEntry(gs *encryptservice.GcmService, action string, i, total int, info *FileInfo) {
+	if total == 1 && info.IsMessage() {
+		return
+	}
+
+	gs.Logf("[%d/%d] %s %s", i+1, total, action, Describe(info))
+}
+
+// Describe shows the user the name, size and type of an entry.
+func Describe(info *FileInfo) string {
+	size := "unknown size"
+	if info.Size != encryptservice.UNKNOWN_SIZE {
+		size = fmt.Sprintf("%.2f MB", float64(info.Size)/1024.0/1024.0)
+	}
+
+	if info.MimeType != "" {
+		return fmt.Sprintf("%s (%s, %s)", entryName(info), size, info.MimeType)
+	}
+
+	return fmt.Sprintf("%s (%s)", entryName(info), size)
+}
+
+// TotalSize adds up the sizes of all entries, known is false if one of them
+// is sent until it ends.
+func (m *Manifest) TotalSize() (total int64, known bool) {
+	for _, info := range m.Files {
+		if info.Size == encryptservice.UNKNOWN_SIZE {
+			return 0, false
+		}
+
+		total += info.Size
+	}
+
+	return total, true
+}
+
+// entryName is how an entry is shown to the user.
+func entryName(info *FileInfo) string {
+	if info.IsMessage() {
+		return "message"
+	}
+
+	if info.Mode.IsDir() {
+		return info.Name + "/"
+	}
+
+	return info.Name
+}
+
+const MESSAGE_MIME_TYPE = "text/plain; charset=utf-8"
+const DIRECTORY_MIME_TYPE = "application/x-tar"
+
+// DetectMimeType guesses the type of a file from its extension, or its first
+// bytes if the extension is unknown.
+func DetectMimeType(name string, r io.ReaderAt) string {
+	mimeType := mime.TypeByExtension(filepath.Ext(name))
+	if mimeType != "" {
+		return mimeType
+	}
+
+	buf := make([]byte, 512)
+	n, _ := r.ReadAt(buf, 0)
+
+	return http.DetectContentType(buf[:n])
+}
@@ -0,0 +1,572 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"hash"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+)
+
+const TEST_DISCOVER_PHRASE = "bluepenguin23"
+
+type memorySink struct {
+	manifest *Manifest
+	files    map[string]*bytes.Buffer
+}
+
+func (s *memorySink) Prepare(manifest *Manifest) error {
+	s.manifest = manifest
+	return nil
+}
+
+func (s *memorySink) Open(info *FileInfo, offset int64) (EntryWriter, error) {
+	buf := &bytes.Buffer{}
+	s.files[info.Name] = buf
+	return nopEntryWriter{buf}, nil
+}
+
+type nopEntryWriter struct {
+	io.Writer
+}
+
+func (nopEntryWriter) Close() error {
+	return nil
+}
+
+func (nopEntryWriter) Abort(err error) error {
+	return nil
+}
+
+// newServicePair runs a handshake like the two sides of a share would.
+func newServicePair(t *testing.T) (*encryptservice.GcmService, *encryptservice.GcmService) {
+	offerer, err := encryptservice.NewHandshake(TEST_DISCOVER_PHRASE, encryptservice.PAKE_RECEIVER, encryptservice.DefaultSuites())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chooser, err := encryptservice.NewHandshake(TEST_DISCOVER_PHRASE, encryptservice.PAKE_SENDER, encryptservice.DefaultSuites())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offer, err := offerer.Offer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	answer, chosen, err := chooser.Answer(offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offered, err := offerer.Finish(offer, answer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender, err := chosen.NewService(TEST_DISCOVER_PHRASE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receiver, err := offered.NewService(TEST_DISCOVER_PHRASE)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return sender, receiver
+}
+
+func TestSendReceiveMultipleFiles(t *testing.T) {
+	sender, receiver := newServicePair(t)
+
+	contents := map[string][]byte{
+		"a.bin": bytes.Repeat([]byte{7}, encryptservice.CHUNK_SIZE*3+17),
+		"b.log": []byte("log line\n"),
+		"c.csv": {},
+	}
+
+	var sources []*Source
+	for _, name := range []string{"a.bin", "b.log", "c.csv"} {
+		sources = append(sources, &Source{
+			FileInfo: FileInfo{Name: name, Size: int64(len(contents[name])), Mode: 0644},
+			Reader:   bytes.NewReader(contents[name]),
+		})
+	}
+
+	sink := &memorySink{files: make(map[string]*bytes.Buffer)}
+	sendErr, receiveErr := run(sender, receiver, &Share{Sources: sources, Note: "nightly logs", ChunkSize: 4 * encryptservice.CHUNK_SIZE}, sink, -1)
+	if sendErr != nil {
+		t.Fatal(sendErr)
+	}
+
+	if receiveErr != nil {
+		t.Fatal(receiveErr)
+	}
+
+	if len(sink.manifest.Files) != len(sources) {
+		t.Fatalf("expected %d manifest entries, got %d", len(sources), len(sink.manifest.Files))
+	}
+
+	if sink.manifest.Note != "nightly logs" {
+		t.Errorf("note %q not received", sink.manifest.Note)
+	}
+
+	if receiver.ChunkSize() != 4*encryptservice.CHUNK_SIZE {
+		t.Errorf("receiver uses chunk size %d", receiver.ChunkSize())
+	}
+
+	for name, content := range contents {
+		if !bytes.Equal(sink.files[name].Bytes(), content) {
+			t.Errorf("%s: content mismatch", name)
+		}
+	}
+}
+
+func TestSendUnknownSize(t *testing.T) {
+	sender, receiver := newServicePair(t)
+
+	data := bytes.Repeat([]byte("piped data\n"), encryptservice.CHUNK_SIZE)
+	r, w := io.Pipe()
+	go func() {
+		w.Write(data)
+		w.Close()
+	}()
+
+	sources := []*Source{
+		{FileInfo: FileInfo{Name: "stdin", Size: encryptservice.UNKNOWN_SIZE}, Reader: r},
+		{FileInfo: FileInfo{Name: "after.txt", Size: 5}, Reader: bytes.NewReader([]byte("after"))},
+	}
+
+	sink := &memorySink{files: make(map[string]*bytes.Buffer)}
+	sendErr, receiveErr := run(sender, receiver, &Share{Sources: sources}, sink, -1)
+	if sendErr != nil {
+		t.Fatal(sendErr)
+	}
+
+	if receiveErr != nil {
+		t.Fatal(receiveErr)
+	}
+
+	if !bytes.Equal(sink.files["stdin"].Bytes(), data) || sink.files["after.txt"].String() != "after" {
+		t.Error("content mismatch")
+	}
+}
+
+func TestReceiveRejectsPathNames(t *testing.T) {
+	for _, name := range []string{"../evil", "dir/file", "/etc/passwd", "."} {
+		sender, receiver := newServicePair(t)
+
+		sources := []*Source{{
+			FileInfo: FileInfo{Name: name, Size: 1},
+			Reader:   bytes.NewReader([]byte{1}),
+		}}
+
+		_, err := run(sender, receiver, &Share{Sources: sources}, &memorySink{files: make(map[string]*bytes.Buffer)}, -1)
+		if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%q: expected ErrInvalidName, got %v", name, err)
+		}
+	}
+}
+
+// failingConn breaks the connection after limit bytes were written
+type failingConn struct {
+	net.Conn
+	limit int
+}
+
+func (c *failingConn) Write(p []byte) (int, error) {
+	if c.limit >= 0 && len(p) > c.limit {
+		c.Conn.Close()
+		return 0, io.ErrClosedPipe
+	}
+
+	if c.limit >= 0 {
+		c.limit -= len(p)
+	}
+
+	return c.Conn.Write(p)
+}
+
+func run(sender, receiver *encryptservice.GcmService, share *Share, sink Sink, limit int) (error, error) {
+	c1, c2 := net.Pipe()
+	sendErr := make(chan error, 1)
+
+	go func() {
+		err := Send(sender, &failingConn{Conn: c1, limit: limit}, share)
+		c1.Close()
+		sendErr <- err
+	}()
+
+	receiveErr := Receive(receiver, c2, sink)
+	c2.Close()
+
+	return <-sendErr, receiveErr
+}
+
+// signalingWriter closes written once something was written to it.
+type signalingWriter struct {
+	written chan struct{}
+}
+
+func (w *signalingWriter) Write(p []byte) (int, error) {
+	select {
+	case <-w.written:
+	default:
+		close(w.written)
+	}
+
+	return len(p), nil
+}
+
+type signalingSink struct {
+	w *signalingWriter
+}
+
+func (s *signalingSink) Prepare(manifest *Manifest) error {
+	return nil
+}
+
+func (s *signalingSink) Open(info *FileInfo, offset int64) (EntryWriter, error) {
+	return nopEntryWriter{s.w}, nil
+}
+
+func TestReceiveCanceledBySender(t *testing.T) {
+	sender, receiver := newServicePair(t)
+
+	src, pw := io.Pipe()
+	share := &Share{Sources: []*Source{{FileInfo: FileInfo{Name: "a.bin", Size: encryptservice.UNKNOWN_SIZE}, Reader: src}}}
+
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go Send(sender, c1, share)
+
+	sink := &signalingSink{w: &signalingWriter{written: make(chan struct{})}}
+	receiveErr := make(chan error, 1)
+	go func() {
+		receiveErr <- Receive(receiver, c2, sink)
+	}()
+
+	// stop in the middle of the file, like a canceled sender
+	pw.Write(make([]byte, encryptservice.CHUNK_SIZE))
+	<-sink.w.written
+	c1.Write(encryptservice.CancelRecord())
+	c1.Close()
+	pw.Close()
+
+	err := <-receiveErr
+	if !errors.Is(err, ErrPeerCanceled) {
+		t.Fatalf("expected ErrPeerCanceled, got %v", err)
+	}
+}
+
+type fileSink struct {
+	dir    string
+	hashes map[string]hash.Hash
+}
+
+func (s *fileSink) Prepare(manifest *Manifest) error {
+	return nil
+}
+
+func (s *fileSink) Resume(info *FileInfo) (int64, hash.Hash, error) {
+	offset, h, err := ResumePoint(filepath.Join(s.dir, info.Name), info)
+	if err != nil || offset == 0 {
+		return 0, nil, err
+	}
+
+	s.hashes[info.Name] = h
+	return offset, h, nil
+}
+
+func (s *fileSink) Open(info *FileInfo, offset int64) (EntryWriter, error) {
+	return OpenPartial(filepath.Join(s.dir, info.Name), info, offset, s.hashes[info.Name])
+}
+
+func TestResumeInterruptedTransfer(t *testing.T) {
+	content := make([]byte, encryptservice.CHUNK_SIZE*10+100)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+
+	info := FileInfo{Name: "disk.img", Size: int64(len(content)), Mode: 0600}
+	info.ID = FileID(info.Name, info.Size, time.Now())
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, info.Name)
+
+	sender, receiver := newServicePair(t)
+	sources := []*Source{{FileInfo: info, Reader: bytes.NewReader(content)}}
+	// uncompressed, so the connection fails after the limit of file data
+	share := &Share{Sources: sources, Compressions: []string{encryptservice.COMPRESSION_NONE}}
+	_, err := run(sender, receiver, share, &fileSink{dir: dir, hashes: make(map[string]hash.Hash)}, encryptservice.CHUNK_SIZE*5)
+	if err == nil {
+		t.Fatal("expected interrupted transfer to fail")
+	}
+
+	state, err := loadPartialState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.Chunk == 0 {
+		t.Fatal("expected part of the file to be kept")
+	}
+
+	sender, receiver = newServicePair(t)
+	sources = []*Source{{FileInfo: info, Reader: bytes.NewReader(content)}}
+	sink := &fileSink{dir: dir, hashes: make(map[string]hash.Hash)}
+
+	offset, _, err := sink.Resume(&info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if offset != state.Chunk*encryptservice.CHUNK_SIZE {
+		t.Errorf("resume offset %d, expected %d", offset, state.Chunk*encryptservice.CHUNK_SIZE)
+	}
+
+	sendErr, receiveErr := run(sender, receiver, &Share{Sources: sources}, sink, -1)
+	if sendErr != nil {
+		t.Fatal(sendErr)
+	}
+
+	if receiveErr != nil {
+		t.Fatal(receiveErr)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, content) {
+		t.Error("resumed file does not match")
+	}
+
+	for _, p := range []string{path + PARTIAL_SUFFIX, path + STATE_SUFFIX} {
+		_, err = os.Stat(p)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s not removed after completing the transfer", p)
+		}
+	}
+}
+
+func TestAbortRemovesCorruptFile(t *testing.T) {
+	info := &FileInfo{Name: "file.bin", Size: encryptservice.CHUNK_SIZE * 2, Mode: 0644, ID: "abc"}
+	path := filepath.Join(t.TempDir(), info.Name)
+
+	w, err := OpenPartial(path, info, 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = w.Write(make([]byte, encryptservice.CHUNK_SIZE))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Abort(io.ErrUnexpectedEOF)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offset, h, err := ResumePoint(path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if offset != encryptservice.CHUNK_SIZE {
+		t.Fatalf("expected to resume at %d, got %d", encryptservice.CHUNK_SIZE, offset)
+	}
+
+	w, err = OpenPartial(path, info, offset, h)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = w.Abort(ErrDigestMismatch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{path, path + PARTIAL_SUFFIX, path + STATE_SUFFIX} {
+		_, err = os.Stat(p)
+		if !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s not removed after digest mismatch", p)
+		}
+	}
+}
+
+func TestAbortRemovesUnresumableFile(t *testing.T) {
+	for _, info := range []*FileInfo{
+		// without an id it can't be resumed
+		{Name: "file.bin", Size: encryptservice.CHUNK_SIZE * 2, Mode: 0644},
+		// less than a chunk is not worth keeping
+		{Name: "file.bin", Size: encryptservice.CHUNK_SIZE * 2, Mode: 0644, ID: "abc"},
+	} {
+		path := filepath.Join(t.TempDir(), info.Name)
+
+		w, err := OpenPartial(path, info, 0, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size := encryptservice.CHUNK_SIZE
+		if info.ID != "" {
+			size = 100
+		}
+
+		_, err = w.Write(make([]byte, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = w.Abort(context.Canceled)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, p := range []string{path, path + PARTIAL_SUFFIX} {
+			_, err = os.Stat(p)
+			if !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("%s with id %q kept", p, info.ID)
+			}
+		}
+	}
+}
+
+type verifyingSink struct {
+	*memorySink
+	code   string
+	accept bool
+}
+
+func (s *verifyingSink) Verify(code string) error {
+	s.code = code
+	if !s.accept {
+		return ErrNotVerified
+	}
+
+	return nil
+}
+
+func TestVerificationCode(t *testing.T) {
+	for _, accept := range []bool{true, false} {
+		sender, receiver := newServicePair(t)
+
+		var senderCode string
+		share := &Share{
+			Sources: []*Source{{FileInfo: FileInfo{Name: "a.txt", Size: 1}, Reader: bytes.NewReader([]byte{1})}},
+			Verify: func(code string) error {
+				senderCode = code
+				return nil
+			},
+		}
+
+		sink := &verifyingSink{memorySink: &memorySink{files: make(map[string]*bytes.Buffer)}, accept: accept}
+		sendErr, receiveErr := run(sender, receiver, share, sink, -1)
+
+		if senderCode == "" || senderCode != sink.code {
+			t.Errorf("verification codes differ: %q and %q", senderCode, sink.code)
+		}
+
+		if accept && (sendErr != nil || receiveErr != nil) {
+			t.Error("verified transfer failed:", sendErr, receiveErr)
+		}
+
+		if !accept {
+			if !errors.Is(receiveErr, ErrNotVerified) || sendErr == nil {
+				t.Error("transfer went on after declining the code:", sendErr, receiveErr)
+			}
+
+			if sink.manifest != nil {
+				t.Error("manifest received before the code was confirmed")
+			}
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	sender, receiver := newServicePair(t)
+
+	log := &bytes.Buffer{}
+	var suite, code string
+	receiver.SetStatus(encryptservice.Status{
+		Log: log,
+		Verification: func(s string, c string) {
+			suite, code = s, c
+		},
+	})
+
+	var senderCode string
+	share := &Share{
+		Sources: []*Source{{FileInfo: FileInfo{Name: "a.txt", Size: 1}, Reader: bytes.NewReader([]byte{1})}},
+		Verify: func(code string) error {
+			senderCode = code
+			return nil
+		},
+	}
+
+	sendErr, receiveErr := run(sender, receiver, share, &memorySink{files: make(map[string]*bytes.Buffer)}, -1)
+	if sendErr != nil || receiveErr != nil {
+		t.Fatal(sendErr, receiveErr)
+	}
+
+	if code != senderCode || suite != receiver.Suite().String() {
+		t.Errorf("verification reported %q %q, expected %q %q", suite, code, receiver.Suite(), senderCode)
+	}
+
+	if !bytes.Contains(log.Bytes(), []byte("sha256: ")) {
+		t.Errorf("sha256 not logged: %q", log)
+	}
+}
+
+type acceptingSink struct {
+	*memorySink
+	accept bool
+}
+
+func (s *acceptingSink) Accept(manifest *Manifest) error {
+	if !s.accept {
+		return ErrRejected
+	}
+
+	return nil
+}
+
+func TestReceiverRejectsShare(t *testing.T) {
+	for _, accept := range []bool{true, false} {
+		sender, receiver := newServicePair(t)
+		share := &Share{
+			Sources: []*Source{{FileInfo: FileInfo{Name: "a.txt", Size: 1}, Reader: bytes.NewReader([]byte{1})}},
+		}
+
+		sink := &acceptingSink{memorySink: &memorySink{files: make(map[string]*bytes.Buffer)}, accept: accept}
+		sendErr, receiveErr := run(sender, receiver, share, sink, -1)
+
+		if accept && (sendErr != nil || receiveErr != nil) {
+			t.Error("accepted transfer failed:", sendErr, receiveErr)
+		}
+
+		if !accept {
+			if !errors.Is(sendErr, ErrRejected) || !errors.Is(receiveErr, ErrRejected) {
+				t.Error("expected ErrRejected on both sides:", sendErr, receiveErr)
+			}
+
+			if len(sink.files) != 0 {
+				t.Error("entry opened after rejecting the share")
+			}
+		}
+	}
+}
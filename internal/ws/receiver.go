@@ -3,52 +3,48 @@ package ws
 import (
 	"context"
 	"fmt"
-	"io"
 	"net/url"
-	"os"
+	"strings"
 
 	"github.com/coder/websocket"
 	"github.com/int32-dev/fastshare/internal/encryptservice"
+	"github.com/int32-dev/fastshare/internal/transfer"
 )
 
+// PAIR_CODE_LEN is the length of the pair codes of relays that didn't put a
+// separator in front of them.
 const PAIR_CODE_LEN = 4
 
 type WsReceiveHandler struct {
-	conn     *websocket.Conn
-	gs       *encryptservice.GcmService
-	byteChan chan []byte
+	conn *websocket.Conn
+	gs   *encryptservice.GcmService
+	stop func() bool
 }
 
-func NewWsReceiveHandler(sharePairCode string, addr string) (*WsReceiveHandler, error) {
-	codeLen := len(sharePairCode)
-
-	if len(sharePairCode) < PAIR_CODE_LEN {
-		return nil, fmt.Errorf("pair code too short")
-	}
-
-	shareCode := sharePairCode[:codeLen-PAIR_CODE_LEN]
-	pairCode := sharePairCode[codeLen-PAIR_CODE_LEN:]
-
-	hmacService := encryptservice.NewHmacService(shareCode)
-
-	keyPair, err := encryptservice.GenerateEcdhKeypair()
+// NewWsReceiveHandler connects to the sender through the relay. Once ctx is
+// done the connection is closed.
+func NewWsReceiveHandler(ctx context.Context, sharePairCode string, addr string, opts *Options) (*WsReceiveHandler, error) {
+	shareCode, pairCode, err := SplitCode(sharePairCode)
 	if err != nil {
 		return nil, err
 	}
 
-	salt, err := encryptservice.GenreateSalt()
+	handshake, err := encryptservice.NewHandshake(shareCode, encryptservice.PAKE_RECEIVER, opts.Suites)
 	if err != nil {
 		return nil, err
 	}
 
-	info := &ClientInfo{
-		PubKey: keyPair.PublicKey().Bytes(),
-		Salt:   salt,
-		Hmac:   hmacService.Sign(keyPair.PublicKey().Bytes(), salt),
-	}
+	// the suite is chosen once the sender's offer arrives, the server only
+	// needs our share to let us in
+	info := &ClientInfo{}
+	info.Share = handshake.Share()
 
 	query := url.Values{}
-	info.AddToQuery(query)
+	err = info.AddToQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
 	query.Add(PaircodeQuery, pairCode)
 
 	uri, err := url.Parse(addr + "?" + query.Encode())
@@ -56,118 +52,128 @@ func NewWsReceiveHandler(sharePairCode string, addr string) (*WsReceiveHandler,
 		return nil, err
 	}
 
-	conn, response, err := websocket.Dial(context.TODO(), uri.String(), nil)
+	discoverCtx, cancel := withTimeout(ctx, opts.DiscoveryTimeout)
+	defer cancel()
+
+	conn, response, err := websocket.Dial(discoverCtx, uri.String(), nil)
 	if err != nil {
-		if response != nil {
-			fmt.Println(response.Status)
-			io.Copy(os.Stdout, response.Body)
-		}
+		return nil, canceled(ctx, discoveryError(discoverCtx, opts.DiscoveryTimeout, relayError(response, err)))
+	}
 
-		return nil, err
+	r := &WsReceiveHandler{
+		conn: conn,
+		stop: closeOnDone(ctx, conn),
 	}
 
-	senderInfo := &ClientInfo{}
-	err = ReadAndParseTextMessage(conn, "senderInfo", senderInfo)
+	r.gs, err = r.pair(discoverCtx, handshake, shareCode, opts)
 	if err != nil {
-		return nil, err
+		r.stop()
+		conn.CloseNow()
+		return nil, canceled(ctx, discoveryError(discoverCtx, opts.DiscoveryTimeout, err))
 	}
 
-	if !hmacService.Verify(senderInfo.PubKey, senderInfo.Hmac, senderInfo.Salt) {
-		conn.Close(websocket.StatusProtocolError, "invalid hmac")
-		return nil, fmt.Errorf("invalid hmac")
+	return r, nil
+}
+
+// SplitCode splits the code the sender shows into the share code and the pair
+// code the relay assigned.
+func SplitCode(sharePairCode string) (string, string, error) {
+	shareCode, pairCode, ok := cutLast(sharePairCode, PAIR_CODE_SEPARATOR)
+	if !ok {
+		// older relays handed out 4 digits that were appended as they were
+		if len(sharePairCode) <= PAIR_CODE_LEN {
+			return "", "", fmt.Errorf("share code too short")
+		}
+
+		n := len(sharePairCode) - PAIR_CODE_LEN
+		return sharePairCode[:n], sharePairCode[n:], nil
+	}
+
+	if shareCode == "" || pairCode == "" {
+		return "", "", fmt.Errorf("share code must look like <share code>%s<pair code>", PAIR_CODE_SEPARATOR)
+	}
+
+	return shareCode, pairCode, nil
+}
+
+func cutLast(s, sep string) (string, string, bool) {
+	i := strings.LastIndex(s, sep)
+	if i < 0 {
+		return s, "", false
 	}
 
-	pubKey, err := encryptservice.ParsePublicKey(senderInfo.PubKey)
+	return s[:i], s[i+len(sep):], true
+}
+
+// pair answers the sender's offer the server passes on.
+func (r *WsReceiveHandler) pair(ctx context.Context, handshake *encryptservice.Handshake, shareCode string, opts *Options) (*encryptservice.GcmService, error) {
+	conn := r.conn
+
+	senderInfo := &ClientInfo{}
+	err := ReadAndParseTextMessage(ctx, conn, "senderInfo", senderInfo)
 	if err != nil {
 		return nil, err
 	}
 
-	fmt.Println("Sending receiver info")
-
-	msg, err := GetJsonMessageBytes("receiverInfo", info)
+	answer, result, err := handshake.Answer(&senderInfo.Hello)
 	if err != nil {
+		conn.Close(websocket.StatusProtocolError, "invalid handshake")
 		return nil, err
 	}
 
-	err = conn.Write(context.TODO(), websocket.MessageText, msg)
+	opts.Status.Logf("sending receiver info")
+
+	msg, err := GetJsonMessageBytes("receiverInfo", &ClientInfo{Hello: *answer})
 	if err != nil {
 		return nil, err
 	}
 
-	gcmServ, err := encryptservice.NewGcmService(keyPair, pubKey, shareCode)
+	err = conn.Write(ctx, websocket.MessageText, msg)
 	if err != nil {
 		return nil, err
 	}
 
-	return &WsReceiveHandler{
-		conn:     conn,
-		gs:       gcmServ,
-		byteChan: make(chan []byte, 1),
-	}, nil
-}
+	senderConfirmation := &ClientInfo{}
+	err = ReadAndParseTextMessage(ctx, conn, "confirmation", senderConfirmation)
+	if err != nil {
+		if status := websocket.CloseStatus(err); status == websocket.StatusProtocolError {
+			return nil, encryptservice.ErrWrongShareCode
+		}
 
-func (h *WsReceiveHandler) Read(p []byte) (int, error) {
-	data, ok := <-h.byteChan
-	if !ok {
-		return 0, io.EOF
+		return nil, err
 	}
 
-	copy(p, data)
-	return len(data), nil
-}
-
-func Receive(sharePairCode string, url string, w io.Writer) error {
-	r, err := NewWsReceiveHandler(sharePairCode, url)
+	err = result.Verify(senderConfirmation.Confirmation)
 	if err != nil {
-		return err
+		conn.Close(websocket.StatusProtocolError, "wrong share code")
+		return nil, err
 	}
 
-	defer r.conn.Close(websocket.StatusProtocolError, "")
-
-	fmt.Println("waiting for sender response")
+	return result.NewService(shareCode)
+}
 
-	size, err := r.getSizeMessage()
+// Receive receives a share through the relay at url. Once ctx is done the
+// share is stopped and ctx.Err() returned.
+func Receive(ctx context.Context, sharePairCode string, url string, sink transfer.Sink, opts *Options) error {
+	r, err := NewWsReceiveHandler(ctx, sharePairCode, url, opts)
 	if err != nil {
 		return err
 	}
 
-	go func() {
-		for {
-			msgType, data, err := r.conn.Read(context.TODO())
-			if err != nil {
-				if status := websocket.CloseStatus(err); status > -1 {
-					if status != websocket.StatusNormalClosure {
-						fmt.Println("read pump:", err)
-					}
-				}
-
-				close(r.byteChan)
-				return
-			}
-
-			if msgType != websocket.MessageBinary {
-				fmt.Println("unexpected message type")
-				continue
-			}
+	defer r.stop()
+	defer r.conn.Close(websocket.StatusProtocolError, "")
 
-			r.byteChan <- data
-		}
-	}()
+	r.gs.SetProgressReporter(opts.Progress)
+	r.gs.SetStatus(opts.Status)
 
-	err = r.gs.Decrypt(r, w, size)
+	r.gs.Logf("waiting for sender response")
 
+	err = transfer.Receive(r.gs, newWsStream(r.conn, opts.IdleTimeout), sink)
 	if err != nil {
-		return err
+		return canceled(ctx, err)
 	}
 
 	r.conn.Close(websocket.StatusNormalClosure, "")
 
 	return nil
 }
-
-func (h *WsReceiveHandler) getSizeMessage() (int64, error) {
-	var size int64
-	err := ReadAndParseTextMessage(h.conn, "size", &size)
-
-	return size, err
-}
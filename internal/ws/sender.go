@@ -2,134 +2,172 @@ package ws
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
+	"net/http"
 	"net/url"
-	"os"
 
 	"github.com/coder/websocket"
 	"github.com/int32-dev/fastshare/internal/encryptservice"
+	"github.com/int32-dev/fastshare/internal/transfer"
 )
 
 type WsSenderHandler struct {
 	conn *websocket.Conn
 	gs   *encryptservice.GcmService
+	stop func() bool
 }
 
-func NewWsSendHandler(shareCode string, addr string) (*WsSenderHandler, error) {
-	keyPair, err := encryptservice.GenerateEcdhKeypair()
+// NewWsSendHandler connects to the relay and waits for a receiver. Once ctx is
+// done the connection is closed.
+func NewWsSendHandler(ctx context.Context, shareCode string, addr string, opts *Options) (*WsSenderHandler, error) {
+	handshake, err := encryptservice.NewHandshake(shareCode, encryptservice.PAKE_SENDER, opts.Suites)
 	if err != nil {
 		return nil, err
 	}
 
-	salt, err := encryptservice.GenreateSalt()
+	offer, err := handshake.Offer()
 	if err != nil {
 		return nil, err
 	}
 
-	hmac := encryptservice.NewHmacService(shareCode)
-	info := &ClientInfo{
-		PubKey: keyPair.PublicKey().Bytes(),
-		Salt:   salt,
-		Hmac:   hmac.Sign(keyPair.PublicKey().Bytes(), salt),
-	}
+	info := &ClientInfo{Hello: *offer}
 
 	query := url.Values{}
-	info.AddToQuery(query)
+	err = info.AddToQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.PairCode != "" {
+		query.Set(ClaimQuery, opts.PairCode)
+	}
 
 	uri, err := url.Parse(addr + "?" + query.Encode())
 	if err != nil {
 		return nil, err
 	}
 
-	conn, response, err := websocket.Dial(context.Background(), uri.String(), nil)
+	discoverCtx, cancel := withTimeout(ctx, opts.DiscoveryTimeout)
+	defer cancel()
+
+	conn, response, err := websocket.Dial(discoverCtx, uri.String(), nil)
 	if err != nil {
-		if response != nil {
-			fmt.Println(response.Status)
-			io.Copy(os.Stdout, response.Body)
-		}
+		return nil, canceled(ctx, discoveryError(discoverCtx, opts.DiscoveryTimeout, claimError(response, err)))
+	}
 
-		return nil, err
+	h := &WsSenderHandler{
+		conn: conn,
+		stop: closeOnDone(ctx, conn),
 	}
 
+	h.gs, err = h.pair(discoverCtx, handshake, offer, shareCode, opts)
+	if err != nil {
+		h.stop()
+		conn.CloseNow()
+		return nil, canceled(ctx, discoveryError(discoverCtx, opts.DiscoveryTimeout, err))
+	}
+
+	return h, nil
+}
+
+// claimError explains why the relay refused a sender, which only happens when
+// it claims a pair code.
+func claimError(response *http.Response, err error) error {
+	if response != nil {
+		switch response.StatusCode {
+		case http.StatusNotFound:
+			return ErrUnknownPairCode
+		case http.StatusConflict:
+			return ErrPairCodeClaimed
+		}
+	}
+
+	return relayError(response, err)
+}
+
+// pair runs the handshake with the receiver the server pairs us with.
+func (h *WsSenderHandler) pair(ctx context.Context, handshake *encryptservice.Handshake, offer *encryptservice.Hello, shareCode string, opts *Options) (*encryptservice.GcmService, error) {
+	conn := h.conn
+
 	var pairCode string
-	err = ReadAndParseTextMessage(conn, "pairCode", &pairCode)
+	err := ReadAndParseTextMessage(ctx, conn, "pairCode", &pairCode)
 	if err != nil {
 		conn.Close(websocket.StatusProtocolError, "")
 		return nil, err
 	}
 
-	fmt.Printf("share code: %s%s\n", shareCode, pairCode)
-	fmt.Println("waiting for receiver...")
+	code := shareCode + PAIR_CODE_SEPARATOR + pairCode
+	if opts.ShareCode != nil {
+		opts.ShareCode(code)
+	} else {
+		opts.Status.Logf("share code: %s", code)
+	}
+
+	opts.Status.Logf("waiting for receiver...")
 
 	receiverInfo := &ClientInfo{}
-	err = ReadAndParseTextMessage(conn, "receiverInfo", receiverInfo)
+	err = ReadAndParseTextMessage(ctx, conn, "receiverInfo", receiverInfo)
 	if err != nil {
 		conn.Close(websocket.StatusProtocolError, "")
 
-		if status := websocket.CloseStatus(err); status == StatusTimeoutError {
-			return nil, fmt.Errorf("timed out waiting for receiver")
+		switch websocket.CloseStatus(err) {
+		case StatusTimeoutError:
+			return nil, fmt.Errorf("%w: the server stopped waiting for a receiver", transfer.ErrDiscoveryTimeout)
+		case websocket.StatusProtocolError:
+			// most likely no common cipher suite
+			return nil, fmt.Errorf("receiver rejected the handshake")
 		}
 
 		return nil, err
 	}
 
-	if !hmac.Verify(receiverInfo.PubKey, receiverInfo.Hmac, receiverInfo.Salt) {
-		conn.Close(websocket.StatusProtocolError, "invalid hmac")
-		return nil, fmt.Errorf("invalid hmac")
+	result, err := handshake.Finish(offer, &receiverInfo.Hello)
+	if errors.Is(err, encryptservice.ErrWrongShareCode) {
+		conn.Close(websocket.StatusProtocolError, "wrong share code")
+		return nil, err
 	}
 
-	pubKey, err := encryptservice.ParsePublicKey(receiverInfo.PubKey)
 	if err != nil {
+		conn.Close(websocket.StatusProtocolError, "invalid handshake")
 		return nil, err
 	}
 
-	fmt.Println("receiver connected")
+	confirmation := &ClientInfo{}
+	confirmation.Confirmation = result.Confirmation()
+	msg, err := GetJsonMessageBytes("confirmation", confirmation)
+	if err != nil {
+		return nil, err
+	}
 
-	gcmService, err := encryptservice.NewGcmService(keyPair, pubKey, shareCode)
+	err = conn.Write(ctx, websocket.MessageText, msg)
 	if err != nil {
 		return nil, err
 	}
 
-	return &WsSenderHandler{
-		conn: conn,
-		gs:   gcmService,
-	}, nil
-}
+	opts.Status.Logf("receiver connected")
 
-func (s *WsSenderHandler) Write(p []byte) (int, error) {
-	err := s.conn.Write(context.Background(), websocket.MessageBinary, p)
-	return len(p), err
+	return result.NewService(shareCode)
 }
 
-func Send(shareCode string, url string, r io.Reader, size int64) error {
-	s, err := NewWsSendHandler(shareCode, url)
+// Send shares through the relay at url. Once ctx is done the share is stopped
+// and ctx.Err() returned.
+func Send(ctx context.Context, shareCode string, url string, share *transfer.Share, opts *Options) error {
+	s, err := NewWsSendHandler(ctx, shareCode, url, opts)
 	if err != nil {
 		return err
 	}
 
+	defer s.stop()
 	defer s.conn.Close(websocket.StatusProtocolError, "")
 
-	err = s.writeSizeMessage(size)
-	if err != nil {
-		return err
-	}
-
-	s.conn.CloseRead(context.Background())
+	s.gs.SetProgressReporter(opts.Progress)
+	s.gs.SetStatus(opts.Status)
 
-	err = s.gs.Encrypt(r, s, size)
+	err = transfer.Send(s.gs, newWsStream(s.conn, opts.IdleTimeout), share)
 	if err != nil {
-		return err
+		return canceled(ctx, err)
 	}
 
 	return s.conn.Close(websocket.StatusNormalClosure, "")
 }
-
-func (s *WsSenderHandler) writeSizeMessage(size int64) error {
-	msg, err := GetJsonMessageBytes("size", size)
-	if err != nil {
-		return err
-	}
-
-	return s.conn.Write(context.Background(), websocket.MessageText, msg)
-}
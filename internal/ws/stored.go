@@ -0,0 +1,226 @@
+package ws
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+	"github.com/int32-dev/fastshare/internal/transfer"
+)
+
+// A stored share is uploaded to the relay, which keeps it until it expires.
+// The upload is a line of json with what's needed to derive the key from the
+// share code, followed by the records transfer.SendStored writes. The relay
+// never sees the share code.
+
+// STORED_VERSION is increased whenever the upload changes in a way older
+// receivers can't handle.
+const STORED_VERSION = 1
+
+// MAX_STORED_HEADER_SIZE is plenty for the json line in front of the records.
+const MAX_STORED_HEADER_SIZE = 1024
+
+type storedHeader struct {
+	Version int
+	Key     *encryptservice.PasswordKey
+}
+
+// storeResponse is what the relay answers an upload with.
+type storeResponse struct {
+	ID      string
+	Expires time.Time
+}
+
+// Store uploads share to the relay at relayURL. Once the upload completed the
+// code the receiver needs is passed to opts.ShareCode. Once ctx is done the
+// upload is stopped and ctx.Err() returned.
+func Store(ctx context.Context, shareCode string, relayURL string, share *transfer.Share, opts *Options) error {
+	uri, err := storeURL(relayURL)
+	if err != nil {
+		return err
+	}
+
+	key, err := encryptservice.NewPasswordKey(opts.Suites)
+	if err != nil {
+		return err
+	}
+
+	gs, err := key.NewService(shareCode, opts.Suites)
+	if err != nil {
+		return err
+	}
+
+	gs.SetProgressReporter(opts.Progress)
+	gs.SetStatus(opts.Status)
+	gs.Logf("encryption: %s", gs.Suite())
+
+	r, w := io.Pipe()
+	defer r.Close()
+
+	uploadErr := make(chan error, 1)
+	go func() {
+		err := upload(gs, w, key, share)
+		w.CloseWithError(err)
+		uploadErr <- err
+	}()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPut, uri, r)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		r.Close()
+		return canceled(ctx, errors.Join(<-uploadErr, err))
+	}
+
+	defer response.Body.Close()
+	r.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("the relay doesn't keep shares for later")
+	}
+
+	if response.StatusCode != http.StatusCreated {
+		return relayError(response, nil)
+	}
+
+	err = <-uploadErr
+	if err != nil {
+		return err
+	}
+
+	stored := &storeResponse{}
+	err = json.NewDecoder(response.Body).Decode(stored)
+	if err != nil {
+		return fmt.Errorf("failed to read the relay's answer: %w", err)
+	}
+
+	code := shareCode + PAIR_CODE_SEPARATOR + stored.ID
+	if opts.ShareCode != nil {
+		opts.ShareCode(code)
+	} else {
+		opts.Status.Logf("share code: %s", code)
+	}
+
+	opts.Status.Logf("stored on the relay until %s", stored.Expires.Local().Format(time.DateTime))
+
+	return nil
+}
+
+func upload(gs *encryptservice.GcmService, w io.Writer, key *encryptservice.PasswordKey, share *transfer.Share) error {
+	bw := bufio.NewWriterSize(w, 64*1024)
+
+	header, err := json.Marshal(&storedHeader{Version: STORED_VERSION, Key: key})
+	if err != nil {
+		return err
+	}
+
+	_, err = bw.Write(append(header, '\n'))
+	if err != nil {
+		return err
+	}
+
+	err = transfer.SendStored(gs, bw, share)
+	if err != nil {
+		return err
+	}
+
+	return bw.Flush()
+}
+
+// Download receives the share stored with sharePairCode from the relay at
+// relayURL, and writes it to sink. Once ctx is done the download is stopped
+// and ctx.Err() returned.
+func Download(ctx context.Context, sharePairCode string, relayURL string, sink transfer.Sink, opts *Options) error {
+	shareCode, id, err := SplitCode(sharePairCode)
+	if err != nil {
+		return err
+	}
+
+	uri, err := storeURL(relayURL)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, uri+"/"+url.PathEscape(id), nil)
+	if err != nil {
+		return err
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return canceled(ctx, err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode == http.StatusNotFound {
+		return ErrNotStored
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return relayError(response, nil)
+	}
+
+	br := bufio.NewReaderSize(response.Body, 64*1024)
+	line, err := br.ReadSlice('\n')
+	if err != nil || len(line) > MAX_STORED_HEADER_SIZE {
+		return canceled(ctx, fmt.Errorf("invalid stored share"))
+	}
+
+	header := &storedHeader{}
+	err = json.Unmarshal(line, header)
+	if err != nil || header.Key == nil {
+		return fmt.Errorf("invalid stored share")
+	}
+
+	if header.Version != STORED_VERSION {
+		return fmt.Errorf("%w: stored share has version %d, expected %d", transfer.ErrUnsupportedVersion, header.Version, STORED_VERSION)
+	}
+
+	gs, err := header.Key.NewService(shareCode, opts.Suites)
+	if err != nil {
+		return err
+	}
+
+	gs.SetProgressReporter(opts.Progress)
+	gs.SetStatus(opts.Status)
+	gs.Logf("encryption: %s", gs.Suite())
+
+	err = transfer.ReceiveStored(gs, br, sink)
+	if err != nil {
+		return canceled(ctx, err)
+	}
+
+	return nil
+}
+
+// storeURL is the http endpoint for stored shares next to the websocket one.
+func storeURL(relayURL string) (string, error) {
+	uri, err := url.Parse(relayURL)
+	if err != nil {
+		return "", err
+	}
+
+	switch uri.Scheme {
+	case "ws":
+		uri.Scheme = "http"
+	case "wss":
+		uri.Scheme = "https"
+	}
+
+	uri.Path = strings.TrimSuffix(uri.Path, "/ws") + "/store"
+	uri.RawQuery = ""
+
+	return uri.String(), nil
+}
@@ -5,30 +5,168 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/coder/websocket"
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+	"github.com/int32-dev/fastshare/internal/transfer"
 )
 
-const PubkeyQuery = "pubkey"
-const SaltQuery = "salt"
-const HmacQuery = "hmac"
+const InfoQuery = "info"
 const PaircodeQuery = "paircode"
+
+// ClaimQuery is set by a sender that connects with a pair code created with
+// the relay's session API, instead of getting a new one.
+const ClaimQuery = "claim"
+
 const StatusTimeoutError = websocket.StatusCode(3000)
 
+// StatusCanceledByRelay closes both sides of a session the relay's admin
+// canceled.
+const StatusCanceledByRelay = websocket.StatusCode(3001)
+
+// PAIR_CODE_SEPARATOR goes between the share code and the pair code the
+// relay assigned. Pair codes only have letters and digits.
+const PAIR_CODE_SEPARATOR = "-"
+
+var (
+	// ErrNoSender means the relay has no sender waiting for the pair code
+	ErrNoSender = fmt.Errorf("no sender is waiting for this share code, it may have expired")
+	// ErrSenderBusy means another receiver already connected to the sender
+	ErrSenderBusy = fmt.Errorf("the sender is already sharing with another receiver")
+	// ErrLockedOut means the relay stopped taking share codes from this
+	// address after too many unknown ones
+	ErrLockedOut = fmt.Errorf("too many unknown share codes")
+	// ErrNotStored means the relay keeps no share for the pair code
+	ErrNotStored = fmt.Errorf("no share is stored for this share code, it may have expired")
+	// ErrCanceledByRelay means the relay's admin canceled the session
+	ErrCanceledByRelay = fmt.Errorf("the relay canceled the share")
+	// ErrUnknownPairCode means the relay has no session waiting to be claimed
+	// with the pair code
+	ErrUnknownPairCode = fmt.Errorf("the relay has no session for this pair code, it may have expired")
+	// ErrPairCodeClaimed means another sender already claimed the pair code
+	ErrPairCodeClaimed = fmt.Errorf("another sender already uses this pair code")
+)
+
+// MAX_MESSAGE_SIZE is the read limit for websocket connections, every binary
+// message carries one encrypted record.
+const MAX_MESSAGE_SIZE = encryptservice.MAX_RECORD_SIZE
+
+// ClientInfo carries one side of the handshake. The sender offers the cipher
+// suites when it connects, the server passes the offer on to the receiver,
+// which chooses the suite and answers with its confirmation.
 type ClientInfo struct {
-	PubKey []byte
-	Salt   []byte
-	Hmac   []byte
+	encryptservice.Hello
+}
+
+// Options configure one side of a share through the relay server.
+type Options struct {
+	Suites encryptservice.Suites
+	// Progress is where the progress of file data is reported, can be nil
+	Progress encryptservice.ProgressReporter
+	// Status is told what the share is doing besides progress
+	Status encryptservice.Status
+	// ShareCode is called on the sender with the code the receiver has to
+	// enter, once the server assigned the pair code. nil logs it.
+	ShareCode func(code string)
+	// DiscoveryTimeout limits how long connecting and waiting for the peer
+	// may take, 0 waits until the context is done
+	DiscoveryTimeout time.Duration
+	// IdleTimeout fails the transfer once nothing could be sent or received
+	// for that long, 0 waits forever
+	IdleTimeout time.Duration
+	// PairCode makes the sender claim a pair code created with the relay's
+	// session API, empty gets a new one
+	PairCode string
+}
+
+// closeOnDone closes conn once ctx is done, which makes every blocked read and
+// write on it fail. The peer is told with StatusGoingAway, see readError.
+// Call the returned stop once conn isn't used anymore.
+func closeOnDone(ctx context.Context, conn *websocket.Conn) func() bool {
+	return context.AfterFunc(ctx, func() {
+		conn.Close(websocket.StatusGoingAway, "canceled")
+	})
+}
+
+// withTimeout is context.WithTimeout, without a timeout if it is 0.
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// discoveryError tells whether pairing failed because it took longer than
+// the discovery timeout.
+func discoveryError(discoverCtx context.Context, timeout time.Duration, err error) error {
+	if errors.Is(discoverCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%w: not paired within %s", transfer.ErrDiscoveryTimeout, timeout)
+	}
+
+	return err
+}
+
+// relayError explains why the relay refused the connection.
+func relayError(response *http.Response, err error) error {
+	if response == nil {
+		return err
+	}
+
+	switch response.StatusCode {
+	case http.StatusNotFound:
+		return ErrNoSender
+	case http.StatusConflict:
+		return ErrSenderBusy
+	case http.StatusTooManyRequests:
+		seconds, parseErr := strconv.Atoi(response.Header.Get("Retry-After"))
+		if parseErr != nil {
+			return fmt.Errorf("%w, try again later", ErrLockedOut)
+		}
+
+		return fmt.Errorf("%w, try again in %s", ErrLockedOut, time.Duration(seconds)*time.Second)
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	message := strings.TrimSpace(string(body))
+	if message == "" && err != nil {
+		return fmt.Errorf("relay answered %s: %w", response.Status, err)
+	}
+
+	if message == "" {
+		return fmt.Errorf("relay answered %s", response.Status)
+	}
+
+	return fmt.Errorf("relay answered %s: %s", response.Status, message)
+}
+
+// canceled returns the error of ctx if it ended the share, err otherwise.
+func canceled(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
 }
 
 type ErrorMessage struct {
 	Error string
 }
 
-func ReadAndParseTextMessage(conn *websocket.Conn, route string, v interface{}) error {
-	msgType, message, err := conn.Read(context.Background())
+func ReadAndParseTextMessage(ctx context.Context, conn *websocket.Conn, route string, v interface{}) error {
+	msgType, message, err := conn.Read(ctx)
+	if websocket.CloseStatus(err) == StatusCanceledByRelay {
+		return ErrCanceledByRelay
+	}
+
 	if err != nil {
 		return err
 	}
@@ -58,44 +196,39 @@ func NewClientInfoFromQueryString(query url.Values) (*ClientInfo, error) {
 	return parseHeaders(query)
 }
 
-func (info *ClientInfo) AddToQuery(query url.Values) {
-	addQueryParams(query, info)
+func (info *ClientInfo) AddToQuery(query url.Values) error {
+	return addQueryParams(query, info)
 }
 
-func addQueryParams(query url.Values, info *ClientInfo) {
-	query.Add(PubkeyQuery, base64.StdEncoding.EncodeToString(info.PubKey))
-	query.Add(SaltQuery, base64.StdEncoding.EncodeToString(info.Salt))
-	query.Add(HmacQuery, base64.StdEncoding.EncodeToString(info.Hmac))
+func addQueryParams(query url.Values, info *ClientInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	query.Add(InfoQuery, base64.RawURLEncoding.EncodeToString(data))
+	return nil
 }
 
 func parseHeaders(query url.Values) (*ClientInfo, error) {
-	pubkey := query.Get(PubkeyQuery)
-	salt := query.Get(SaltQuery)
-	hmac := query.Get(HmacQuery)
-
-	if pubkey == "" || salt == "" || hmac == "" {
+	info := query.Get(InfoQuery)
+	if info == "" {
 		return nil, fmt.Errorf("missing headers")
 	}
 
-	pubKeyBytes, err := base64.StdEncoding.DecodeString(pubkey)
+	data, err := base64.RawURLEncoding.DecodeString(info)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode pubkey: %w", err)
+		return nil, fmt.Errorf("failed to decode info: %w", err)
 	}
 
-	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	clientInfo := &ClientInfo{}
+	err = json.Unmarshal(data, clientInfo)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode salt: %w", err)
+		return nil, fmt.Errorf("failed to unmarshal info: %w", err)
 	}
 
-	hmacBytes, err := base64.StdEncoding.DecodeString(hmac)
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode hmac: %w", err)
-	}
-
-	clientInfo := &ClientInfo{
-		PubKey: pubKeyBytes,
-		Salt:   saltBytes,
-		Hmac:   hmacBytes,
+	if len(clientInfo.Share) != encryptservice.PAKE_SHARE_SIZE {
+		return nil, fmt.Errorf("invalid share")
 	}
 
 	return clientInfo, nil
@@ -128,3 +261,135 @@ func ParseTextMessage(message []byte) (string, []byte, error) {
 
 	return string(messageParts[0]), messageParts[1], nil
 }
+
+// wsStream turns the binary messages of a websocket connection into a byte
+// stream. Each Write is sent as one message.
+type wsStream struct {
+	conn     *websocket.Conn
+	idle     time.Duration
+	byteChan chan []byte
+	pending  []byte
+	// err is returned once byteChan is closed, done is closed once it is set
+	err  error
+	done chan struct{}
+}
+
+// newWsStream reads from conn until it is closed. Reads and writes fail once
+// they made no progress for idle, unless it is 0.
+func newWsStream(conn *websocket.Conn, idle time.Duration) *wsStream {
+	s := &wsStream{
+		conn:     conn,
+		idle:     idle,
+		byteChan: make(chan []byte, 1),
+		done:     make(chan struct{}),
+	}
+
+	conn.SetReadLimit(MAX_MESSAGE_SIZE)
+
+	go s.readPump()
+
+	return s
+}
+
+func (s *wsStream) readPump() {
+	for {
+		msgType, data, err := s.conn.Read(context.Background())
+		if err != nil {
+			s.err = readError(err)
+			close(s.done)
+			close(s.byteChan)
+			return
+		}
+
+		if msgType != websocket.MessageBinary {
+			// nothing but records is sent once the transfer started
+			continue
+		}
+
+		s.byteChan <- data
+	}
+}
+
+// readError turns the peer closing the connection into io.EOF, or into
+// transfer.ErrPeerCanceled if it gave up and ErrCanceledByRelay if the relay
+// ended it.
+func readError(err error) error {
+	switch websocket.CloseStatus(err) {
+	case websocket.StatusNormalClosure:
+		return io.EOF
+	case websocket.StatusGoingAway:
+		return transfer.ErrPeerCanceled
+	case StatusCanceledByRelay:
+		return ErrCanceledByRelay
+	}
+
+	return err
+}
+
+func (s *wsStream) Read(p []byte) (int, error) {
+	if len(s.pending) == 0 {
+		data, err := s.next()
+		if err != nil {
+			return 0, err
+		}
+
+		s.pending = data
+	}
+
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+
+	return n, nil
+}
+
+// next waits for the next message. The read pump keeps reading without a
+// timeout, a sender that only writes doesn't expect anything for a long time.
+func (s *wsStream) next() ([]byte, error) {
+	var timeout <-chan time.Time
+	if s.idle > 0 {
+		t := time.NewTimer(s.idle)
+		defer t.Stop()
+		timeout = t.C
+	}
+
+	select {
+	case data, ok := <-s.byteChan:
+		if !ok {
+			return nil, s.err
+		}
+
+		return data, nil
+	case <-timeout:
+		return nil, fmt.Errorf("%w: nothing received for %s", transfer.ErrIdleTimeout, s.idle)
+	}
+}
+
+// writeError reports why the peer closed the connection if it did, a sender
+// only notices when its next write fails.
+func (s *wsStream) writeError(err error) error {
+	select {
+	case <-s.done:
+		if errors.Is(s.err, transfer.ErrPeerCanceled) || errors.Is(s.err, ErrCanceledByRelay) {
+			return s.err
+		}
+	default:
+	}
+
+	return err
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	ctx, cancel := withTimeout(context.Background(), s.idle)
+	defer cancel()
+
+	err := s.conn.Write(ctx, websocket.MessageBinary, p)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return 0, fmt.Errorf("%w: nothing sent for %s", transfer.ErrIdleTimeout, s.idle)
+	}
+
+	if err != nil {
+		return 0, s.writeError(err)
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,219 @@
+package fastshare
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+
+	"github.com/int32-dev/fastshare/internal/archive"
+	"github.com/int32-dev/fastshare/internal/shareservice"
+	"github.com/int32-dev/fastshare/internal/transfer"
+	"github.com/int32-dev/fastshare/internal/ws"
+)
+
+// Sink decides where received entries are written to. Sinks can also
+// implement ResumeSink to continue interrupted transfers, StripeSink to
+// receive large files over several connections, VerifySink to confirm the
+// verification code, AcceptSink to decide whether to receive a share at
+// all, and SessionSink to join a session the sender offers.
+type Sink = transfer.Sink
+
+type AcceptSink = transfer.AcceptSink
+type EntryWriter = transfer.EntryWriter
+type ResumeSink = transfer.ResumeSink
+type SessionSink = transfer.SessionSink
+type StripeSink = transfer.StripeSink
+type StripeWriter = transfer.StripeWriter
+type VerifySink = transfer.VerifySink
+
+// Manifest is what the sender is about to send, see Sink.Prepare.
+type Manifest = transfer.Manifest
+
+// Receiver receives from the Sender with the same share code.
+type Receiver struct {
+	opts Options
+	code string
+}
+
+// NewReceiver receives from the sender that shows code, including the pair
+// code with a relay.
+func NewReceiver(code string, opts Options) (*Receiver, error) {
+	if code == "" {
+		return nil, fmt.Errorf("%w: missing share code", ErrInvalidOptions)
+	}
+
+	err := opts.check()
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = opts.suites()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Receiver{opts: opts, code: code}, nil
+}
+
+// Receive finds the sender and writes what it sends to sink, or downloads the
+// offline share from the relay. Sessions aren't joined and the verification
+// code isn't shown for an offline share. Once ctx is done
+// the transfer is stopped and ctx.Err() returned.
+func (r *Receiver) Receive(ctx context.Context, sink Sink) error {
+	suites, err := r.opts.suites()
+	if err != nil {
+		return err
+	}
+
+	if r.opts.Offline {
+		return ws.Download(ctx, r.code, r.opts.RelayURL, sink, r.opts.relay(suites))
+	}
+
+	if r.opts.RelayURL != "" {
+		return ws.Receive(ctx, r.code, r.opts.RelayURL, sink, r.opts.relay(suites))
+	}
+
+	ss, err := shareservice.NewLocalShareService(r.opts.port(), r.code, r.opts.local(suites))
+	if err != nil {
+		return err
+	}
+
+	return ss.Receive(ctx, sink)
+}
+
+// Overwrite decides what happens to a received entry that already exists.
+type Overwrite = transfer.Overwrite
+
+const (
+	OVERWRITE_REFUSE  = transfer.OVERWRITE_REFUSE
+	OVERWRITE_REPLACE = transfer.OVERWRITE_REPLACE
+	OVERWRITE_RENAME  = transfer.OVERWRITE_RENAME
+)
+
+// DirSink writes files and directories into a directory under the sender's
+// names and keeps messages in memory. Entries are received next to their
+// target and only moved there once verified. Interrupted files are resumed.
+type DirSink struct {
+	// Overwrite is checked before anything is received, by default the
+	// transfer fails if an entry already exists
+	Overwrite Overwrite
+	dir       string
+	// file is set by NewFileSink
+	file     string
+	messages []string
+	paths    map[*FileInfo]string
+	hashes   map[*FileInfo]hash.Hash
+}
+
+func NewDirSink(dir string) *DirSink {
+	return &DirSink{
+		dir:    dir,
+		paths:  make(map[*FileInfo]string),
+		hashes: make(map[*FileInfo]hash.Hash),
+	}
+}
+
+// NewFileSink writes the single entry of a share to path, messages included.
+// Shares of more entries fail in Prepare.
+func NewFileSink(path string) *DirSink {
+	s := NewDirSink(filepath.Dir(path))
+	s.file = path
+	return s
+}
+
+// Messages are the messages received so far.
+func (s *DirSink) Messages() []string {
+	return s.messages
+}
+
+// Path is where info was written to, "" for messages kept in memory.
+func (s *DirSink) Path(info *FileInfo) string {
+	return s.paths[info]
+}
+
+func (s *DirSink) Prepare(manifest *Manifest) error {
+	if s.file != "" && len(manifest.Files) != 1 {
+		return fmt.Errorf("sender is sending %d entries, only one can be written to %s", len(manifest.Files), s.file)
+	}
+
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	taken := make(map[string]bool)
+	for _, info := range manifest.Files {
+		path := s.file
+		if path == "" && info.IsMessage() {
+			continue
+		}
+
+		if path == "" {
+			path = filepath.Join(s.dir, info.Name)
+		}
+
+		path, err := transfer.TargetPath(path, s.Overwrite, taken)
+		if err != nil {
+			return err
+		}
+
+		taken[path] = true
+		s.paths[info] = path
+	}
+
+	return nil
+}
+
+func (s *DirSink) Resume(info *FileInfo) (int64, hash.Hash, error) {
+	if s.paths[info] == "" || info.Mode.IsDir() {
+		return 0, nil, nil
+	}
+
+	offset, h, err := transfer.ResumePoint(s.paths[info], info)
+	if err != nil || offset == 0 {
+		return 0, nil, err
+	}
+
+	s.hashes[info] = h
+
+	return offset, h, nil
+}
+
+func (s *DirSink) Open(info *FileInfo, offset int64) (EntryWriter, error) {
+	if info.IsMessage() && s.paths[info] == "" {
+		return &messageWriter{sink: s}, nil
+	}
+
+	if info.Mode.IsDir() {
+		w, err := archive.NewDirWriter(s.paths[info])
+		if err != nil {
+			return nil, err
+		}
+
+		return w, nil
+	}
+
+	return s.OpenStripe(info, offset)
+}
+
+func (s *DirSink) OpenStripe(info *FileInfo, offset int64) (StripeWriter, error) {
+	return transfer.OpenPartial(s.paths[info], info, offset, s.hashes[info])
+}
+
+// messageWriter adds the message to the sink once it was verified.
+type messageWriter struct {
+	bytes.Buffer
+	sink *DirSink
+}
+
+func (w *messageWriter) Close() error {
+	w.sink.messages = append(w.sink.messages, w.String())
+	return nil
+}
+
+func (w *messageWriter) Abort(err error) error {
+	return nil
+}
@@ -0,0 +1,268 @@
+package fastshare
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/int32-dev/fastshare/internal/archive"
+	"github.com/int32-dev/fastshare/internal/encryptservice"
+	"github.com/int32-dev/fastshare/internal/sharephrase"
+	"github.com/int32-dev/fastshare/internal/shareservice"
+	"github.com/int32-dev/fastshare/internal/transfer"
+	"github.com/int32-dev/fastshare/internal/ws"
+)
+
+type SenderOptions struct {
+	Options
+	// Code is the share code, empty for a random one. With a relay the
+	// server adds a pair code to it. Offline shares always get a random one.
+	Code string
+	// PairCode is a pair code created with the relay's session API, which
+	// is then used instead of a new one. Only for a relay, not offline.
+	PairCode string
+	// Note is shown to the receiver before the transfer starts
+	Note string
+	// ChunkSize is the bytes of data per encrypted record, a multiple of
+	// 16 KiB up to 1 MiB. 0 for 16 KiB.
+	ChunkSize int
+	// Streams is how many connections large files are striped across on
+	// the local network, up to 64. 0 tunes it from the measured throughput,
+	// 1 uses a single connection.
+	Streams int
+	// Compression only offers zstd, gzip or none to the receiver, empty
+	// offers all of them
+	Compression string
+	// ShareCode is called with the code the receiver has to use, as soon as
+	// it is known
+	ShareCode func(code string)
+	// Verify is called with the verification code before anything is sent,
+	// an error stops the transfer. Both devices show the same code unless
+	// somebody sits between them.
+	Verify func(code string) error
+	// Session keeps the connection open after the sources were sent, if the
+	// receiver's sink is a SessionSink. Both sides then take turns sending
+	// more, see SessionPeer. nil closes it.
+	Session SessionPeer
+}
+
+// Source is a file, directory or message to send.
+type Source = transfer.Source
+
+// Share is what a SessionPeer sends on its turn, only Sources has to be set.
+type Share = transfer.Share
+
+// SessionPeer drives one side of a session, see SenderOptions.Session and
+// SessionSink.
+type SessionPeer = transfer.SessionPeer
+
+// FileInfo describes a Source, an empty Name is a message.
+type FileInfo = transfer.FileInfo
+
+// OFFLINE_CODE_WORDS is how many words the share code of an offline share has,
+// about 77 bits.
+const OFFLINE_CODE_WORDS = 6
+
+// Sender sends sources to a Receiver with the same share code.
+type Sender struct {
+	opts         SenderOptions
+	suites       encryptservice.Suites
+	compressions []string
+	code         string
+}
+
+func NewSender(opts SenderOptions) (*Sender, error) {
+	err := opts.check()
+	if err != nil {
+		return nil, err
+	}
+
+	// anybody holding the stored share can try codes, only a long random
+	// one holds up
+	if opts.Offline && opts.Code != "" {
+		return nil, fmt.Errorf("%w: the share code of an offline share is always generated", ErrInvalidOptions)
+	}
+
+	if opts.Offline && (opts.Session != nil || opts.Verify != nil) {
+		return nil, fmt.Errorf("%w: an offline share can't be verified or start a session, nobody answers", ErrInvalidOptions)
+	}
+
+	if opts.PairCode != "" && (opts.RelayURL == "" || opts.Offline) {
+		return nil, fmt.Errorf("%w: a pair code is only used by a relay that isn't storing the share", ErrInvalidOptions)
+	}
+
+	suites, err := opts.suites()
+	if err != nil {
+		return nil, err
+	}
+
+	compressions, err := encryptservice.NewCompressions(opts.Compression)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidOptions, err)
+	}
+
+	if opts.ChunkSize != 0 {
+		err = encryptservice.ValidateChunkSize(opts.ChunkSize)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidOptions, err)
+		}
+	}
+
+	if opts.Streams < 0 || opts.Streams > transfer.MAX_STREAMS {
+		return nil, fmt.Errorf("%w: streams must be between 0 and %d", ErrInvalidOptions, transfer.MAX_STREAMS)
+	}
+
+	code := opts.Code
+	if code == "" {
+		// the relay adds a pair code. Whoever holds a stored share can guess
+		// its code offline, so that one is a lot longer.
+		if opts.Offline {
+			code, err = sharephrase.GetRandomPhrase(OFFLINE_CODE_WORDS, false)
+		} else if opts.RelayURL != "" {
+			code, err = sharephrase.GetRandomPhrase(3, false)
+		} else {
+			code, err = sharephrase.GetRandomPhrase(2, true)
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &Sender{
+		opts:         opts,
+		suites:       suites,
+		compressions: compressions,
+		code:         code,
+	}, nil
+}
+
+// Code is the share code, without the pair code a relay adds to it.
+func (s *Sender) Code() string {
+	return s.code
+}
+
+// Send waits for the receiver and sends it the sources, in order. Offline
+// it uploads them to the relay instead and returns once they're stored. With
+// SenderOptions.Session it returns once the session ended. Once ctx is
+// done the transfer is stopped and ctx.Err() returned.
+func (s *Sender) Send(ctx context.Context, sources ...*Source) error {
+	share := &transfer.Share{
+		Sources:      sources,
+		Note:         s.opts.Note,
+		ChunkSize:    s.opts.ChunkSize,
+		Streams:      s.opts.Streams,
+		Compressions: s.compressions,
+		Verify:       s.opts.Verify,
+		Session:      s.opts.Session,
+	}
+
+	if s.opts.RelayURL != "" {
+		relay := s.opts.relay(s.suites)
+		relay.ShareCode = s.shareCode
+		relay.PairCode = s.opts.PairCode
+
+		if s.opts.Offline {
+			return ws.Store(ctx, s.code, s.opts.RelayURL, share, relay)
+		}
+
+		return ws.Send(ctx, s.code, s.opts.RelayURL, share, relay)
+	}
+
+	s.shareCode(s.code)
+
+	ss, err := shareservice.NewLocalShareService(s.opts.port(), s.code, s.opts.local(s.suites))
+	if err != nil {
+		return err
+	}
+
+	return ss.Send(ctx, share)
+}
+
+func (s *Sender) shareCode(code string) {
+	if s.opts.ShareCode != nil {
+		s.opts.ShareCode(code)
+	}
+}
+
+// MessageSource sends a text message.
+func MessageSource(message string) *Source {
+	return &Source{
+		FileInfo: FileInfo{
+			Size:     int64(len(message)),
+			ModTime:  time.Now(),
+			MimeType: transfer.MESSAGE_MIME_TYPE,
+		},
+		Reader: bytes.NewBufferString(message),
+	}
+}
+
+// UNKNOWN_SIZE is the Size of a Source that is sent until its reader ends.
+const UNKNOWN_SIZE = encryptservice.UNKNOWN_SIZE
+
+// ReaderSource sends everything r returns until EOF, like a pipe, as a file
+// called name.
+func ReaderSource(name string, r io.Reader) *Source {
+	return &Source{
+		FileInfo: FileInfo{
+			Name:     name,
+			Size:     UNKNOWN_SIZE,
+			Mode:     0644,
+			ModTime:  time.Now(),
+			MimeType: "application/octet-stream",
+		},
+		Reader: r,
+	}
+}
+
+// OpenSource opens a file or directory to send, directories are sent as a tar
+// archive. The closer has to be closed once the source was sent.
+func OpenSource(path string) (*Source, io.Closer, error) {
+	// so that "." or "dir/.." still send the directory's real name
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	src := &Source{
+		FileInfo: FileInfo{
+			Name:    filepath.Base(path),
+			Mode:    info.Mode(),
+			ModTime: info.ModTime(),
+		},
+	}
+
+	if info.IsDir() {
+		src.MimeType = transfer.DIRECTORY_MIME_TYPE
+		src.Size, err = archive.Size(path)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		dir := archive.NewReader(path)
+		src.Reader = dir
+
+		return src, dir, nil
+	}
+
+	file, err := os.OpenFile(path, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	src.Size = info.Size()
+	src.ID = transfer.FileID(src.Name, src.Size, info.ModTime())
+	src.MimeType = transfer.DetectMimeType(src.Name, file)
+	src.Reader = file
+
+	return src, file, nil
+}